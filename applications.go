@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Whitelist applications.  Anyone in chat can apply for a player to be
+//whitelisted, the alerts rooms are told, and staff approve or deny it.  The
+//applicant hears back privately.
+
+//What an application can be
+const (
+	APPLICATION_PENDING  = "pending"
+	APPLICATION_APPROVED = "approved"
+	APPLICATION_DENIED   = "denied"
+)
+
+type application struct {
+	ID        int
+	Player    string
+	Note      string
+	Applicant string //Identity, e.g. irc:nick
+	Nick      string //Display name, for telling them how it went
+	Transport string
+	Room      string //Where they applied from
+	Server    string
+	Submitted time.Time
+
+	State     string
+	DecidedBy string
+	Decided   time.Time
+	Reason    string
+}
+
+//What's kept in applicationsFile
+type applicationQueue struct {
+	NextID       int
+	Applications []*application
+}
+
+const (
+	applicationsFile    = "applications.json"
+	ApplicationCooldown = 300 //Seconds an applicant must wait between applications
+)
+
+var (
+	applications     *applicationQueue //Loaded on first use
+	applicationsLock sync.Mutex
+
+	playerNameRegex *regexp.Regexp = regexp.MustCompile(`^[a-zA-Z0-9_]{3,16}$`)
+)
+
+//Must be called with applicationsLock held
+func loadApplications() {
+	if applications != nil {
+		return
+	}
+
+	applications = &applicationQueue{NextID: 1}
+	if err := loadData(applicationsFile, applications); err != nil {
+		logErr.Printf("Couldn't read %s: %s\n", applicationsFile, err)
+	}
+}
+
+//Must be called with applicationsLock held
+func saveApplications() {
+	if err := saveData(applicationsFile, applications); err != nil {
+		logErr.Printf("Couldn't save %s: %s\n", applicationsFile, err)
+	}
+}
+
+//Queue an application, unless player already has one pending or its
+//applicant has only just applied
+func submitApplication(app application) (*application, error) {
+	applicationsLock.Lock()
+	defer applicationsLock.Unlock()
+
+	loadApplications()
+	for i := len(applications.Applications) - 1; i >= 0; i-- {
+		last := applications.Applications[i]
+		if !strings.EqualFold(last.Applicant, app.Applicant) {
+			continue
+		}
+		if wait := ApplicationCooldown*time.Second - time.Since(last.Submitted); wait > 0 {
+			return nil, fmt.Errorf("You applied with #%d just now, wait %v before applying again.",
+				last.ID, wait/time.Second*time.Second+time.Second)
+		}
+		break
+	}
+	for _, a := range applications.Applications {
+		if a.State == APPLICATION_PENDING && strings.EqualFold(a.Player, app.Player) {
+			return nil, fmt.Errorf("%s already has an application waiting, #%d.", a.Player, a.ID)
+		}
+	}
+
+	app.ID = applications.NextID
+	app.State = APPLICATION_PENDING
+	app.Submitted = time.Now()
+	applications.NextID++
+	applications.Applications = append(applications.Applications, &app)
+	saveApplications()
+	return &app, nil
+}
+
+//A copy of application id
+func findApplication(id int) (application, bool) {
+	applicationsLock.Lock()
+	defer applicationsLock.Unlock()
+
+	loadApplications()
+	for _, a := range applications.Applications {
+		if a.ID == id {
+			return *a, true
+		}
+	}
+	return application{}, false
+}
+
+//Record the decision on application id, if it's still pending
+func decideApplication(id int, state, by, reason string) (application, error) {
+	applicationsLock.Lock()
+	defer applicationsLock.Unlock()
+
+	loadApplications()
+	for _, a := range applications.Applications {
+		if a.ID != id {
+			continue
+		}
+		if a.State != APPLICATION_PENDING {
+			return *a, fmt.Errorf("Application #%d was already %s by %s.", a.ID, a.State, a.DecidedBy)
+		}
+
+		a.State, a.DecidedBy, a.Decided, a.Reason = state, by, time.Now(), reason
+		saveApplications()
+		return *a, nil
+	}
+	return application{}, fmt.Errorf("There's no application #%d.", id)
+}
+
+//Applications in the given state, or all of them if it's empty, oldest first
+func listApplications(state string) []application {
+	applicationsLock.Lock()
+	defer applicationsLock.Unlock()
+
+	loadApplications()
+	var found []application
+	for _, a := range applications.Applications {
+		if state == "" || a.State == state {
+			found = append(found, *a)
+		}
+	}
+	return found
+}
+
+func (a application) String() string {
+	s := fmt.Sprintf("#%d: %s for %s, %v ago", a.ID, a.Applicant, a.Player,
+		time.Since(a.Submitted)/time.Second*time.Second)
+	if a.Note != "" {
+		s += ": " + a.Note
+	}
+	if a.State != APPLICATION_PENDING {
+		s += fmt.Sprintf(" (%s by %s", a.State, a.DecidedBy)
+		if a.Reason != "" {
+			s += ": " + a.Reason
+		}
+		s += ")"
+	}
+	return s
+}
+
+//Let the applicant know how their application went: privately on IRC, or
+//by mail if they've gone, and in the room they applied from elsewhere
+func (a application) notify(text string) {
+	if a.Transport == ircChat.Name() {
+		if ircChat.Online() && ircNickPresent(a.Nick) {
+			ircChat.Send(a.Nick, toChat(ircChat, text))
+		} else {
+			sendMail(a.Applicant, "whitelist", text)
+		}
+		return
+	}
+
+	for _, t := range transports {
+		if t.Name() == a.Transport {
+			deliver(t, a.Room, "", a.Nick+": "+text)
+		}
+	}
+}
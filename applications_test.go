@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ckolbeck/mcserver"
+)
+
+//A server that answers each console command with the next of lines
+func answeringServer(lines ...string) *minecraft {
+	m := &minecraft{Server: &mcserver.Server{In: make(chan string, 1)}, name: "survival", response: make(chan string, 16)}
+	m.response <- "[12:00:00] [Server thread/INFO]: Stale output"
+	go func() {
+		for _, line := range lines {
+			<-m.In
+			m.response <- line
+		}
+	}()
+	return m
+}
+
+func TestWhitelistAdd(t *testing.T) {
+	for _, test := range []struct {
+		line, said string
+		ok         bool
+	}{
+		{"[12:00:00] [Server thread/INFO]: Added Steve to the whitelist", "Added Steve to the whitelist", true},
+		{"[12:00:00 INFO]: Player is already whitelisted", "Player is already whitelisted", true},
+		{"[12:00:00] [Server thread/INFO]: That player does not exist", "That player does not exist", false},
+		{"2013-05-01 12:00:00 [INFO] Could not add Steve to the whitelist", "Could not add Steve to the whitelist", false},
+	} {
+		timeout := false
+		said, ok := answeringServer(test.line).whitelistAdd("Steve", &timeout)
+		if said != test.said || ok != test.ok {
+			t.Errorf("%q: got %q, %v", test.line, said, ok)
+		}
+	}
+
+	//Giving up once the command's timed out
+	timeout := true
+	if said, ok := answeringServer().whitelistAdd("Steve", &timeout); ok || said != "the server didn't answer" {
+		t.Errorf("timed out: got %q, %v", said, ok)
+	}
+}
+
+func TestApplicationCooldown(t *testing.T) {
+	withTestConfig(t, nil)
+
+	first, err := submitApplication(application{Player: "Steve", Applicant: "irc:alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decideApplication(first.ID, APPLICATION_DENIED, "irc:op", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	//Not again straight away, even for someone else
+	if _, err := submitApplication(application{Player: "Alex", Applicant: "irc:Alice"}); err == nil ||
+		!strings.HasPrefix(err.Error(), "You applied with #1 just now, wait ") {
+		t.Errorf("applied again straight away: %v", err)
+	}
+
+	//Others aren't held up by it
+	if _, err := submitApplication(application{Player: "Alex", Applicant: "irc:bob"}); err != nil {
+		t.Errorf("bob couldn't apply: %s", err)
+	}
+
+	//And once it's passed, alice can try again
+	applicationsLock.Lock()
+	applications.Applications[0].Submitted = time.Now().Add(-ApplicationCooldown * time.Second)
+	applicationsLock.Unlock()
+	if app, err := submitApplication(application{Player: "Steve", Applicant: "irc:alice"}); err != nil || app.ID != 3 {
+		t.Errorf("alice couldn't apply again: %+v, %v", app, err)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Reads the server's own ban lists: banned-players.json and banned-ips.json
+//from 1.7.6 on, and the banned-players.txt and banned-ips.txt before that.
+//The oldest text lists are just a name or address per line; from 1.3 they
+//carry the same fields as the JSON, separated by |.
+
+//A line of a ban list
+type banEntry struct {
+	UUID    string `json:"uuid"`
+	Name    string `json:"name"`
+	IP      string `json:"ip"`
+	Created string `json:"created"`
+	Source  string `json:"source"`
+	Expires string `json:"expires"`
+	Reason  string `json:"reason"`
+}
+
+//The name or address banned
+func (e banEntry) target() string {
+	if e.IP != "" {
+		return e.IP
+	}
+	return e.Name
+}
+
+//The ban list file in dir for players, or IPs, and whether it's JSON
+func banListFile(dir string, ip bool) (string, bool) {
+	base := "banned-players"
+	if ip {
+		base = "banned-ips"
+	}
+
+	file := filepath.Join(dir, base+".json")
+	if _, err := os.Stat(file); err == nil {
+		return file, true
+	}
+	return filepath.Join(dir, base+".txt"), false
+}
+
+//The bans in dir's player, or IP, ban list
+func readBanList(dir string, ip bool) ([]banEntry, error) {
+	file, isJSON := banListFile(dir, ip)
+
+	if isJSON {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var entries []banEntry
+		return entries, json.Unmarshal(raw, &entries)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []banEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "|")
+		for len(fields) < 5 {
+			fields = append(fields, "")
+		}
+		e := banEntry{Created: fields[1], Source: fields[2], Expires: fields[3], Reason: fields[4]}
+		if ip {
+			e.IP = fields[0]
+		} else {
+			e.Name = fields[0]
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+//Whether target (a name, or with ip an address) is on the ban list in dir
+func onBanList(dir, target string, ip bool) (bool, error) {
+	entries, err := readBanList(dir, ip)
+	if err != nil {
+		return false, err
+	}
+
+	for _, e := range entries {
+		if strings.EqualFold(e.target(), target) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+const BanPageSize = 10 //Bans per page of 'ban list'
+
+//A ban from the server's lists, the bot's records, or both
+type banRecord struct {
+	banEntry
+	sanction *sanction //If it was issued through the bot
+}
+
+//The servers whose ban lists count for m: its backends if it's a proxy
+func (m *minecraft) banListServers() []*minecraft {
+	if m.config().Type != "" {
+		return m.backends()
+	}
+	return []*minecraft{m}
+}
+
+//Everything banned on m, its ban lists merged with the bot's own records,
+//sorted by name
+func (m *minecraft) banRecords() ([]banRecord, error) {
+	byTarget := make(map[string]*banRecord)
+	var firstErr error
+
+	for _, s := range m.banListServers() {
+		for _, ip := range []bool{false, true} {
+			entries, err := readBanList(s.config().MCServerDir, ip)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %s", s.name, err)
+				}
+				continue
+			}
+
+			for _, e := range entries {
+				if _, ok := byTarget[strings.ToLower(e.target())]; !ok {
+					byTarget[strings.ToLower(e.target())] = &banRecord{banEntry: e}
+				}
+			}
+		}
+	}
+
+	for _, s := range allSanctions() {
+		if srv := s.server(); srv == nil || !sameNetwork(srv, m) {
+			continue
+		}
+		s := s
+		r, ok := byTarget[strings.ToLower(s.Target)]
+		if !ok {
+			r = &banRecord{}
+			if s.ip() {
+				r.IP = s.Target
+			} else {
+				r.Name = s.Target
+			}
+			byTarget[strings.ToLower(s.Target)] = r
+		}
+		r.sanction = &s
+	}
+
+	var records []banRecord
+	for _, r := range byTarget {
+		records = append(records, *r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return strings.ToLower(records[i].target()) < strings.ToLower(records[j].target())
+	})
+	return records, firstErr
+}
+
+//Why r was banned, preferring what the bot was told
+func (r banRecord) reason() string {
+	if r.sanction != nil && r.sanction.Reason != "" {
+		return r.sanction.Reason
+	}
+	return r.Reason
+}
+
+//When r runs out, if it does
+func (r banRecord) expiry() string {
+	if r.sanction != nil && !r.sanction.permanent() {
+		return fmt.Sprintf("in %v", time.Until(r.sanction.Expires)/time.Second*time.Second)
+	}
+	if r.Expires == "" || strings.EqualFold(r.Expires, "forever") {
+		return ""
+	}
+	return r.Expires
+}
+
+//Who banned r
+func (r banRecord) issuer() string {
+	if r.sanction != nil {
+		return r.sanction.Issuer
+	}
+	return r.Source
+}
+
+//r in a line
+func (r banRecord) String() string {
+	var details []string
+	if issuer := r.issuer(); issuer != "" {
+		details = append(details, "by "+issuer)
+	}
+	if expiry := r.expiry(); expiry != "" {
+		details = append(details, "expires "+expiry)
+	}
+
+	s := r.target()
+	if reason := r.reason(); reason != "" {
+		s += ": " + reason
+	}
+	if len(details) > 0 {
+		s += " (" + strings.Join(details, ", ") + ")"
+	}
+	return s
+}
+
+//Everything known about r, a line per detail
+func (r banRecord) info() []string {
+	kind := "Player"
+	if r.IP != "" {
+		kind = "IP"
+	}
+	info := []string{kind + " " + r.target() + " is banned."}
+	if r.UUID != "" {
+		info = append(info, "UUID: "+r.UUID)
+	}
+	if reason := r.reason(); reason != "" {
+		info = append(info, "Reason: "+reason)
+	}
+	if r.Created != "" {
+		listed := "On the server's list since " + r.Created
+		if r.Source != "" {
+			listed += ", from " + r.Source
+		}
+		info = append(info, listed)
+	}
+	if r.sanction != nil {
+		info = append(info, fmt.Sprintf("Issued through the bot by %s on %s, %v ago, as a %s", r.sanction.Issuer,
+			r.sanction.Server, time.Since(r.sanction.Issued)/time.Second*time.Second, r.sanction.Kind))
+	}
+	if expiry := r.expiry(); expiry != "" {
+		info = append(info, "Expires "+expiry)
+	} else {
+		info = append(info, "Permanent")
+	}
+	return info
+}
+
+//Whether r's name, address or reason contains text
+func (r banRecord) matches(text string) bool {
+	text = strings.ToLower(text)
+	return strings.Contains(strings.ToLower(r.target()), text) || strings.Contains(strings.ToLower(r.reason()), text)
+}
+
+//One page of records, with a heading saying which
+func banPage(heading string, records []banRecord, page int) []string {
+	pages := (len(records) + BanPageSize - 1) / BanPageSize
+	if page < 1 || page > pages {
+		return []string{fmt.Sprintf("%s: there are %d pages.", heading, pages)}
+	}
+
+	reply := []string{fmt.Sprintf("%s, page %d of %d (%d in all):", heading, page, pages, len(records))}
+	end := page * BanPageSize
+	if end > len(records) {
+		end = len(records)
+	}
+	for _, r := range records[(page-1)*BanPageSize : end] {
+		reply = append(reply, r.String())
+	}
+	return reply
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadBanList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcbot-banlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//Before 1.3, a name or address a line
+	write("banned-players.txt", "# Updated 01/01/12\nGriefer\n\n")
+	write("banned-ips.txt", "10.0.0.1\n")
+	if got, err := readBanList(dir, false); err != nil || !reflect.DeepEqual(got, []banEntry{{Name: "Griefer"}}) {
+		t.Errorf("old players: %+v, %v", got, err)
+	}
+	if got, err := readBanList(dir, true); err != nil || !reflect.DeepEqual(got, []banEntry{{IP: "10.0.0.1"}}) {
+		t.Errorf("old IPs: %+v, %v", got, err)
+	}
+
+	//1.3 to 1.7.5
+	write("banned-players.txt", "Griefer|2013-05-01 12:00:00 +0000|Mod1|Forever|Lava|in spawn\n")
+	want := []banEntry{{Name: "Griefer", Created: "2013-05-01 12:00:00 +0000", Source: "Mod1", Expires: "Forever", Reason: "Lava"}}
+	if got, err := readBanList(dir, false); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("piped players: %+v, %v", got, err)
+	}
+
+	//1.7.6 on, taking over from the text list
+	write("banned-players.json", `[{"uuid":"b50ad385-829d-3141-a216-7e7d7539ba7f","name":"Steve",`+
+		`"created":"2024-01-01 12:00:00 +0000","source":"Server","expires":"forever","reason":"Banned by an operator."}]`)
+	want = []banEntry{{UUID: "b50ad385-829d-3141-a216-7e7d7539ba7f", Name: "Steve", Created: "2024-01-01 12:00:00 +0000",
+		Source: "Server", Expires: "forever", Reason: "Banned by an operator."}}
+	if got, err := readBanList(dir, false); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("JSON players: %+v, %v", got, err)
+	}
+	if banned, err := onBanList(dir, "steve", false); err != nil || !banned {
+		t.Errorf("steve not found: %v", err)
+	}
+	if banned, err := onBanList(dir, "Griefer", false); err != nil || banned {
+		t.Errorf("the text list was read too: %v", err)
+	}
+
+	write("banned-ips.json", "not json")
+	if _, err := readBanList(dir, true); err == nil {
+		t.Error("read a broken list")
+	}
+}
+
+func TestBanListArgs(t *testing.T) {
+	dir := withTestConfig(t, nil)
+	err := ioutil.WriteFile(filepath.Join(dir, "banned-players.txt"),
+		[]byte("Griefer|||Forever|lava in spawn\nList|||Forever|named badly\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := &command{server: &minecraft{name: "survival", conf: ServerConfig{Name: "survival", MCServerDir: dir}}}
+
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "Bans, page 1 of 1 (2 in all):"},
+		{[]string{"list", "2"}, "Bans: there are 1 pages."},
+		{[]string{"list", "two"}, "Usage: "},
+		{[]string{"search", "lava", "in"}, "Bans matching lava in, page 1 of 1 (1 in all):"},
+		{[]string{"search", "lava", "1"}, "Bans matching lava, page 1 of 1 (1 in all):"},
+		{[]string{"search", "1"}, "No bans match 1."},
+		{[]string{"info", "list"}, "Player List is banned."},
+	} {
+		if got := banListCmd(cmd, test.args); !strings.HasPrefix(got[0], test.want) {
+			t.Errorf("%q: got %q", test.args, got)
+		}
+	}
+	if got := bansCmd(cmd, nil, new(bool)); got[0] != "Bans, page 1 of 1 (2 in all):" {
+		t.Errorf("bans: got %q", got)
+	}
+}
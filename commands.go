@@ -2,63 +2,118 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
-	irc "github.com/ckolbeck/ircbot"
 	"io/ioutil"
 	"net"
 	"os/exec"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
-type commandFunc func([]string, *bool) []string
+type commandFunc func(*command, []string, *bool) []string
 type command struct {
-	raw     string
-	sender  string
-	channel string
-	source  int
+	raw        string
+	sender     string
+	identities []string //What permissions are checked against, e.g. irc:nick
+	unverified bool     //From a chat user no account vouches for, so links don't apply
+	channel    string   //Where to reply, for chat commands
+	source     int
+	transport  chatTransport //For chat commands
+	server     *minecraft    //The server it acts on
+	origin     *minecraft    //For in game commands, the server it came from
 }
 
 const (
 	DefaultStopDelay = 5
 	CommandTimeout   = 60
+	ConsoleReplyWait = 2  //Seconds console collects output for
+	ConsoleReplyMax  = 15 //Lines of output console replies with
 	notImplemented   = "This command is not yet implemented"
 )
 
 var commandMap map[string]commandFunc = map[string]commandFunc{
-	"?":         helpCmd,
-	"backup":    backupCmd,
-	"ban":       banCmd,
-	"pardon":    pardonCmd,
-	"give":      giveCmd,
-	"help":      helpCmd,
-	"kick":      kickCmd,
-	"list":      listCmd,
-	"mapgen":    mapgenCmd,
-	"restart":   restartCmd,
-	"source":    sourceCmd,
-	"start":     startCmd,
-	"state":     stateCmd,
-	"status":    stateCmd,
-	"stop":      stopCmd,
-	"tp":        tpCmd,
-	"version":   versionCmd,
-	"whitelist": whitelistCmd,
+	"?":            helpCmd,
+	"access":       accessCmd,
+	"backup":       backupCmd,
+	"ban":          banCmd,
+	"bans":         bansCmd,
+	"pardon":       pardonCmd,
+	"apply":        applyCmd,
+	"applications": applicationsCmd,
+	"approve":      approveCmd,
+	"console":      consoleCmd,
+	"deaths":       deathsCmd,
+	"deny":         denyCmd,
+	"give":         giveCmd,
+	"help":         helpCmd,
+	"helpop":       helpopCmd,
+	"ignore":       ignoreCmd,
+	"kick":         kickCmd,
+	"last":         lastCmd,
+	"link":         linkCmd,
+	"list":         listCmd,
+	"mail":         mailCmd,
+	"mapgen":       mapgenCmd,
+	"op":           opCmd,
+	"relay":        relayCmd,
+	"report":       reportCmd,
+	"reload":       reloadCmd,
+	"restart":      restartCmd,
+	"seen":         seenCmd,
+	"servers":      serversCmd,
+	"source":       sourceCmd,
+	"start":        startCmd,
+	"state":        stateCmd,
+	"status":       stateCmd,
+	"stop":         stopCmd,
+	"tell":         tellCmd,
+	"tickets":      ticketsCmd,
+	"tp":           tpCmd,
+	"version":      versionCmd,
+	"whitelist":    whitelistCmd,
 }
 
 var commandHelpMap map[string]string = map[string]string{
 	"?": "? [command]: If [command] is present, get usage information on that command, otherwise" +
 		" display a list of available commands",
 
+	"access": "access <grant|revoke <level> <identity>|allow|deny <level> <command>|show [who]>: " +
+		"Examine or change who may run which commands.  Changes are saved to the config file.",
+
 	"backup": "backup [name]: Force the creation of a persistant backup.  If [name] is present," +
 		" the file will be named 'name.backup', otherwise it will be '<RFC3339 time>.backup'.",
 
-	"ban": "ban <name or ip> [duration]: Ban a player by ip or name.  If [duration] is present, " +
-		"the ban will be lifted after than many minutes. " +
-		"If no arguments are passed, get a list of currently banned players and IPs.",
+	"ban": fmt.Sprintf("ban <name or ip> [duration] [reason]: Ban a player by ip or name, network wide"+
+		" behind a proxy, telling the server [reason].  If [duration] is present, e.g. 90m or 2h, the ban will"+
+		" be lifted after that long, even if the bot is restarted in between.  With no arguments or 'list"+
+		" [page]', list current bans %d to a page.  'info <name or ip>' shows the reason, source, issuer and"+
+		" expiry of a ban, and 'search <text> [page]' finds bans by name, address or reason.  A player named"+
+		" list, info or search is banned with 'ban -- <name>'.  While the server is stopped its ban list is"+
+		" edited directly, which needs the player to have joined before unless it's in offline mode.",
+		BanPageSize),
+
+	"bans": "bans [page]: The same as 'ban list [page]', for those who may see bans but not issue them.",
+
+	"pardon": "pardon <name or ip>: Remove a player from the banned list by name or IP.  While the server is" +
+		" stopped its ban list is edited directly.",
+
+	"apply": "apply <player> [note]: Ask for <player> to be whitelisted.  Staff are told, and you'll hear" +
+		" back privately once they've decided.",
+
+	"applications": "applications [all]: List the whitelist applications waiting for a decision, or all of them.",
+
+	"approve": "approve <id>: Whitelist the player in application <id> and let the applicant know.",
+
+	"console": fmt.Sprintf("console <server command>: Run a command on the server console and get "+
+		"back whatever it prints in the next %d seconds.", ConsoleReplyWait),
+
+	"deaths": "deaths [player]: Show how many times [player] has died and how, or who has died most.",
 
-	"pardon": "pardon <name or ip>: Remove a player from the banned list by name or IP.",
+	"deny": "deny <id> [reason]: Turn down whitelist application <id>, letting the applicant know [reason].",
 
 	"give": "give <player> <item id or name> [num]: Spawn <item> at <player>'s location.  If [num] " +
 		"is present, spawn that many of <item>.  Some items may not be spawnable by name.",
@@ -66,18 +121,53 @@ var commandHelpMap map[string]string = map[string]string{
 	"help": "help [command]: If [command] is present, get usage information on that command, otherwise" +
 		" display a list of available commands",
 
-	"kick": "kick <player> [duration]: Kick <player> off the server.  Player will be able to rejoin" +
-		" immediatly unless [duration] is present, in which case they will be banned for that many minutes.",
+	"helpop": "helpop <message>: From in game, ask staff for help.  Moderators in chat are pinged, and you'll" +
+		" be told when someone picks it up.",
 
-	"list": "list: List all players currently connected to the server.",
+	"ignore": "ignore <add <nick>|remove <nick>|list>: Manipulate or examine the list of IRC nicks the bot ignores.",
+
+	"kick": "kick <player> [duration] [reason]: Kick <player> off the server.  Player will be able to rejoin" +
+		" immediatly unless [duration] is present, e.g. 30m, in which case they will be banned for that long.",
+
+	"last": fmt.Sprintf("last [n] [player]: Get the last [n] lines of game chat, joins and deaths, or just"+
+		" [player]'s, sent privately where possible.  If [n] is not present, get %d.", DefaultLastLines),
+
+	"link": fmt.Sprintf("link [<player>|<code>|remove]: Link your chat account with a Minecraft player, so"+
+		" either has the other's permissions.  From chat, link <player> gives a code, which the player then"+
+		" confirms in game with link <code> within %d minutes.  On IRC you need to be logged in to an"+
+		" account.  With no arguments, show your link.",
+		LinkCodeTimeout),
+
+	"list": "list: List all players currently connected to the server, or to the whole network if it's" +
+		" behind a proxy.",
+
+	"mail": "mail <list|read|clear>: List the messages left for you, read the new ones, or delete them all.",
 
 	"mapgen": "mapgen [stop]: Force a run of the map generator.  If a mapgen is currently running, get an" +
 		" estimate of its progress.",
 
+	"op": "op <add <name>|remove <name>|list>: Make players server operators, or no longer, or list them." +
+		"  While the server is stopped its ops file is edited directly.",
+
+	"relay": "relay [on|off [event]|mute <who>|unmute <who>]: Show or change what's relayed between chat" +
+		" and the game.  Events are chat, action, join, leave, death, advancement, start and stop.  <who>" +
+		" is a player or chat nick, or an identity such as irc:nick.  Changes are saved to the config file.",
+
+	"report": "report <player> <reason>: From in game, report <player> to staff.  Where you are is noted" +
+		" with it, and you'll be told when someone picks it up.",
+
+	"reload": "reload: Reread the config file, apply what can be applied live and report what changed.",
+
 	"restart": fmt.Sprintf("restart [delay] [message]: Restart the server after issuing [message] and "+
 		"waiting [delay] seconds.  If [delay] is not present, wait %d seconds.",
 		DefaultStopDelay/int64(1e9)),
 
+	"servers": "servers: List the Minecraft servers this bot manages.  Any command can be run against" +
+		" a particular server by prefixing it with @<server>, e.g. '@creative list'.",
+
+	"seen": "seen <player>: Find out where <player> is, or when and where they were last online.  <player>" +
+		" may also be a chat identity linked to them, such as irc:nick.",
+
 	"source": "source: Get information on this bot's source code.",
 
 	"start": "start: Start the Minecraft server if it's stopped.",
@@ -87,22 +177,19 @@ var commandHelpMap map[string]string = map[string]string{
 	"stop": fmt.Sprintf("stop [delay] [message]: Stop the server after issuing [message] and waiting "+
 		"[delay] seconds.  If [delay] is not present, wait %d seconds.", DefaultStopDelay/int64(1e9)),
 
-	"tp": "tp <player> <destination player>: Teleport <player> to <destination player>'s location.",
-
-	"version": "version: Get the version number of the currently running minecraft server.",
+	"tell": "tell <player> <message>: Send <message> to <player> alone, or leave it for when they next join." +
+		"  In game, tell <nick> <message> sends it to an IRC user instead.",
 
-	"whitelist": "whitelist <add <name>|remove <name>|list>: Manipulate or examine the server's whitelist.",
-}
+	"tickets": "tickets [list|claim <id> [force]|close <id> [note]]: List open reports and help requests, take" +
+		" one on, or close it.  The player is told either way.  Someone else's ticket is only taken with force.",
 
-func directedIRC(cmd string, m *irc.Message) string {
+	"tp": "tp <player> <destination player>: Teleport <player> to <destination player>'s location.",
 
-	if m.Args[0] == config.Nick {
-		commands <- &command{cmd, m.GetSender(), m.GetSender(), SOURCE_IRC}
-	} else {
-		commands <- &command{cmd, m.GetSender(), m.Args[0], SOURCE_IRC}
-	}
+	"version": "version: Get the version number of the currently running minecraft server.",
 
-	return ""
+	"whitelist": "whitelist <add <name>|remove <name>|list>: Manipulate or examine the server's whitelist." +
+		"  While the server is stopped its whitelist file is edited directly, which needs the player to have" +
+		" joined before unless it's in offline mode.",
 }
 
 func commandDispatch() {
@@ -114,31 +201,53 @@ func commandDispatch() {
 			continue
 		}
 
-		f, exists := commandMap[split[0]]
+		//In game replies go back to the server the command came from, even
+		//if it targets another
+		cmd.origin = cmd.server
+
+		//'@name command' runs command against the named server instead of
+		//the one the command came from
+		var target string
+		if strings.HasPrefix(split[0], "@") {
+			target = split[0][1:]
+			split = split[1:]
+			cmd.server = findServer(target)
+		} else if cmd.server == nil {
+			cmd.server = findServer("")
+		}
+
+		var f commandFunc
+		exists := false
+		if len(split) > 0 {
+			f, exists = commandMap[split[0]]
+		}
 
-		if !exists {
+		if len(split) == 0 {
+			reply = []string{"Usage: @<server> <command> [args]"}
+			split = []string{""}
+		} else if cmd.server == nil && target != "" {
+			reply = []string{"Unknown server: " + target}
+		} else if cmd.server == nil {
+			reply = []string{"No server to run that on."}
+		} else if !exists {
 			reply = []string{"Unknown command: " + split[0]}
-		} else if !allowed(cmd.sender, split[0], cmd.source) {
+		} else if cmd.source == SOURCE_CHAT && !roomAllowsCommand(cmd.transport, cmd.channel, split[0]) {
+			reply = []string{"'" + split[0] + "' can't be used here."}
+		} else if !allowed(cmd, split[0]) {
 			reply = []string{cmd.sender + " is not allowed to invoke '" + split[0] +
 				"'. This incident will be reported."}
 
 			logInfo.Printf("%s attempted '%s'\n", cmd.sender, cmd.raw)
+			alert(fmt.Sprintf("%s attempted '%s'", strings.Join(cmd.identities, "/"), cmd.raw))
 		} else {
 			//Flush the server output queue first
-		Flush:
-			for {
-				select {
-				case <-commandResponse:
-				default:
-					break Flush
-				}
-			}
+			cmd.server.flushResponse()
 
 			returned := make(chan int)
 			timeout := false
 
 			go func() {
-				reply = f(split[1:], &timeout)
+				reply = f(cmd, split[1:], &timeout)
 				returned <- 1
 			}()
 
@@ -154,40 +263,41 @@ func commandDispatch() {
 		switch cmd.source {
 		case SOURCE_MC:
 			for _, s := range reply {
-				server.In <- "say " + s
+				cmd.origin.say(s)
+			}
+		case SOURCE_CHAT:
+			for _, s := range reply {
+				cmd.transport.Send(cmd.channel, toChat(cmd.transport, s))
 			}
-		case SOURCE_IRC:
+		case SOURCE_INTERNAL:
 			for _, s := range reply {
-				bot.Send(&irc.Message{
-					Command:  "PRIVMSG",
-					Args:     []string{cmd.channel},
-					Trailing: s,
-				})
+				logInfo.Printf("%s: %s\n", split[0], s)
 			}
 		}
 	}
 }
 
-func allowed(sender, op string, source int) bool {
-	//Is op allowed by default?
-	if exists, allowed := config.defaultAccess[op]; exists && allowed {
+func allowed(cmd *command, op string) bool {
+	conf := currentConfig()
+
+	if cmd.source == SOURCE_INTERNAL {
 		return true
 	}
 
-	switch source {
-	case SOURCE_MC:
-		sender = "mc:" + sender
-	case SOURCE_IRC:
-
-		//TODO: Make sure irc nick is registered
-
-		sender = "irc:" + sender
+	//Is op allowed by default?
+	if exists, allowed := conf.defaultAccess[op]; exists && allowed {
+		return true
 	}
 
 	//If user is marked as part of any groups
-	if levels, ok := config.accessLevelMembers[sender]; ok {
-		for _, l := range levels {
-			level := config.accessLevels[l]
+	//Or through whoever they're linked to, if they're who they say
+	identities := cmd.identities
+	if !cmd.unverified {
+		identities = withLinks(identities)
+	}
+	for _, identity := range identities {
+		for _, l := range conf.accessLevelMembers[identity] {
+			level := conf.accessLevels[l]
 			if exists, allowed := level[op]; exists && allowed {
 				return true
 			}
@@ -198,7 +308,7 @@ func allowed(sender, op string, source int) bool {
 }
 
 //func waitForRegex() []string
-func helpCmd(args []string, timeout *bool) []string {
+func helpCmd(cmd *command, args []string, timeout *bool) []string {
 	var reply string
 	var ok bool
 
@@ -207,6 +317,9 @@ func helpCmd(args []string, timeout *bool) []string {
 			reply += ", " + k
 		}
 		reply = "Available commands: " + reply[2:]
+		if len(servers) > 1 {
+			reply += ".  Prefix any with @<server> to run it on another server, see 'servers'."
+		}
 	} else if len(args) == 1 {
 		reply, ok = commandHelpMap[args[0]]
 		if !ok {
@@ -219,17 +332,135 @@ func helpCmd(args []string, timeout *bool) []string {
 	return []string{reply}
 }
 
-func backupCmd(args []string, timeout *bool) []string {
-	return []string{notImplemented}
+func accessCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) == 0 {
+		return []string{"Usage: " + commandHelpMap["access"]}
+	}
+
+	switch args[0] {
+	case "grant", "revoke":
+		if len(args) != 3 {
+			return []string{"Usage: " + commandHelpMap["access"]}
+		}
+
+		level, who := args[1], args[2]
+		if !validIdentity(who) {
+			return []string{"Identities must be given as mc:<name>, irc:<nick>, matrix:<user id>, " +
+				"discord:<user id> or discord-role:<role id>."}
+		}
+
+		err := updateConfig(func(c *Config) error {
+			l, exists := c.AccessLevels[level]
+			if args[0] == "grant" {
+				if c.AccessLevels == nil {
+					c.AccessLevels = make(map[string]AccessLevel)
+				}
+				l.Members = addString(l.Members, who)
+			} else if !exists {
+				return errors.New("No such access level: " + level)
+			} else {
+				l.Members = removeString(l.Members, who)
+			}
+			c.AccessLevels[level] = l
+			return nil
+		})
+		if err != nil {
+			return []string{err.Error()}
+		}
+
+		if args[0] == "grant" {
+			return []string{who + " added to " + level + "."}
+		}
+		return []string{who + " removed from " + level + "."}
+
+	case "allow", "deny":
+		if len(args) != 3 {
+			return []string{"Usage: " + commandHelpMap["access"]}
+		}
+
+		level, op := args[1], args[2]
+		if _, exists := commandHelpMap[op]; !exists { //commandMap would be an initialization loop
+			return []string{"Unknown command: " + op}
+		}
+
+		err := updateConfig(func(c *Config) error {
+			l, exists := c.AccessLevels[level]
+			if args[0] == "allow" {
+				if c.AccessLevels == nil {
+					c.AccessLevels = make(map[string]AccessLevel)
+				}
+				l.Allowed = addString(l.Allowed, op)
+			} else if !exists {
+				return errors.New("No such access level: " + level)
+			} else {
+				l.Allowed = removeString(l.Allowed, op)
+			}
+			c.AccessLevels[level] = l
+			return nil
+		})
+		if err != nil {
+			return []string{err.Error()}
+		}
+
+		if args[0] == "allow" {
+			return []string{level + " may now use '" + op + "'."}
+		}
+		return []string{level + " may no longer use '" + op + "'."}
+
+	case "show":
+		if len(args) > 2 {
+			return []string{"Usage: " + commandHelpMap["access"]}
+		}
+
+		return showAccess(currentConfig(), args[1:])
+	}
+
+	return []string{"Usage: " + commandHelpMap["access"]}
 }
 
-func banCmd(args []string, timeout *bool) []string {
-	if len(args) == 0 || len(args) > 2 {
-		return []string{"Usage: " + commandHelpMap["ban"]}
+func showAccess(conf *Config, who []string) (reply []string) {
+	if len(who) == 0 {
+		reply = append(reply, "Default: "+strings.Join(conf.DefaultAccess, ", "))
+		for title, level := range conf.AccessLevels {
+			reply = append(reply, fmt.Sprintf("%s: members %s; allowed %s", title,
+				strings.Join(level.Members, ", "), strings.Join(level.Allowed, ", ")))
+		}
+		return
 	}
 
-	if !server.IsRunning() {
-		return []string{"Server not currently running."}
+	identities := []string{who[0]}
+	if !validIdentity(who[0]) {
+		identities = []string{"mc:" + who[0]}
+		for _, t := range transports {
+			identities = append(identities, t.Name()+":"+who[0])
+		}
+	}
+
+	for _, identity := range identities {
+		levels := conf.accessLevelMembers[identity]
+		if len(levels) == 0 {
+			reply = append(reply, identity+" has default access only.")
+		} else {
+			reply = append(reply, identity+": "+strings.Join(levels, ", "))
+		}
+	}
+
+	return
+}
+
+func backupCmd(cmd *command, args []string, timeout *bool) []string {
+	return []string{notImplemented}
+}
+
+func banCmd(cmd *command, args []string, timeout *bool) []string {
+	//Players named list, info or search are banned with 'ban -- <name>'
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+		if len(args) == 0 {
+			return []string{"Usage: " + commandHelpMap["ban"]}
+		}
+	} else if len(args) == 0 || args[0] == "list" || args[0] == "info" || args[0] == "search" {
+		return banListCmd(cmd, args)
 	}
 
 	var ext string
@@ -239,55 +470,287 @@ func banCmd(args []string, timeout *bool) []string {
 		ext = "-ip"
 	}
 
-	if len(args) == 2 {
-		dur, err := time.ParseDuration(args[1])
-		if err != nil || dur <= 0 {
-			return []string{"Could not parse " + args[1] + " as a valid duration. Missing units?"}
+	s := sanction{Target: args[0], Kind: SANCTION_BAN, Issuer: cmd.sender, Server: cmd.server.name}
+	reasonFrom := 1
+	if len(args) > 1 {
+		if dur, err := time.ParseDuration(args[1]); err == nil {
+			if dur <= 0 {
+				return []string{"Could not parse " + args[1] + " as a valid duration. Missing units?"}
+			}
+			s.Expires = time.Now().Add(dur)
+			isTemp = fmt.Sprintf(" for %v.", dur)
+			reasonFrom = 2
 		}
-		isTemp = fmt.Sprintf(" for %d minute(s).", dur)
-
-		go func() {
-			<-(time.After(dur * time.Second))
-			server.In <- "pardon" + ext + " " + args[0]
-		}()
 	}
+	s.Reason = strings.Join(args[reasonFrom:], " ")
 
-	server.In <- "ban" + ext + " " + args[0]
+	target := args[0]
+	if s.Reason != "" {
+		target += " " + s.Reason
+	}
+	if err := networkSend(cmd.server, "ban"+ext, target); err != nil {
+		return []string{"Couldn't ban " + args[0] + ": " + err.Error()}
+	}
+	impose(s)
 
 	return []string{args[0] + " has been banned" + isTemp}
 }
 
-func pardonCmd(args []string, timeout *bool) []string {
+//ban list [page], ban info <name or ip> and ban search <text> [page]
+func banListCmd(cmd *command, args []string) []string {
+	records, err := cmd.server.banRecords()
+	if err != nil {
+		logErr.Printf("Reading ban lists: %s\n", err)
+	}
+
+	if len(args) == 0 || args[0] == "list" {
+		page := 1
+		if len(args) == 2 {
+			if page, err = strconv.Atoi(args[1]); err != nil {
+				return []string{"Usage: " + commandHelpMap["ban"]}
+			}
+		} else if len(args) > 2 {
+			return []string{"Usage: " + commandHelpMap["ban"]}
+		}
+		if len(records) == 0 {
+			return []string{"Nobody is banned."}
+		}
+		return banPage("Bans", records, page)
+	}
+
+	if len(args) < 2 || args[0] == "info" && len(args) != 2 {
+		return []string{"Usage: " + commandHelpMap["ban"]}
+	}
+
+	if args[0] == "info" {
+		for _, r := range records {
+			if strings.EqualFold(r.target(), args[1]) {
+				return r.info()
+			}
+		}
+		return []string{args[1] + " isn't banned."}
+	}
+
+	//The text can be several words, and a number after them is the page
+	text, page := args[1:], 1
+	if len(text) > 1 {
+		if n, err := strconv.Atoi(text[len(text)-1]); err == nil {
+			text, page = text[:len(text)-1], n
+		}
+	}
+	search := strings.Join(text, " ")
+
+	var found []banRecord
+	for _, r := range records {
+		if r.matches(search) {
+			found = append(found, r)
+		}
+	}
+	if len(found) == 0 {
+		return []string{"No bans match " + search + "."}
+	}
+	return banPage("Bans matching "+search, found, page)
+}
+
+func pardonCmd(cmd *command, args []string, timeout *bool) []string {
 	if len(args) != 1 {
 		return []string{"Usage: " + commandHelpMap["pardon"]}
 	}
 
-	if !server.IsRunning() {
+	pardon := "pardon"
+	if net.ParseIP(args[0]) != nil {
+		pardon = "pardon-ip"
+	}
+	if err := networkSend(cmd.server, pardon, args[0]); err != nil {
+		return []string{"Couldn't pardon " + args[0] + ": " + err.Error()}
+	}
+	forgive(cmd.server, args[0])
+
+	return []string{args[0] + " has been pardoned."}
+}
+
+//The same as ban list, for those allowed to see bans but not issue them
+func bansCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) > 1 {
+		return []string{"Usage: " + commandHelpMap["bans"]}
+	}
+	return banListCmd(cmd, append([]string{"list"}, args...))
+}
+
+func consoleCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) == 0 || args[0] == "" {
+		return []string{"Usage: " + commandHelpMap["console"]}
+	}
+
+	if !cmd.server.IsRunning() {
 		return []string{"Server not currently running."}
 	}
 
-	if net.ParseIP(args[0]) != nil {
-		server.In <- "pardon-ip " + args[0]
-	} else {
-		server.In <- "pardon " + args[0]
+	//Stopping behind the bot's back would leave it thinking the server
+	//crashed, the same reason readConsoleInput hijacks it
+	if verb := consoleHijack(strings.Join(args, " ")); verb != "" {
+		return []string{"Use the " + verb + " command instead."}
 	}
 
-	return []string{args[0] + " has been pardoned."}
+	cmd.server.In <- strings.Join(args, " ")
+
+	var reply []string
+	wait := time.After(ConsoleReplyWait * time.Second)
+	for {
+		select {
+		case line := <-cmd.server.response:
+			reply = append(reply, line)
+		case <-wait:
+			if len(reply) == 0 {
+				return []string{"No output."}
+			}
+			if len(reply) > ConsoleReplyMax {
+				more := len(reply) - ConsoleReplyMax
+				reply = append(reply[:ConsoleReplyMax], fmt.Sprintf("(%d more lines)", more))
+			}
+			return reply
+		}
+	}
 }
 
-func giveCmd(args []string, timeout *bool) []string {
+func giveCmd(cmd *command, args []string, timeout *bool) []string {
 	return []string{notImplemented}
 }
 
-var kickSuccessRegex *regexp.Regexp = regexp.MustCompile(`\[INFO\] Kicked ([a-zA-Z0-9\-]+) from the game`)
-var kickFailureRegex *regexp.Regexp = regexp.MustCompile(`\[INFO\] That player cannot be found`)
+func helpopCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) < 1 {
+		return []string{"Usage: " + commandHelpMap["helpop"]}
+	}
+	return raiseTicket(cmd, TICKET_HELPOP, "", strings.Join(args, " "))
+}
+
+func reportCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) < 2 {
+		return []string{"Usage: " + commandHelpMap["report"]}
+	}
+	return raiseTicket(cmd, TICKET_REPORT, args[0], strings.Join(args[1:], " "))
+}
+
+//Open a ticket for the player who ran cmd
+func raiseTicket(cmd *command, kind, reported, message string) []string {
+	if cmd.source != SOURCE_MC {
+		return []string{"That's for players in game."}
+	}
+
+	t, err := openTicket(ticket{
+		Kind:     kind,
+		Player:   cmd.sender,
+		Reported: reported,
+		Message:  message,
+		Server:   cmd.origin.name,
+		Location: cmd.origin.locate(cmd.sender),
+	})
+	if err != nil {
+		return replyPrivately(cmd, []string{err.Error()})
+	}
+	logInfo.Printf("%s opened ticket #%d\n", cmd.sender, t.ID)
+	announceTicket(t)
+
+	return replyPrivately(cmd, []string{fmt.Sprintf("Ticket #%d has been passed on to staff.", t.ID)})
+}
+
+func ticketsCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) == 0 || len(args) == 1 && args[0] == "list" {
+		open := openTickets()
+		if len(open) == 0 {
+			return []string{"No open tickets."}
+		}
+
+		var reply []string
+		for _, t := range open {
+			reply = append(reply, t.String())
+		}
+		return reply
+	}
+
+	if len(args) < 2 || args[0] != "claim" && args[0] != "close" ||
+		args[0] == "claim" && (len(args) > 3 || len(args) == 3 && args[2] != "force") {
+		return []string{"Usage: " + commandHelpMap["tickets"]}
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+	if err != nil {
+		return []string{"Usage: " + commandHelpMap["tickets"]}
+	}
+
+	if args[0] == "claim" {
+		t, err := updateTicket(id, TICKET_CLAIMED, cmd.sender, "", len(args) == 3)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		t.notify(fmt.Sprintf("Your ticket #%d has been picked up by %s.", t.ID, cmd.sender))
+		return []string{fmt.Sprintf("Ticket #%d is yours.", t.ID)}
+	}
+
+	note := strings.Join(args[2:], " ")
+	t, err := updateTicket(id, TICKET_CLOSED, cmd.sender, note, false)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	text := fmt.Sprintf("Your ticket #%d has been closed by %s.", t.ID, cmd.sender)
+	if note != "" {
+		text = fmt.Sprintf("Your ticket #%d has been closed by %s: %s", t.ID, cmd.sender, note)
+	}
+	t.notify(text)
+	logInfo.Printf("%s closed ticket #%d\n", cmd.sender, t.ID)
+
+	return []string{fmt.Sprintf("Closed ticket #%d.", t.ID)}
+}
+
+func ignoreCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) == 0 {
+		return []string{"Usage: " + commandHelpMap["ignore"]}
+	}
+
+	switch args[0] {
+	case "add", "remove":
+		if len(args) != 2 {
+			return []string{"Usage: " + commandHelpMap["ignore"]}
+		}
+
+		nick := args[1]
+		err := updateConfig(func(c *Config) error {
+			if args[0] == "add" {
+				c.Ignore = addString(c.Ignore, nick)
+			} else {
+				c.Ignore = removeString(c.Ignore, nick)
+			}
+			return nil
+		})
+		if err != nil {
+			return []string{err.Error()}
+		}
+
+		if args[0] == "add" {
+			return []string{"Now ignoring " + nick + "."}
+		}
+		return []string{"No longer ignoring " + nick + "."}
+
+	case "list":
+		ignored := currentConfig().Ignore
+		if len(ignored) == 0 {
+			return []string{"Nobody is being ignored."}
+		}
+		return []string{"Ignoring: " + strings.Join(ignored, ", ")}
+	}
+
+	return []string{"Usage: " + commandHelpMap["ignore"]}
+}
+
+//Who was kicked, or why nobody was
+var kickRegex *regexp.Regexp = regexp.MustCompile(`INFO\]:? (?:Kicked (\w+)(?: from the game|:)|` +
+	`(That player cannot be found|No player was found))`)
 
-func kickCmd(args []string, timeout *bool) []string {
-	if len(args) < 1 || 2 < len(args) {
+func kickCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) < 1 {
 		return []string{"Usage: " + commandHelpMap["kick"]}
 	}
 
-	if !server.IsRunning() {
+	if !cmd.server.IsRunning() {
 		return []string{"Server not currently running."}
 	}
 
@@ -295,82 +758,265 @@ func kickCmd(args []string, timeout *bool) []string {
 	var dur time.Duration
 	var err error
 
-	if len(args) == 2 {
-		if dur, err = time.ParseDuration(args[1]); err != nil || dur <= 0 {
-			return []string{"Could not parse " + args[1] + " as a valid duration. Missing units?"}
+	reasonFrom := 1
+	if len(args) > 1 {
+		if dur, err = time.ParseDuration(args[1]); err == nil {
+			if dur <= 0 {
+				return []string{"Could not parse " + args[1] + " as a valid duration. Missing units?"}
+			}
+			reasonFrom = 2
 		}
 	}
+	reason := strings.Join(args[reasonFrom:], " ")
+	target := args[0]
+	if reason != "" {
+		target += " " + reason
+	}
 
-	server.In <- "kick " + args[0]
+	kickban := sanction{Target: args[0], Kind: SANCTION_KICKBAN, Reason: reason, Issuer: cmd.sender,
+		Server: cmd.server.name, Expires: time.Now().Add(dur)}
 
-	for line := range commandResponse {
-		if match := kickSuccessRegex.FindStringSubmatch(line); match != nil {
-			if match[1] == args[0] {
-				reply = args[0] + " was kicked"
-				break
+	//Behind a proxy, kick through the proxy if it knows how, otherwise from
+	//whichever backend the player is on
+	if network := cmd.server.network(); network != nil {
+		if format := network.config().ProxyCommands["kick"]; format != "" {
+			network.In <- fmt.Sprintf(format, target)
+			if dur <= 0 {
+				return []string{args[0] + " was kicked from the network."}
 			}
-		} else if kickFailureRegex.MatchString(line) {
+
+			if err := networkSend(network, "ban", target); err != nil {
+				return []string{args[0] + " was kicked from the network, but couldn't be banned: " + err.Error()}
+			}
+			kickban.Server = network.name
+			impose(kickban)
+			return []string{fmt.Sprintf("%s was kickbanned from the network for %v.", args[0], dur)}
+		}
+
+		p := network.find(args[0])
+		if p == nil {
 			return []string{"Kick failed, couldn't find  " + args[0] + "."}
 		}
+		if cmd.server = findServer(p.server); cmd.server == nil || !cmd.server.IsRunning() {
+			return []string{args[0] + " is on " + p.server + ", which this bot can't kick from."}
+		}
 	}
 
-	if dur != -1 {
-		reply = fmt.Sprintf("%s was kickbanned and will be pardoned in %d minute(s).", args[0], dur)
-		go func() {
-			<-(time.After(dur))
-			server.In <- "pardon " + args[0]
-		}()
+	cmd.server.In <- "kick " + target
+
+	for reply == "" {
+		match := cmd.server.awaitResponse(kickRegex, timeout)
+		if match == nil {
+			return []string{"The server didn't say whether " + args[0] + " was kicked."}
+		} else if match[2] != "" {
+			return []string{"Kick failed, couldn't find  " + args[0] + "."}
+		} else if strings.EqualFold(match[1], args[0]) {
+			reply = args[0] + " was kicked"
+		}
+	}
+
+	if dur > 0 {
+		if err := networkSend(cmd.server, "ban", target); err != nil {
+			return []string{reply + ", but couldn't be banned: " + err.Error()}
+		}
+		reply = fmt.Sprintf("%s was kickbanned and will be pardoned in %v.", args[0], dur)
+		kickban.Server = cmd.server.name
+		impose(kickban)
 	}
 
 	return []string{reply}
 }
 
-var listRegex *regexp.Regexp = regexp.MustCompile(`\[INFO\] (There are \d+/\d+ players online:)`)
+//The head of list's answer, followed by the players on the same line or,
+//on older servers, the next
+var listRegex *regexp.Regexp = regexp.MustCompile(`INFO\]:? (There are \d+(?:/| of a max of )\d+ players online:) ?(.*)$`)
 
-func listCmd(args []string, timeout *bool) []string {
-	if !server.IsRunning() {
-		return []string{"Server not currently running."}
+//Any line the server logs, for what follows on from the one before
+var nextLineRegex *regexp.Regexp = regexp.MustCompile(`INFO\]:? (.*)$`)
+
+func lastCmd(cmd *command, args []string, timeout *bool) []string {
+	n := DefaultLastLines
+	if len(args) > 0 {
+		if i, err := strconv.Atoi(args[0]); err == nil {
+			n = i
+			args = args[1:]
+		}
+	}
+	if len(args) > 1 || n <= 0 {
+		return []string{"Usage: " + commandHelpMap["last"]}
+	}
+	if size := currentConfig().ScrollbackSize; n > size {
+		n = size
+	}
+
+	player := ""
+	if len(args) == 1 {
+		player = args[0]
 	}
 
-	server.In <- "list"
+	entries := recall(n, player, time.Time{})
+	if len(entries) == 0 {
+		return []string{"Nothing to show."}
+	}
+
+	var reply []string
+	for _, e := range entries {
+		reply = append(reply, e.String())
+	}
+	return replyPrivately(cmd, reply)
+}
+
+func linkCmd(cmd *command, args []string, timeout *bool) []string {
+	//Anyone can take a nick, so links are made with the account behind it
+	if cmd.unverified {
+		return []string{"Links need an account behind your name, log in to it (e.g. with NickServ) first."}
+	}
+	me := cmd.identities[0]
 
-	for line := range commandResponse {
-		if match := listRegex.FindStringSubmatch(line); match != nil {
-			players := <-commandResponse //The next line should have the actual list
-			return append(match[1:], strings.SplitAfterN(players, "[INFO] ", 2)[1:]...)
+	switch {
+	case len(args) == 0:
+		if l, ok := findLink(me); ok {
+			return []string{fmt.Sprintf("%s is linked with %s, since %s.", l.Identity, l.Player,
+				l.Since.Format("Jan 2 2006"))}
 		}
+		return []string{"You aren't linked."}
+	case len(args) != 1:
+		return []string{"Usage: " + commandHelpMap["link"]}
+	case args[0] == "remove":
+		if unlink(me) {
+			return []string{"Unlinked."}
+		}
+		return []string{"You aren't linked."}
+	case cmd.source == SOURCE_MC:
+		identity, err := confirmLink(cmd.sender, args[0])
+		if err != nil {
+			return replyPrivately(cmd, []string{err.Error()})
+		}
+		logInfo.Printf("Linked %s with %s\n", cmd.sender, identity)
+		return replyPrivately(cmd, []string{cmd.sender + " is now linked with " + identity + "."})
+	case cmd.source == SOURCE_CHAT:
+		code, err := requestLink(me, args[0])
+		if err != nil {
+			return []string{"Couldn't make a code: " + err.Error()}
+		}
+		return replyPrivately(cmd, []string{fmt.Sprintf("To confirm, type %slink %s in game as %s within %d minutes.",
+			currentConfig().AttnChar, code, args[0], LinkCodeTimeout)})
 	}
 
-	return nil
+	return []string{"Links can only be made between chat and the game."}
 }
 
-var (
-	mapgenRunning    bool   = false
-	lastMapgenOutput string = ""
-	lastMapgenRun    time.Time
-)
+func listCmd(cmd *command, args []string, timeout *bool) []string {
+	//A backend of a network may be down while players are elsewhere on it
+	if network := cmd.server.network(); network != nil {
+		return network.networkList()
+	}
 
-func mapgenCmd(args []string, timeout *bool) []string {
-	if mapgenRunning {
-		return []string{"MapGen already running, last output: " + lastMapgenOutput}
+	if !cmd.server.IsRunning() {
+		return []string{"Server not currently running."}
 	}
 
-	if server.IsRunning() {
-		server.In <- "save-all"
-		server.In <- "save-off"
-		for line := range commandResponse {
-			if strings.Contains(line, "[INFO] Turned off world auto-saving") {
-				break
+	cmd.server.In <- "list"
+
+	answer := cmd.server.awaitList(listRegex, timeout)
+	if answer == nil {
+		return []string{"The server didn't answer."}
+	} else if answer[1] == "" {
+		return answer[:1]
+	}
+
+	split := strings.Split(answer[1], ", ")
+	for i, name := range split {
+		split[i] = showLinked(name)
+	}
+	return []string{answer[0], strings.Join(split, ", ")}
+}
+
+//The server's answer to a command listing players: the line head matches,
+//and the players after it on the same line or, from older servers, the
+//next.  nil if the command times out first.
+func (m *minecraft) awaitList(head *regexp.Regexp, timeout *bool) []string {
+	match := m.awaitResponse(head, timeout)
+	if match == nil {
+		return nil
+	}
+
+	players := match[2]
+	if players == "" && strings.HasSuffix(match[1], ":") && !strings.HasPrefix(match[1], "There are 0 ") {
+		if next := m.awaitResponse(nextLineRegex, timeout); next != nil {
+			players = strings.TrimPrefix(next[1], ", ")
+		}
+	}
+	return []string{match[1], players}
+}
+
+func mailCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) != 1 {
+		return []string{"Usage: " + commandHelpMap["mail"]}
+	}
+	if cmd.unverified {
+		return []string{"Mail is kept for your account, log in to it first."}
+	}
+	me := cmd.identities[0]
+
+	var reply []string
+	switch args[0] {
+	case "list":
+		messages := readMail(me, false)
+		if len(messages) == 0 {
+			return replyPrivately(cmd, []string{"You have no mail."})
+		}
+
+		reply = append(reply, fmt.Sprintf("You have %d messages:", len(messages)))
+		for i, msg := range messages {
+			state := ""
+			if !msg.Read {
+				state = " (new)"
 			}
+			reply = append(reply, fmt.Sprintf("%d. From %s, %v ago%s", i+1, msg.From,
+				time.Since(msg.Sent)/time.Second*time.Second, state))
+		}
+	case "read":
+		messages := readMail(me, true)
+		if len(messages) == 0 {
+			return replyPrivately(cmd, []string{"No new mail."})
 		}
+		for _, msg := range messages {
+			reply = append(reply, msg.String())
+		}
+	case "clear":
+		reply = []string{fmt.Sprintf("Deleted %d messages.", clearMail(me))}
+	default:
+		return []string{"Usage: " + commandHelpMap["mail"]}
 	}
 
-	copyWorld(config.MCWorldDir, config.MapTempWorldDir)
-	server.In <- "save-on"
-	mapgenRunning = true
-	lastMapgenRun = time.Now()
+	return replyPrivately(cmd, reply)
+}
+
+var saveOffRegex *regexp.Regexp = regexp.MustCompile(`INFO\]:? (?:Turned off world auto-saving|Automatic saving is now disabled|` +
+	`Saving is already turned off)`)
 
-	command := exec.Command(config.MapUpdateCommand.Command, config.MapUpdateCommand.Args...)
+func mapgenCmd(cmd *command, args []string, timeout *bool) []string {
+	if cmd.server.mapgenRunning {
+		return []string{"MapGen already running, last output: " + cmd.server.lastMapgenOutput}
+	}
+
+	if cmd.server.IsRunning() {
+		cmd.server.In <- "save-all"
+		cmd.server.In <- "save-off"
+		if cmd.server.awaitResponse(saveOffRegex, timeout) == nil {
+			cmd.server.In <- "save-on"
+			return []string{"The server didn't turn off saving, so the world can't be copied."}
+		}
+	}
+
+	conf := cmd.server.config()
+	copyWorld(conf.MCWorldDir, conf.MapTempWorldDir)
+	cmd.server.In <- "save-on"
+	cmd.server.mapgenRunning = true
+	cmd.server.lastMapgenRun = time.Now()
+
+	command := exec.Command(conf.MapUpdateCommand.Command, conf.MapUpdateCommand.Args...)
 
 	//These two lambdas will constantly be racing for lastMapgenOutput, and that's ok
 	go func() {
@@ -384,7 +1030,7 @@ func mapgenCmd(args []string, timeout *bool) []string {
 				continue
 			}
 			fmt.Printf("%s\n", line)
-			lastMapgenOutput = string(line)
+			cmd.server.lastMapgenOutput = string(line)
 		}
 	}()
 	go func() {
@@ -399,7 +1045,7 @@ func mapgenCmd(args []string, timeout *bool) []string {
 				continue
 			}
 			fmt.Printf("%s\n", line)
-			lastMapgenOutput = string(line)
+			cmd.server.lastMapgenOutput = string(line)
 		}
 	}()
 
@@ -407,73 +1053,234 @@ func mapgenCmd(args []string, timeout *bool) []string {
 		err := command.Run()
 
 		if err != nil {
-			bot.Send(&irc.Message{
-				Command:  "PRIVMSG",
-				Args:     []string{config.IrcChan},
-				Trailing: "MapGen exited uncleanly: " + err.Error(),
-			})
+			cmd.server.alert("MapGen exited uncleanly: " + err.Error())
 		} else {
-
-			dur := time.Since(lastMapgenRun)
-
-			bot.Send(&irc.Message{
-				Command:  "PRIVMSG",
-				Args:     []string{config.IrcChan},
-				Trailing: fmt.Sprintf("MapGen Complete in %v", dur),
-			})
+			dur := time.Since(cmd.server.lastMapgenRun)
+			cmd.server.alert(fmt.Sprintf("MapGen Complete in %v", dur))
 		}
 
-		mapgenRunning = false
-		lastMapgenOutput = ""
+		cmd.server.mapgenRunning = false
+		cmd.server.lastMapgenOutput = ""
 	}()
 
 	return []string{"MapGen started"}
 }
 
-func restartCmd(args []string, timeout *bool) []string {
-	stopCmd(args, nil)
-	return startCmd(nil, nil)
+func relayCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) == 0 {
+		relay := currentConfig().Relay
+		state := "on"
+		if relay.Disabled {
+			state = "off"
+		}
+
+		var off []string
+		for event, e := range relay.Events {
+			if e.Disabled {
+				off = append(off, event)
+			}
+		}
+		sort.Strings(off)
+
+		reply := []string{"Relay is " + state + "."}
+		if len(off) > 0 {
+			reply = append(reply, "Not relaying: "+strings.Join(off, ", "))
+		}
+		if len(relay.Muted) > 0 {
+			reply = append(reply, "Muted: "+strings.Join(relay.Muted, ", "))
+		}
+		return reply
+	}
+
+	var reply string
+	switch {
+	case (args[0] == "on" || args[0] == "off") && len(args) == 1:
+		reply = "Relay turned " + args[0] + "."
+	case (args[0] == "on" || args[0] == "off") && len(args) == 2:
+		if _, known := defaultEventTemplates[args[1]]; !known {
+			return []string{"Unknown event: " + args[1]}
+		}
+		reply = "Relaying of " + args[1] + " turned " + args[0] + "."
+	case args[0] == "mute" && len(args) == 2:
+		reply = args[1] + " muted."
+	case args[0] == "unmute" && len(args) == 2:
+		reply = args[1] + " unmuted."
+	default:
+		return []string{"Usage: " + commandHelpMap["relay"]}
+	}
+
+	err := updateConfig(func(c *Config) error {
+		switch {
+		case args[0] == "mute":
+			c.Relay.Muted = addString(c.Relay.Muted, args[1])
+		case args[0] == "unmute":
+			c.Relay.Muted = removeString(c.Relay.Muted, args[1])
+		case len(args) == 2:
+			e := c.Relay.Events[args[1]]
+			e.Disabled = args[0] == "off"
+			c.Relay.Events[args[1]] = e
+		default:
+			c.Relay.Disabled = args[0] == "off"
+		}
+		return nil
+	})
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	return []string{reply}
+}
+
+func reloadCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) != 0 {
+		return []string{"Usage: " + commandHelpMap["reload"]}
+	}
+
+	changes, err := reloadConfig()
+	if err != nil {
+		return []string{"Reload failed, keeping the old config: " + err.Error()}
+	}
+
+	return changes
 }
 
-func sourceCmd(args []string, timeout *bool) []string {
+func restartCmd(cmd *command, args []string, timeout *bool) []string {
+	stopCmd(cmd, args, timeout)
+	return startCmd(cmd, nil, timeout)
+}
+
+func serversCmd(cmd *command, args []string, timeout *bool) (reply []string) {
+	if len(args) != 0 {
+		return []string{"Usage: " + commandHelpMap["servers"]}
+	}
+
+	for _, m := range servers {
+		state := "stopped"
+		if m.IsRunning() {
+			state = "running"
+		}
+		if m.version != "" {
+			state += ", " + m.version
+		}
+		if m == cmd.server {
+			state += ", the default here"
+		}
+		reply = append(reply, fmt.Sprintf("@%s: %s", m.name, state))
+	}
+
+	return
+}
+
+func seenCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) != 1 {
+		return []string{"Usage: " + commandHelpMap["seen"]}
+	}
+
+	where := func(server string) string {
+		if len(servers) > 1 {
+			return " on " + server
+		}
+		return ""
+	}
+
+	if strings.Contains(args[0], ":") { //A chat identity
+		l, ok := findLink(args[0])
+		if !ok {
+			return []string{args[0] + " isn't linked with a player."}
+		}
+		args[0] = l.Player
+	}
+
+	for _, m := range servers {
+		if m.config().Proxy != "" { //Its proxy knows better
+			continue
+		}
+		if p := m.find(args[0]); p != nil {
+			return []string{fmt.Sprintf("%s is online%s, and has been for %v.", showLinked(p.name), where(p.server),
+				time.Since(p.since)/time.Second*time.Second)}
+		}
+	}
+
+	entry, ok := lastSeen(args[0])
+	if !ok {
+		return []string{args[0] + " hasn't been seen."}
+	}
+
+	return []string{fmt.Sprintf("%s was last seen%s %v ago.", showLinked(entry.Name), where(entry.Server),
+		time.Since(entry.Last)/time.Second*time.Second)}
+}
+
+func deathsCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) > 1 {
+		return []string{"Usage: " + commandHelpMap["deaths"]}
+	}
+
+	if len(args) == 1 {
+		d, ok := deathsOf(args[0])
+		if !ok {
+			return []string{args[0] + " hasn't died."}
+		}
+		times := "times"
+		if d.Count == 1 {
+			times = "time"
+		}
+		return []string{fmt.Sprintf("%s has died %d %s, most recently %v ago: %s", d.Name, d.Count, times,
+			time.Since(d.Last)/time.Second*time.Second, d.LastMessage)}
+	}
+
+	most := mostDeaths(5)
+	if len(most) == 0 {
+		return []string{"Nobody has died."}
+	}
+	var counts []string
+	for _, d := range most {
+		counts = append(counts, fmt.Sprintf("%s (%d)", d.Name, d.Count))
+	}
+	return []string{"Most deaths: " + strings.Join(counts, ", ")}
+}
+
+func sourceCmd(cmd *command, args []string, timeout *bool) []string {
 	return []string{"MCBot was written by Cory 'cbeck' Kolbeck.  Its source and license" +
 		" information can be found at https://github.com/ckolbeck/mc-bot"}
 }
 
-var versionRegex *regexp.Regexp = regexp.MustCompile(`\[INFO\] Starting (minecraft server version .*)`)
+var versionRegex *regexp.Regexp = regexp.MustCompile(`INFO\]:? Starting (minecraft server version .*)`)
 
-func startCmd(args []string, timeout *bool) []string {
+func startCmd(cmd *command, args []string, timeout *bool) []string {
 	if len(args) != 0 {
 		return []string{"Usage: " + commandHelpMap["start"]}
 	}
 
-	if err := server.Start(); err != nil {
+	//Not while one of its lists is being edited behind its back
+	serverFilesLock.Lock()
+	err := cmd.server.Start()
+	serverFilesLock.Unlock()
+	if err != nil {
 		return []string{err.Error()}
 	}
 
-	for line := range commandResponse {
-		if match := versionRegex.FindStringSubmatch(line); match != nil {
-			serverVersion = match[1]
-			break
-		}
+	//teeOutput notes the version
+	if cmd.server.awaitResponse(versionRegex, timeout) == nil {
+		return []string{"Server starting, but it hasn't said which version it is yet."}
 	}
 
 	return []string{"Server started."}
 }
 
-func stateCmd(args []string, timeout *bool) (reply []string) {
+func stateCmd(cmd *command, args []string, timeout *bool) (reply []string) {
 	var lines []string
 	if len(args) != 0 {
 		return []string{"Usage: " + commandHelpMap["state"]}
 	}
 
 	//GetPID will return an error if server is not running
-	pid, err := server.GetPID()
+	pid, err := cmd.server.GetPID()
 	if err != nil {
 		return []string{err.Error()}
 	}
 
-	switch config.HostOS {
+	hostOS := currentConfig().HostOS
+	switch hostOS {
 	case "linux":
 		raw, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
 		if err != nil {
@@ -481,8 +1288,8 @@ func stateCmd(args []string, timeout *bool) (reply []string) {
 		}
 		lines = strings.Split(string(raw), "\n")
 	case "windows":
-		cmd := exec.Command("tasklist", "/FI", fmt.Sprintf("pid eq %d", pid), "/FO", "LIST")
-		raw, err := cmd.Output()
+		tasklist := exec.Command("tasklist", "/FI", fmt.Sprintf("pid eq %d", pid), "/FO", "LIST")
+		raw, err := tasklist.Output()
 		if err != nil {
 			reply = []string{"Error while assessing status: " + err.Error()}
 		}
@@ -495,7 +1302,7 @@ func stateCmd(args []string, timeout *bool) (reply []string) {
 		stats[split[0]] = line
 	}
 
-	switch config.HostOS {
+	switch hostOS {
 	case "linux":
 		reply = append(reply, stats["VmSize"])
 		reply = append(reply, stats["VmSwap"])
@@ -505,26 +1312,26 @@ func stateCmd(args []string, timeout *bool) (reply []string) {
 		reply = append(reply, stats["Status"])
 	}
 
-	reply = append(reply, fmt.Sprintf("Errors: %d", serverErrors))
-	reply = append(reply, fmt.Sprintf("Severe Errors: %d", severeServerErrors))
-	reply = append(reply, serverVersion)
+	reply = append(reply, fmt.Sprintf("Errors: %d", cmd.server.errors))
+	reply = append(reply, fmt.Sprintf("Severe Errors: %d", cmd.server.severeErrors))
+	reply = append(reply, cmd.server.version)
 
-	if mapgenRunning {
-		reply = append(reply, "MapGen currently running: "+lastMapgenOutput)
-	} else if lastMapgenRun.IsZero() {
-		reply = append(reply, "No MapGen run since last bot restart.")		
+	if cmd.server.mapgenRunning {
+		reply = append(reply, "MapGen currently running: "+cmd.server.lastMapgenOutput)
+	} else if cmd.server.lastMapgenRun.IsZero() {
+		reply = append(reply, "No MapGen run since last bot restart.")
 	} else {
-		reply = append(reply, "MapGen last run  "+lastMapgenRun.Format("Mon Jan _2 15:04"))
+		reply = append(reply, "MapGen last run  "+cmd.server.lastMapgenRun.Format("Mon Jan _2 15:04"))
 	}
 
 	return
 }
 
-func stopCmd(args []string, timeout *bool) []string {
+func stopCmd(cmd *command, args []string, timeout *bool) []string {
 	delay := DefaultStopDelay * time.Second
 	var msg string
 
-	if !server.IsRunning() {
+	if !cmd.server.IsRunning() {
 		return []string{"Server not currently running."}
 	}
 
@@ -545,58 +1352,93 @@ func stopCmd(args []string, timeout *bool) []string {
 		}
 	}
 
-	serverErrors = 0
-	severeServerErrors = 0
-	serverVersion = ""
+	cmd.server.resetStats()
 
-	if err := server.Stop(delay, msg); err != nil {
+	if err := cmd.server.Stop(delay, msg); err != nil {
 		return []string{err.Error()}
 	}
 
 	return []string{"Server stopped."}
 }
 
-var tpRegex *regexp.Regexp = regexp.MustCompile(`\[INFO\] (Teleported.*|` +
-	`That player cannot be found.*)`)
+var tpRegex *regexp.Regexp = regexp.MustCompile(`INFO\]:? (Teleported .*|` +
+	`That player cannot be found.*|No (?:entity|player) was found)`)
+
+func tellCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) < 2 {
+		return []string{"Usage: " + commandHelpMap["tell"]}
+	}
+	to, text := args[0], strings.Join(args[1:], " ")
+
+	if cmd.source == SOURCE_MC { //From a player, to IRC
+		if ircChat.Online() && ircNickPresent(to) {
+			ircChat.Send(to, toChat(ircChat, "<"+cmd.sender+"> "+text))
+			return replyPrivately(cmd, []string{"Sent to " + to + "."})
+		}
+
+		//IRC mail is kept for accounts, nicks being anyone's for the taking.
+		//Only the gateway knows which a nick is logged in to, and then only
+		//while it's around.
+		if account := ircAccount(to); account != "" {
+			sendMail("irc:"+account, cmd.sender, text)
+			return replyPrivately(cmd, []string{"Couldn't reach " + to + " on IRC, they'll get your message when they're next around."})
+		}
+		sendMail("irc:"+to, cmd.sender, text)
+		return replyPrivately(cmd, []string{to + " isn't on IRC. Your message is kept for the IRC account " + to +
+			", which isn't necessarily who uses that nick."})
+	}
+
+	if cmd.transport != nil {
+		text = toGame(cmd.transport, text)
+	}
+	if target, name := playerServer(to); target != nil {
+		target.tell(name, "<"+cmd.sender+"> "+text)
+		return []string{"Sent to " + name + "."}
+	}
 
-func tpCmd(args []string, timeout *bool) []string {
+	sendMail("mc:"+to, cmd.sender, text)
+	return []string{to + " isn't online, they'll get your message when they next join."}
+}
+
+func tpCmd(cmd *command, args []string, timeout *bool) []string {
 	if len(args) != 2 {
 		return []string{"Usage: " + commandHelpMap["tp"]}
 	}
 
-	if !server.IsRunning() {
+	if !cmd.server.IsRunning() {
 		return []string{"Server not currently running."}
 	}
 
-	server.In <- fmt.Sprintf("tp %s %s", args[0], args[1])
+	cmd.server.In <- fmt.Sprintf("tp %s %s", args[0], args[1])
 
-	for line := range commandResponse {
-		if match := tpRegex.FindStringSubmatch(line); match != nil {
-			return []string{match[1]}
-		}
+	if match := cmd.server.awaitResponse(tpRegex, timeout); match != nil {
+		return []string{match[1]}
 	}
-
-	//Shouldn't be reachable
-	return nil
+	return []string{"The server didn't answer."}
 }
 
-func versionCmd(args []string, timeout *bool) []string {
-	if serverVersion != "" {
-		return []string{serverVersion}
+func versionCmd(cmd *command, args []string, timeout *bool) []string {
+	if cmd.server.version != "" {
+		return []string{cmd.server.version}
 	}
 	return []string{"Server not running or version unknown."}
 }
 
-var whitelistAddRemoveRegex *regexp.Regexp = regexp.MustCompile(`\[INFO\] (Removed \w+ from the whitelist|Added \w+ to the whitelist)`)
-var whitelistListRegex *regexp.Regexp = regexp.MustCompile(`(There are \d+ \(out of \d+ seen\) whitelisted players:)`)
+var whitelistAddRemoveRegex *regexp.Regexp = regexp.MustCompile(`INFO\]:? (Removed \w+ from the whitelist|Added \w+ to the whitelist|` +
+	`Player is already whitelisted|Player is not whitelisted|That player does not exist|Could not (?:add|remove) \w+ (?:to|from) the whitelist)`)
+
+//The head of whitelist list's answer, followed by the players on the same
+//line or, on older servers, the next
+var whitelistListRegex *regexp.Regexp = regexp.MustCompile(`INFO\]:? (There are (?:no|\d+(?: \(out of \d+ seen\))?) ` +
+	`whitelisted players?(?:\(s\))?:?) ?(.*)$`)
 
-func whitelistCmd(args []string, timeout *bool) (reply []string) {
+func whitelistCmd(cmd *command, args []string, timeout *bool) (reply []string) {
 	if len(args) == 0 {
 		return []string{"Usage: " + commandHelpMap["whitelist"]}
 	}
 
-	if !server.IsRunning() {
-		return []string{"Server not currently running."}
+	if !cmd.server.IsRunning() {
+		return offlineListCmd(cmd.server, "whitelist", args)
 	}
 
 	switch args[0] {
@@ -606,27 +1448,292 @@ func whitelistCmd(args []string, timeout *bool) (reply []string) {
 		}
 
 		for _, name := range args[1:] {
-			server.In <- fmt.Sprintf("whitelist %s %s", args[0], name)
-			for line := range commandResponse {
-				if match := whitelistAddRemoveRegex.FindStringSubmatch(line); match != nil {
-					reply = append(reply, match[1])
-					break
-				}
-
+			cmd.server.In <- fmt.Sprintf("whitelist %s %s", args[0], name)
+			match := cmd.server.awaitResponse(whitelistAddRemoveRegex, timeout)
+			if match == nil {
+				break
 			}
+			reply = append(reply, match[1])
 		}
 	case "list":
-		server.In <- "whitelist list"
-		for line := range commandResponse {
-			if match := whitelistListRegex.FindStringSubmatch(line); match != nil {
-				players := <-commandResponse //The next line should have the actual list
-				return append(match[1:], strings.SplitAfterN(players, "[INFO] , ", 2)[1:]...)
-
-			}
+		cmd.server.In <- "whitelist list"
+		answer := cmd.server.awaitList(whitelistListRegex, timeout)
+		if answer == nil {
+			return []string{"The server didn't answer."}
+		} else if answer[1] == "" {
+			return answer[:1]
 		}
+		return answer
 	default:
 		return []string{"Usage: " + commandHelpMap["whitelist"]}
 	}
 
 	return
 }
+
+var opRegex *regexp.Regexp = regexp.MustCompile(`INFO\]:? (Opp(?:ed|ing) \w+|Made \w+ a server operator|De-?opp(?:ed|ing) \w+|` +
+	`Made \w+ no longer a server operator|Nothing changed.*|That player does not exist|Could not (?:de-?)?op \w+)`)
+
+func opCmd(cmd *command, args []string, timeout *bool) (reply []string) {
+	if len(args) == 0 || args[0] == "list" && len(args) != 1 {
+		return []string{"Usage: " + commandHelpMap["op"]}
+	}
+
+	if !cmd.server.IsRunning() || args[0] == "list" {
+		return offlineListCmd(cmd.server, "op", args)
+	}
+
+	var command string
+	switch args[0] {
+	case "add":
+		command = "op"
+	case "remove":
+		command = "deop"
+	default:
+		return []string{"Usage: " + commandHelpMap["op"]}
+	}
+	if len(args) < 2 {
+		return []string{args[0] + " requires at least one argument"}
+	}
+
+	for _, name := range args[1:] {
+		cmd.server.In <- command + " " + name
+		match := cmd.server.awaitResponse(opRegex, timeout)
+		if match == nil {
+			break
+		}
+		reply = append(reply, match[1])
+	}
+	return
+}
+
+//whitelist or op, with args, for m while it's stopped: its list's file is
+//read or changed directly
+func offlineListCmd(m *minecraft, command string, args []string) (reply []string) {
+	list, what, heading := "whitelist", "whitelisted", "Whitelisted"
+	if command == "op" {
+		list, what, heading = "ops", "an operator", "Operators"
+	}
+
+	switch args[0] {
+	case "add", "remove":
+		if len(args) < 2 {
+			return []string{args[0] + " requires at least one argument"}
+		}
+
+		for _, name := range args[1:] {
+			changed, err := m.offlineListEdit(list, args[0], name)
+			switch {
+			case err != nil:
+				reply = append(reply, "Couldn't "+args[0]+" "+name+": "+err.Error())
+			case !changed && args[0] == "add":
+				reply = append(reply, name+" is already "+what+".")
+			case !changed:
+				reply = append(reply, name+" isn't "+what+".")
+			case args[0] == "add":
+				reply = append(reply, name+" is now "+what+".")
+			default:
+				reply = append(reply, name+" is no longer "+what+".")
+			}
+		}
+		return append(reply, "The server is stopped, so its files were changed directly.")
+	case "list":
+		names, err := m.readList(list)
+		if err != nil {
+			return []string{"Couldn't read the " + list + ": " + err.Error()}
+		}
+		if len(names) == 0 {
+			return []string{"Nobody is " + what + "."}
+		}
+		return []string{fmt.Sprintf("%s (%d): %s", heading, len(names), strings.Join(names, ", "))}
+	}
+
+	return []string{"Usage: " + commandHelpMap[command]}
+}
+
+func applyCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) < 1 {
+		return []string{"Usage: " + commandHelpMap["apply"]}
+	}
+	if cmd.source != SOURCE_CHAT {
+		return []string{"Applications are made from chat."}
+	}
+	if !playerNameRegex.MatchString(args[0]) {
+		return []string{args[0] + " isn't a valid player name."}
+	}
+
+	app, err := submitApplication(application{
+		Player:    args[0],
+		Note:      strings.Join(args[1:], " "),
+		Applicant: cmd.identities[0],
+		Nick:      cmd.sender,
+		Transport: cmd.transport.Name(),
+		Room:      cmd.channel,
+		Server:    cmd.server.name,
+	})
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	attn := currentConfig().AttnChar
+	cmd.server.alert(fmt.Sprintf("Whitelist application %s.  %sapprove %d or %sdeny %d [reason]",
+		app, attn, app.ID, attn, app.ID))
+	return []string{fmt.Sprintf("Application #%d for %s is waiting for staff to look at it.", app.ID, app.Player)}
+}
+
+func applicationsCmd(cmd *command, args []string, timeout *bool) []string {
+	state := APPLICATION_PENDING
+	if len(args) == 1 && args[0] == "all" {
+		state = ""
+	} else if len(args) != 0 {
+		return []string{"Usage: " + commandHelpMap["applications"]}
+	}
+
+	apps := listApplications(state)
+	if len(apps) == 0 {
+		return []string{"No applications."}
+	}
+
+	var reply []string
+	for _, app := range apps {
+		reply = append(reply, app.String())
+	}
+	return reply
+}
+
+func approveCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) != 1 {
+		return []string{"Usage: " + commandHelpMap["approve"]}
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return []string{"Usage: " + commandHelpMap["approve"]}
+	}
+
+	app, ok := findApplication(id)
+	if !ok {
+		return []string{fmt.Sprintf("There's no application #%d.", id)}
+	}
+	if app.State != APPLICATION_PENDING {
+		return []string{fmt.Sprintf("Application #%d was already %s by %s.", app.ID, app.State, app.DecidedBy)}
+	}
+
+	//Whitelist on the server applied for, or every server behind it
+	srv := findServer(app.Server)
+	if srv == nil {
+		srv = cmd.server
+	}
+	targets := []*minecraft{srv}
+	if srv.config().Type != "" {
+		targets = srv.backends()
+	}
+
+	//Try them all, so one failing doesn't leave the rest undone, but only
+	//approve once every one has taken.  Adding again is harmless, so it can
+	//just be retried.
+	var reply []string
+	failed := false
+	for _, target := range targets {
+		if !target.IsRunning() {
+			if _, err := target.offlineListEdit("whitelist", "add", app.Player); err != nil {
+				reply = append(reply, target.tag("Couldn't whitelist "+app.Player+": "+err.Error()))
+				failed = true
+			} else {
+				reply = append(reply, target.tag("Added "+app.Player+" to the stopped server's whitelist"))
+			}
+			continue
+		}
+
+		said, ok := target.whitelistAdd(app.Player, timeout)
+		if !ok {
+			reply = append(reply, target.tag("Couldn't whitelist "+app.Player+": "+said))
+			failed = true
+		} else {
+			reply = append(reply, target.tag(said))
+		}
+	}
+	if failed {
+		return append(reply, fmt.Sprintf("Application #%d left waiting, approve it again once that's sorted.", app.ID))
+	}
+
+	app, err = decideApplication(id, APPLICATION_APPROVED, cmd.identities[0], "")
+	if err != nil {
+		return []string{err.Error()}
+	}
+	logInfo.Printf("%s approved whitelist application #%d for %s\n", cmd.sender, app.ID, app.Player)
+	app.notify(fmt.Sprintf("Your application for %s has been approved, welcome!", app.Player))
+
+	return append(reply, fmt.Sprintf("Approved #%d, %s has been told.", app.ID, app.Nick))
+}
+
+func denyCmd(cmd *command, args []string, timeout *bool) []string {
+	if len(args) < 1 {
+		return []string{"Usage: " + commandHelpMap["deny"]}
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return []string{"Usage: " + commandHelpMap["deny"]}
+	}
+	reason := strings.Join(args[1:], " ")
+
+	app, err := decideApplication(id, APPLICATION_DENIED, cmd.identities[0], reason)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	logInfo.Printf("%s denied whitelist application #%d for %s\n", cmd.sender, app.ID, app.Player)
+
+	text := fmt.Sprintf("Your application for %s has been turned down.", app.Player)
+	if reason != "" {
+		text = fmt.Sprintf("Your application for %s has been turned down: %s", app.Player, reason)
+	}
+	app.notify(text)
+
+	return []string{fmt.Sprintf("Denied #%d, %s has been told.", app.ID, app.Nick)}
+}
+
+var whitelistAddRegex *regexp.Regexp = regexp.MustCompile(`INFO\]:? (Added \w+ to the whitelist|Player is already whitelisted|` +
+	`That player does not exist|Could not add \w+ to the whitelist)`)
+
+//Whitelist player on m, which is running, returning what it said and whether
+//it took.  m needn't be the command's own server, so its output is flushed
+//here.
+func (m *minecraft) whitelistAdd(player string, timeout *bool) (string, bool) {
+	m.flushResponse()
+	m.In <- "whitelist add " + player
+	match := m.awaitResponse(whitelistAddRegex, timeout)
+	if match == nil {
+		return "the server didn't answer", false
+	}
+	return match[1], strings.HasPrefix(match[1], "Added") || strings.HasPrefix(match[1], "Player is already")
+}
+
+//Append s to list if it isn't already present
+func addString(list []string, s string) []string {
+	for _, l := range list {
+		if l == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+//Remove every occurrence of s from list
+func removeString(list []string, s string) []string {
+	var out []string
+	for _, l := range list {
+		if l != s {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+//Whether who looks like mc:name or <transport>:name
+func validIdentity(who string) bool {
+	split := strings.SplitN(who, ":", 2)
+	if len(split) != 2 || split[1] == "" {
+		return false
+	}
+
+	return split[0] == "mc" || split[0] == "discord-role" || isTransport(split[0])
+}
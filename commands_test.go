@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestAwaitList(t *testing.T) {
+	for _, test := range []struct {
+		head  *regexp.Regexp
+		lines []string
+		want  []string
+	}{
+		{listRegex, []string{"[12:00:00] [Server thread/INFO]: There are 2 of a max of 20 players online: Steve, Alex"},
+			[]string{"There are 2 of a max of 20 players online:", "Steve, Alex"}},
+		{listRegex, []string{"[12:00:00] [Server thread/INFO]: There are 0 of a max of 20 players online: "},
+			[]string{"There are 0 of a max of 20 players online:", ""}},
+		{listRegex, []string{"2013-05-01 12:00:00 [INFO] There are 2/20 players online:", "2013-05-01 12:00:00 [INFO] Steve, Alex"},
+			[]string{"There are 2/20 players online:", "Steve, Alex"}},
+		{whitelistListRegex, []string{"[12:00:00] [Server thread/INFO]: There are 2 whitelisted player(s): Steve, Alex"},
+			[]string{"There are 2 whitelisted player(s):", "Steve, Alex"}},
+		{whitelistListRegex, []string{"[12:00:00] [Server thread/INFO]: There are no whitelisted players"},
+			[]string{"There are no whitelisted players", ""}},
+		{whitelistListRegex, []string{"2013-05-01 12:00:00 [INFO] There are 2 (out of 3 seen) whitelisted players:",
+			"2013-05-01 12:00:00 [INFO] , Steve, Alex"},
+			[]string{"There are 2 (out of 3 seen) whitelisted players:", "Steve, Alex"}},
+	} {
+		m := &minecraft{response: make(chan string, 4)}
+		m.response <- "[12:00:00] [Server thread/INFO]: <Steve> There are 9 of a max of 9 players online: lies"
+		for _, line := range test.lines {
+			m.response <- line
+		}
+
+		timeout := false
+		if got := m.awaitList(test.head, &timeout); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.lines, got, test.want)
+		}
+	}
+
+	//Giving up once the command's timed out
+	timeout := true
+	if got := (&minecraft{response: make(chan string)}).awaitList(listRegex, &timeout); got != nil {
+		t.Errorf("timed out: got %q", got)
+	}
+}
+
+func TestResponseRegexes(t *testing.T) {
+	for _, test := range []struct {
+		re         *regexp.Regexp
+		line, want string
+	}{
+		{tpRegex, "[12:00:00] [Server thread/INFO]: Teleported Steve to Alex", "Teleported Steve to Alex"},
+		{tpRegex, "[12:00:00] [Server thread/INFO]: No entity was found", "No entity was found"},
+		{tpRegex, "2013-05-01 12:00:00 [INFO] That player cannot be found", "That player cannot be found"},
+		{tpRegex, "[12:00:00] [Server thread/INFO]: <Steve> Teleported Steve to Alex", ""},
+		{kickRegex, "[12:00:00] [Server thread/INFO]: Kicked Steve: Kicked by an operator", "Steve"},
+		{kickRegex, "2013-05-01 12:00:00 [INFO] Kicked Steve from the game", "Steve"},
+		{kickRegex, "[12:00:00] [Server thread/INFO]: No player was found", ""},
+		{whitelistAddRemoveRegex, "[12:00:00] [Server thread/INFO]: Removed Steve from the whitelist", "Removed Steve from the whitelist"},
+		{whitelistAddRemoveRegex, "[12:00:00] [Server thread/INFO]: Player is not whitelisted", "Player is not whitelisted"},
+		{whitelistAddRemoveRegex, "2013-05-01 12:00:00 [INFO] Added Steve to the whitelist", "Added Steve to the whitelist"},
+		{whitelistAddRemoveRegex, "[12:00:00] [Server thread/INFO]: <Steve> Added Alex to the whitelist", ""},
+		{saveOffRegex, "[12:00:00] [Server thread/INFO]: Automatic saving is now disabled", ""},
+		{saveOffRegex, "2013-05-01 12:00:00 [INFO] Turned off world auto-saving", ""},
+		{versionRegex, "[12:00:00] [Server thread/INFO]: Starting minecraft server version 1.20.4", "minecraft server version 1.20.4"},
+	} {
+		match := test.re.FindStringSubmatch(test.line)
+		got := ""
+		if len(match) > 1 {
+			got = match[1]
+		}
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.line, got, test.want)
+		}
+	}
+
+	//Which lines match at all
+	for line, want := range map[string]bool{
+		"[12:00:00] [Server thread/INFO]: No player was found":              true,
+		"[12:00:00] [Server thread/INFO]: Automatic saving is now disabled": true,
+		"[12:00:00] [Server thread/INFO]: <Steve> No player was found":      false,
+	} {
+		if got := kickRegex.MatchString(line) || saveOffRegex.MatchString(line); got != want {
+			t.Errorf("%q: matched %v", line, got)
+		}
+	}
+}
@@ -2,29 +2,67 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var (
+	config     *Config
+	configLock sync.RWMutex
+
+	//Serializes reloads so two SIGHUPs can't interleave their diffs
+	reloadLock sync.Mutex
 )
 
 type Config struct {
 	HostOS string
 
+	//Where the bot keeps what it remembers between runs, . if unset
+	DataDir string
+
 	//IRC stuff
-	Nick       string
-	Pass       string
-	AttnChar   string
-	IrcServer  string
-	IrcChan    string
-	IrcChanKey string
-	IrcDomain  string
-	IrcPort    int
-	SSL        bool
+	Nick        string
+	Pass        string
+	AttnChar    string
+	IrcServer   string
+	IrcChan     string //Shorthand for a single channel with every role but console
+	IrcChanKey  string
+	IrcChannels []ChannelConfig
+	IrcDomain   string
+	IrcPort     int
+	SSL         bool
+	IrcAuth     ircAuth
+
+	//How bold, colours and so on are carried between chat and the game
+	Formatting formatConfig
+
+	//How chat is shown in game
+	Relay relayConfig
+
+	//Matrix and Discord bridges, optional
+	Matrix  matrixConfig
+	Discord discordConfig
 
 	//Command access levels
 	DefaultAccess []string
 	AccessLevels  map[string]AccessLevel
 	Ignore        []string
 
+	//Console mirror: at most ConsoleMaxLines lines are sent to each console
+	//room every ConsoleWindow seconds, the rest are summarised
+	ConsoleMaxLines int
+	ConsoleWindow   int64
+
+	//How many relayed chat lines, joins, deaths and so on are kept for
+	//'last'.  IRC users coming back after at least AwaySummary minutes are
+	//sent a summary of what they missed; 0 to not bother.
+	ScrollbackSize int
+	AwaySummary    int64
+
 	//Backup related
 	BackupCommand  cmd
 	BackupInterval int64
@@ -34,19 +72,32 @@ type Config struct {
 	MapTempWorldDir   string
 	MapUpdateInterval int64
 
-	//MC Server config
+	//MC Server config.  To manage more than one server, describe each in
+	//Servers instead of using these and the backup/map settings above.
 	MCServerCommand cmd
 	MCServerDir     string
 	MCWorldDir      string
+	Servers         []ServerConfig
 
 	//Derived values:
+	servers            []*ServerConfig
+	formatAllowed      map[string]bool
+	relayTemplates     relayTemplates
+	muted              map[string]bool
+	ircChannels        []*ChannelConfig
 	defaultAccess      map[string]bool
 	accessLevels       map[string]map[string]bool
 	accessLevelMembers map[string][]string
 	ignore             map[string]bool
 
-	//The filename this config was pulled from
+	//The filename this config was pulled from, the format it was in and
+	//what it said
 	source string
+	format string
+	raw    []byte
+
+	//Field path -> the ${ENV_VAR} or file:/path reference resolved there
+	secrets map[string]secretRef
 }
 
 type AccessLevel struct {
@@ -66,8 +117,14 @@ func ReadConfig(confFile string) (*Config, error) {
 	}
 
 	conf := &Config{}
+	format := detectFormat(confFile, raw)
 
-	if err = json.Unmarshal(raw, conf); err != nil {
+	if err = decodeConfig(raw, format, conf); err != nil {
+		return nil, err
+	}
+
+	warnIfWorldReadable(confFile)
+	if conf.secrets, err = resolveSecrets(conf); err != nil {
 		return nil, err
 	}
 
@@ -78,45 +135,173 @@ func ReadConfig(confFile string) (*Config, error) {
 	applyDefaults(conf)
 	mungeConfig(conf)
 	conf.source = confFile
+	conf.format = format
+	conf.raw = raw
 	return conf, nil
 }
 
-func (c *Config) Reparse() error {
-	newConf, err := ReadConfig(c.source)
-	if err != nil {
-		return err
-	}
+//Get the active configuration.  The returned Config is shared and must be
+//treated as read only; changes are made by swapping in a new one.
+func currentConfig() *Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return config
+}
 
-	*c = *newConf
+func setConfig(c *Config) {
+	configLock.Lock()
+	config = c
+	configLock.Unlock()
+}
 
-	return nil
+//Read a fresh copy of c from the file it was originally loaded from.
+//c itself is left untouched.
+func (c *Config) Reparse() (*Config, error) {
+	return ReadConfig(c.source)
 }
 
+//Write the changes made to c since it was read out to confFile, which is
+//edited in place so the rest of it, comments included, stays as it was.
+//Secrets are written as the references they were resolved from.  The new
+//file is written next to confFile and renamed into place so a crash can't
+//leave a half written config behind, and the previous contents are kept in
+//confFile.bak.
 func (c *Config) WriteConfig(confFile string) error {
-	tmp, err := ioutil.TempFile("", "mcbot-")
-	if err != nil {
+	read := &Config{}
+	if err := decodeConfig(c.raw, c.format, read); err != nil {
+		return err
+	}
+	//Defaults are filled in on both sides so only real changes show up,
+	//and a file that left them out keeps leaving them out
+	applyDefaults(read)
+
+	//Never write resolved secrets back out
+	unresolved := c.clone()
+	if err := unresolveSecrets(unresolved, c.secrets); err != nil {
 		return err
 	}
 
-	raw, err := json.MarshalIndent(c, "", "  ")
+	edits := diffGeneric(toGeneric(read), toGeneric(unresolved), nil)
+	if len(edits) == 0 {
+		return nil
+	}
+
+	//The file as it is now, in case it's been edited by hand since
+	current := []byte{}
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(confFile); err == nil {
+		if current, err = ioutil.ReadFile(confFile); err != nil {
+			return err
+		}
+
+		if err = ioutil.WriteFile(confFile+".bak", current, info.Mode()); err != nil {
+			return err
+		}
+		mode = info.Mode()
+	}
+
+	raw, err := patchConfig(current, c.format, edits)
 	if err != nil {
 		return err
 	}
+	if err = writeAtomic(confFile, raw, mode); err != nil {
+		return err
+	}
+
+	//So the next write starts from here, without picking up any hand edits
+	//c doesn't know about
+	c.raw, err = patchConfig(c.raw, c.format, edits)
+	return err
+}
 
-	_, err = tmp.Write(raw)
+//Make a deep copy of c that can be edited without disturbing readers of c
+func (c *Config) clone() *Config {
+	raw, err := json.Marshal(c)
 	if err != nil {
+		panic(err) //Config is always marshalable
+	}
+
+	n := &Config{}
+	if err = json.Unmarshal(raw, n); err != nil {
+		panic(err)
+	}
+
+	n.source = c.source
+	n.format = c.format
+	n.raw = c.raw
+	n.secrets = c.secrets
+	return n
+}
+
+//Apply edit to a copy of the active config, persist it to the file it was
+//loaded from and swap it in.  If edit or the write fails the active config
+//is left as it was.
+func updateConfig(edit func(*Config) error) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	c := currentConfig().clone()
+	if err := edit(c); err != nil {
 		return err
 	}
 
-	tmp.Close()
+	mungeConfig(c)
 
-	err = os.Rename(tmp.Name(), confFile)
+	if err := c.WriteConfig(c.source); err != nil {
+		return err
+	}
 
-	return err
+	setConfig(c)
+	return nil
 }
 
 //Munge the config file/json friendly constructs into easier to use formats
 func mungeConfig(conf *Config) {
+	conf.ircChannels = nil
+	for i := range conf.IrcChannels {
+		c := conf.IrcChannels[i]
+		c.compile() //Already vetted by sanityCheck
+		conf.ircChannels = append(conf.ircChannels, &c)
+	}
+	if len(conf.ircChannels) == 0 && conf.IrcChan != "" {
+		c := ChannelConfig{
+			Name:  conf.IrcChan,
+			Key:   conf.IrcChanKey,
+			Roles: []string{ROLE_RELAY, ROLE_COMMANDS, ROLE_ALERTS},
+		}
+		c.compile()
+		conf.ircChannels = append(conf.ircChannels, &c)
+	}
+
+	conf.servers = nil
+	for i := range conf.Servers {
+		conf.servers = append(conf.servers, &conf.Servers[i])
+	}
+	if len(conf.servers) == 0 {
+		conf.servers = []*ServerConfig{{
+			Name:              defaultServerName,
+			MCServerCommand:   conf.MCServerCommand,
+			MCServerDir:       conf.MCServerDir,
+			MCWorldDir:        conf.MCWorldDir,
+			BackupCommand:     conf.BackupCommand,
+			BackupInterval:    conf.BackupInterval,
+			MapUpdateCommand:  conf.MapUpdateCommand,
+			MapTempWorldDir:   conf.MapTempWorldDir,
+			MapUpdateInterval: conf.MapUpdateInterval,
+		}}
+	}
+
+	conf.relayTemplates, _ = conf.Relay.compile() //Already vetted by sanityCheck
+	conf.muted = make(map[string]bool, len(conf.Relay.Muted))
+	for _, who := range conf.Relay.Muted {
+		conf.muted[strings.ToLower(who)] = true
+	}
+
+	conf.formatAllowed = make(map[string]bool)
+	for _, format := range conf.Formatting.Allowed {
+		conf.formatAllowed[format] = true
+	}
+
 	conf.defaultAccess = make(map[string]bool, len(conf.DefaultAccess))
 	for _, cmd := range conf.DefaultAccess {
 		conf.defaultAccess[cmd] = true
@@ -142,9 +327,181 @@ func mungeConfig(conf *Config) {
 }
 
 func sanityCheck(c *Config) error {
-	return nil
+	for _, channel := range c.IrcChannels {
+		if err := channel.compile(); err != nil {
+			return err
+		}
+	}
+
+	if err := checkServers(c); err != nil {
+		return err
+	}
+
+	if err := checkFormatting(c.Formatting); err != nil {
+		return err
+	}
+
+	if _, err := c.Relay.compile(); err != nil {
+		return err
+	}
+
+	return checkIRCAuth(c.IrcAuth, c.SSL)
 }
 
 func applyDefaults(c *Config) {
-	return
+	if c.IrcAuth.IdentifyTimeout <= 0 {
+		c.IrcAuth.IdentifyTimeout = 15
+	}
+	if c.DataDir == "" {
+		c.DataDir = "."
+	}
+	if c.Formatting.ToGame == "" {
+		c.Formatting.ToGame = FORMATTING_TRANSLATE
+	}
+	if c.Formatting.ToChat == "" {
+		c.Formatting.ToChat = FORMATTING_TRANSLATE
+	}
+	if len(c.Formatting.Allowed) == 0 {
+		c.Formatting.Allowed = defaultAllowedFormats
+	}
+	if c.Relay.Command == "" {
+		c.Relay.Command = RELAY_AUTO
+	}
+	if c.Relay.SayTemplate == "" {
+		c.Relay.SayTemplate = defaultSayTemplate
+	}
+	if c.Relay.TellrawTemplate == "" {
+		c.Relay.TellrawTemplate = defaultTellrawTemplate
+	}
+	c.Relay.applyDefaults()
+	if c.ConsoleMaxLines <= 0 {
+		c.ConsoleMaxLines = 20
+	}
+	if c.ConsoleWindow <= 0 {
+		c.ConsoleWindow = 10
+	}
+	if c.ScrollbackSize <= 0 {
+		c.ScrollbackSize = 100
+	}
+}
+
+//Fields which can't be applied to a running bot
+var restartRequired = map[string]bool{
+	"HostOS":          true,
+	"DataDir":         true,
+	"Nick":            true,
+	"Pass":            true,
+	"AttnChar":        true,
+	"IrcServer":       true,
+	"IrcDomain":       true,
+	"IrcPort":         true,
+	"SSL":             true,
+	"IrcAuth":         true,
+	"Matrix":          true,
+	"Discord":         true,
+	"MCServerCommand": true,
+	"MCServerDir":     true,
+}
+
+//Fields whose values shouldn't be echoed back to chat
+var secretFields = map[string]bool{
+	"Pass":        true,
+	"IrcChanKey":  true,
+	"IrcChannels": true,
+	"IrcAuth":     true,
+	"Matrix":      true,
+	"Discord":     true,
+}
+
+type configChange struct {
+	Field    string
+	Old, New string
+}
+
+//Compare the exported fields of two configs
+func diffConfig(old, new *Config) []configChange {
+	var changes []configChange
+
+	oldVal := reflect.ValueOf(old).Elem()
+	newVal := reflect.ValueOf(new).Elem()
+	t := oldVal.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" { //Unexported, derived from something else
+			continue
+		}
+
+		o, n := oldVal.Field(i).Interface(), newVal.Field(i).Interface()
+		if reflect.DeepEqual(o, n) {
+			continue
+		}
+
+		change := configChange{Field: field.Name}
+		if secretFields[field.Name] {
+			change.Old, change.New = "(hidden)", "(hidden)"
+		} else {
+			change.Old, change.New = fmt.Sprintf("%v", o), fmt.Sprintf("%v", n)
+		}
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+//Reread the config file, swap it in and apply whatever changed.  Returns a
+//human readable description of each change and how it was handled.
+func reloadConfig() ([]string, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	old := currentConfig()
+	newConf, err := old.Reparse()
+	if err != nil {
+		return nil, err
+	}
+
+	changes := diffConfig(old, newConf)
+	setConfig(newConf)
+
+	if len(changes) == 0 {
+		return []string{"Config reloaded, no changes."}, nil
+	}
+
+	var report []string
+	reschedule, rejoined := false, false
+
+	for _, change := range changes {
+		line := fmt.Sprintf("%s: %s -> %s", change.Field, change.Old, change.New)
+
+		switch change.Field {
+		case "IrcChan", "IrcChanKey", "IrcChannels":
+			if !rejoined {
+				ircChat.syncChannels(old.ircChannels, newConf.ircChannels)
+				rejoined = true
+			}
+			line += " (channels updated)"
+		case "DefaultAccess", "AccessLevels", "Ignore":
+			line += " (permissions rebuilt)"
+		case "MapUpdateCommand", "MapUpdateInterval":
+			reschedule = true
+			line += " (rescheduled)"
+		case "Servers":
+			reschedule = true
+			line += " (rescheduled, new servers and server commands require restart)"
+		default:
+			if restartRequired[change.Field] {
+				line += " (requires restart to take effect)"
+				logErr.Printf("Config field %s changed, restart mc-bot to apply it\n", change.Field)
+			}
+		}
+
+		report = append(report, line)
+	}
+
+	if reschedule {
+		scheduleFromConfig(newConf)
+	}
+
+	return report, nil
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffConfig(t *testing.T) {
+	old := &Config{Nick: "MCBot", Pass: "hunter2", DefaultAccess: []string{"help"}}
+	new := &Config{Nick: "MCBot", Pass: "swordfish", DefaultAccess: []string{"help", "list"}}
+	new.source = "elsewhere" //Unexported fields are derived, and don't count
+
+	want := []configChange{
+		{"Pass", "(hidden)", "(hidden)"},
+		{"DefaultAccess", "[help]", "[help list]"},
+	}
+	if got := diffConfig(old, new); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := diffConfig(old, old); len(got) != 0 {
+		t.Errorf("a config differs from itself: %+v", got)
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	fields := reflect.TypeOf(Config{})
+	for name := range restartRequired {
+		if _, ok := fields.FieldByName(name); !ok {
+			t.Errorf("%s isn't a config field", name)
+		}
+	}
+	for name := range secretFields {
+		if _, ok := fields.FieldByName(name); !ok {
+			t.Errorf("secret %s isn't a config field", name)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	withTestConfig(t, nil)
+	file := filepath.Join(t.TempDir(), "mcbot.yaml")
+	write := func(raw string) {
+		if err := ioutil.WriteFile(file, []byte(raw), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("Nick: MCBot\nIrcChan: \"#mc\"\nDefaultAccess: [help]\n")
+	conf, err := ReadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(conf)
+
+	if report, err := reloadConfig(); err != nil || !reflect.DeepEqual(report, []string{"Config reloaded, no changes."}) {
+		t.Errorf("unchanged: %q, %v", report, err)
+	}
+
+	write("Nick: MCBot2\nIrcChan: \"#mc\"\nDefaultAccess: [help, list]\nMapUpdateInterval: 30\n")
+	report, err := reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Nick: MCBot -> MCBot2 (requires restart to take effect)",
+		"DefaultAccess: [help] -> [help list] (permissions rebuilt)",
+		"MapUpdateInterval: 0 -> 30 (rescheduled)",
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("got %q, want %q", report, want)
+	}
+	if !currentConfig().defaultAccess["list"] {
+		t.Error("new permissions not in effect")
+	}
+
+	//A broken file leaves the running config alone
+	write("Nick: [unclosed\n")
+	if _, err := reloadConfig(); err == nil {
+		t.Error("reloaded a broken file")
+	}
+	if currentConfig().Nick != "MCBot2" {
+		t.Errorf("running config is now %q", currentConfig().Nick)
+	}
+}
+
+func TestChannelChanges(t *testing.T) {
+	names := func(cs []*ChannelConfig) string {
+		var n []string
+		for _, c := range cs {
+			n = append(n, c.Name)
+		}
+		return strings.Join(n, " ")
+	}
+
+	old := []*ChannelConfig{{Name: "#mc"}, {Name: "#staff", Key: "old"}, {Name: "#gone"}}
+	new := []*ChannelConfig{{Name: "#MC"}, {Name: "#staff", Key: "new"}, {Name: "#new"}}
+	part, join := channelChanges(old, new)
+	if names(part) != "#staff #gone" || names(join) != "#staff #new" {
+		t.Errorf("parted %q, joined %q", names(part), names(join))
+	}
+	if join[0].Key != "new" {
+		t.Errorf("rejoined with %q", join[0].Key)
+	}
+}
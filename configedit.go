@@ -0,0 +1,859 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//Saving changes made from chat back into the config file.  Rather than
+//encoding the whole config again, what changed is worked out as a list of
+//edits and each is made to the file as it stands, so its comments and
+//layout survive.  JSON and TOML are edited as text, YAML through yaml.v3's
+//node tree.
+
+//One change to a config file: the setting at path given value, or removed
+type configEdit struct {
+	path   []string
+	value  interface{}
+	remove bool
+}
+
+func (e configEdit) String() string {
+	return strings.Join(e.path, ".")
+}
+
+//conf as plain maps, slices and values, keyed like the config file
+func toGeneric(conf *Config) map[string]interface{} {
+	raw, err := json.Marshal(conf)
+	if err != nil {
+		panic(err) //Config is always marshalable
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var generic map[string]interface{}
+	if err = dec.Decode(&generic); err != nil {
+		panic(err)
+	}
+	plainValues(generic)
+	return generic
+}
+
+//The edits which turn old into new, both as from toGeneric
+func diffGeneric(old, new interface{}, path []string) []configEdit {
+	oldMap, oldOk := old.(map[string]interface{})
+	newMap, newOk := new.(map[string]interface{})
+	if !oldOk || !newOk {
+		if reflect.DeepEqual(old, new) {
+			return nil
+		}
+		return []configEdit{{path: path, value: new}}
+	}
+
+	var keys []string
+	for key := range oldMap {
+		keys = append(keys, key)
+	}
+	for key := range newMap {
+		if _, ok := oldMap[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var edits []configEdit
+	for _, key := range keys {
+		p := append(path[:len(path):len(path)], key)
+		o, inOld := oldMap[key]
+		n, inNew := newMap[key]
+		switch {
+		case !inNew:
+			edits = append(edits, configEdit{path: p, remove: true})
+		case !inOld:
+			edits = append(edits, configEdit{path: p, value: n})
+		default:
+			edits = append(edits, diffGeneric(o, n, p)...)
+		}
+	}
+	return edits
+}
+
+//The key in m that key names.  Config fields are matched without regard to
+//case, as encoding/json does when the file is read.
+func lookupKey(m map[string]interface{}, key string) string {
+	if _, ok := m[key]; ok {
+		return key
+	}
+	for k := range m {
+		if strings.EqualFold(k, key) {
+			return k
+		}
+	}
+	return key
+}
+
+func sameKey(a, b string) bool {
+	return a == b || strings.EqualFold(a, b)
+}
+
+//Make e to doc, a config file decoded generically
+func (e configEdit) apply(doc map[string]interface{}) {
+	m := doc
+	for i, key := range e.path {
+		key = lookupKey(m, key)
+		if i == len(e.path)-1 {
+			if e.remove {
+				delete(m, key)
+			} else {
+				m[key] = e.value
+			}
+			return
+		}
+
+		next, ok := m[key].(map[string]interface{})
+		if !ok {
+			if e.remove {
+				return
+			}
+			next = make(map[string]interface{})
+			m[key] = next
+		}
+		m = next
+	}
+}
+
+//What's at path in doc, or nil
+func genericAt(doc map[string]interface{}, path []string) interface{} {
+	var v interface{} = doc
+	for _, key := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[lookupKey(m, key)]
+	}
+	return v
+}
+
+//value, to be set at the end of path when none of path exists yet
+func nestValue(path []string, value interface{}) interface{} {
+	for i := len(path) - 1; i > 0; i-- {
+		value = map[string]interface{}{path[i]: value}
+	}
+	return value
+}
+
+//Make edits to raw, a config file in format, returning the new contents.
+//The result is checked to still parse, in case the file is laid out in a
+//way the editing didn't anticipate.
+func patchConfig(raw []byte, format string, edits []configEdit) ([]byte, error) {
+	var err error
+	switch format {
+	case FORMAT_JSON:
+		raw, err = patchJSON(raw, edits)
+	case FORMAT_TOML:
+		raw, err = patchTOML(raw, edits)
+	case FORMAT_YAML:
+		raw, err = patchYAML(raw, edits)
+	default:
+		return nil, errors.New("Unknown config format: " + format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = decodeGeneric(raw, format); err != nil {
+		return nil, fmt.Errorf("couldn't edit the config in place (%s), change it by hand", err)
+	}
+	return raw, nil
+}
+
+//JSON
+
+//A member of a JSON object, as offsets into the file
+type jsonMember struct {
+	key                        string
+	keyStart, valStart, valEnd int
+}
+
+func patchJSON(raw []byte, edits []configEdit) ([]byte, error) {
+	if len(bytes.TrimSpace(stripJSONComments(raw))) == 0 {
+		raw = []byte("{\n}\n")
+	}
+
+	doc, err := decodeGeneric(raw, FORMAT_JSON)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range edits {
+		e.apply(doc)
+		if raw, err = patchJSONEdit(raw, doc, e); err != nil {
+			return nil, fmt.Errorf("%s: %s", e, err)
+		}
+	}
+	return raw, nil
+}
+
+//Make e to raw.  doc is raw decoded, with e already made to it.
+func patchJSONEdit(raw []byte, doc map[string]interface{}, e configEdit) ([]byte, error) {
+	//Comments are blanked out rather than removed, so offsets into plain
+	//are offsets into raw
+	plain := stripJSONComments(raw)
+
+	start := bytes.IndexByte(plain, '{')
+	if start < 0 {
+		return nil, errors.New("the config isn't a JSON object")
+	}
+	var obj json.RawMessage
+	if err := json.Unmarshal(plain[start:], &obj); err != nil {
+		return nil, err
+	}
+	end := start + len(obj)
+
+	for i, key := range e.path {
+		members, err := jsonMembers(plain, start, end)
+		if err != nil {
+			return nil, err
+		}
+
+		found := -1
+		for j, m := range members {
+			if sameKey(m.key, key) {
+				found = j
+				break
+			}
+		}
+
+		if found < 0 {
+			if e.remove {
+				return raw, nil
+			}
+			return jsonInsert(raw, start, end, members, key, genericAt(doc, e.path[:i+1])), nil
+		}
+
+		m := members[found]
+		if i == len(e.path)-1 {
+			if e.remove {
+				return jsonRemove(raw, members, found), nil
+			}
+			return jsonReplace(raw, m, e.value), nil
+		}
+		if plain[m.valStart] != '{' {
+			return jsonReplace(raw, m, genericAt(doc, e.path[:i+1])), nil
+		}
+		start, end = m.valStart, m.valEnd
+	}
+	return raw, nil
+}
+
+//The members of the object between start and end in plain
+func jsonMembers(plain []byte, start, end int) ([]jsonMember, error) {
+	dec := json.NewDecoder(bytes.NewReader(plain[start:end]))
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+
+	var members []jsonMember
+	for dec.More() {
+		keyStart := start + int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		for plain[keyStart] != '"' {
+			keyStart++
+		}
+
+		var value json.RawMessage
+		if err = dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		valEnd := start + int(dec.InputOffset())
+
+		key, _ := tok.(string)
+		members = append(members, jsonMember{key, keyStart, valEnd - len(value), valEnd})
+	}
+	return members, nil
+}
+
+func jsonReplace(raw []byte, m jsonMember, value interface{}) []byte {
+	oneLine := !bytes.Contains(raw[m.valStart:m.valEnd], []byte("\n"))
+	text := jsonText(value, lineIndent(raw, m.keyStart), oneLine)
+	return splice(raw, m.valStart, m.valEnd, text)
+}
+
+func jsonInsert(raw []byte, start, end int, members []jsonMember, key string, value interface{}) []byte {
+	if len(members) > 0 {
+		indent := lineIndent(raw, members[0].keyStart)
+		last := members[len(members)-1]
+		return splice(raw, last.valEnd, last.valEnd,
+			",\n"+indent+jsonText(key, "", true)+": "+jsonText(value, indent, true))
+	}
+
+	outer := lineIndent(raw, start)
+	indent := outer + "  "
+	text := "\n" + indent + jsonText(key, "", true) + ": " + jsonText(value, indent, true) + "\n" + outer
+	if len(bytes.TrimSpace(raw[start+1:end-1])) == 0 {
+		return splice(raw, start+1, end-1, text)
+	}
+	return splice(raw, start+1, start+1, text)
+}
+
+func jsonRemove(raw []byte, members []jsonMember, i int) []byte {
+	m := members[i]
+	switch {
+	case len(members) == 1:
+		return splice(raw, m.keyStart, m.valEnd, "")
+	case i == 0:
+		return splice(raw, m.keyStart, members[1].keyStart, "")
+	}
+	return splice(raw, members[i-1].valEnd, m.valEnd, "")
+}
+
+//value as JSON, indented to follow a line starting with indent.  Lists of
+//plain values are kept on one line if oneLine is set.
+func jsonText(value interface{}, indent string, oneLine bool) string {
+	if list, ok := value.([]interface{}); ok && oneLine && plainList(list) {
+		var items []string
+		for _, item := range list {
+			items = append(items, jsonText(item, "", true))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent(indent, "  ")
+	enc.Encode(value)
+	return strings.TrimRight(buf.String(), "\n")
+}
+
+//Whether list holds nothing but strings, numbers and bools
+func plainList(list []interface{}) bool {
+	for _, item := range list {
+		switch item.(type) {
+		case map[string]interface{}, []interface{}, []map[string]interface{}:
+			return false
+		}
+	}
+	return true
+}
+
+//The whitespace the line holding pos starts with
+func lineIndent(raw []byte, pos int) string {
+	start := bytes.LastIndexByte(raw[:pos], '\n') + 1
+	end := start
+	for end < len(raw) && (raw[end] == ' ' || raw[end] == '\t') {
+		end++
+	}
+	return string(raw[start:end])
+}
+
+//raw with what's between start and end replaced by text
+func splice(raw []byte, start, end int, text string) []byte {
+	out := make([]byte, 0, len(raw)+len(text))
+	out = append(out, raw[:start]...)
+	out = append(out, text...)
+	return append(out, raw[end:]...)
+}
+
+//YAML
+
+func patchYAML(raw []byte, edits []configEdit) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, errors.New("the config isn't a YAML mapping")
+	}
+
+	for _, e := range edits {
+		if err := patchYAMLEdit(root, e.path, e); err != nil {
+			return nil, fmt.Errorf("%s: %s", e, err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	enc.Close()
+	return buf.Bytes(), nil
+}
+
+//Make e, whose path from m onwards is path, to the mapping m
+func patchYAMLEdit(m *yaml.Node, path []string, e configEdit) error {
+	found := -1
+	for i := 0; i < len(m.Content); i += 2 {
+		if sameKey(m.Content[i].Value, path[0]) {
+			found = i
+			break
+		}
+	}
+
+	if found < 0 {
+		if e.remove {
+			return nil
+		}
+		value := &yaml.Node{}
+		if err := value.Encode(nestValue(path, e.value)); err != nil {
+			return err
+		}
+		key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: path[0]}
+		m.Content = append(m.Content, key, value)
+		return nil
+	}
+
+	if len(path) == 1 {
+		if e.remove {
+			m.Content = append(m.Content[:found], m.Content[found+2:]...)
+			return nil
+		}
+		return yamlReplace(m.Content[found+1], e.value)
+	}
+
+	next := m.Content[found+1]
+	if next.Kind != yaml.MappingNode {
+		if e.remove {
+			return nil
+		}
+		return yamlReplace(next, nestValue(path, e.value))
+	}
+	return patchYAMLEdit(next, path[1:], e)
+}
+
+//Put value in place of n, keeping n's comments and flow style
+func yamlReplace(n *yaml.Node, value interface{}) error {
+	v := yaml.Node{}
+	if err := v.Encode(value); err != nil {
+		return err
+	}
+	v.HeadComment, v.LineComment, v.FootComment = n.HeadComment, n.LineComment, n.FootComment
+	if n.Style&yaml.FlowStyle != 0 && (v.Kind == yaml.SequenceNode || v.Kind == yaml.MappingNode) {
+		v.Style |= yaml.FlowStyle
+	}
+	*n = v
+	return nil
+}
+
+//TOML
+
+//A line, or lines, of a TOML file which says something
+type tomlStmt struct {
+	start, end int //Its lines, end just past the newline
+
+	table  []string //Which table it's in, or for headers, declares
+	array  bool     //Whether that's an [[array]] of tables
+	header bool
+
+	key              []string //For key = value, the key's parts
+	valStart, valEnd int
+}
+
+//The full key an assignment sets
+func (s tomlStmt) fullKey() []string {
+	return append(s.table[:len(s.table):len(s.table)], s.key...)
+}
+
+var tomlBareKeyRegex *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func patchTOML(raw []byte, edits []configEdit) ([]byte, error) {
+	doc, err := decodeGeneric(raw, FORMAT_TOML)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range edits {
+		e.apply(doc)
+		if raw, err = patchTOMLEdit(raw, doc, e); err != nil {
+			return nil, fmt.Errorf("%s: %s", e, err)
+		}
+	}
+	return raw, nil
+}
+
+//Make e to raw.  doc is raw decoded, with e already made to it.
+func patchTOMLEdit(raw []byte, doc map[string]interface{}, e configEdit) ([]byte, error) {
+	stmts, err := scanTOML(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	//Set directly, or within an inline table
+	for _, s := range stmts {
+		if s.header || s.array {
+			continue
+		}
+		key := s.fullKey()
+		if !keyPrefix(key, e.path) {
+			continue
+		}
+
+		if len(key) == len(e.path) && e.remove {
+			return splice(raw, s.start, s.end, ""), nil
+		}
+		value := genericAt(doc, key)
+		if value == nil {
+			return splice(raw, s.start, s.end, ""), nil
+		}
+		return splice(raw, s.valStart, s.valEnd, tomlValue(value)), nil
+	}
+
+	//Otherwise the tables and dotted keys which set it go, and it's
+	//added afresh
+	type span struct{ start, end int }
+	var spans []span
+	for i, s := range stmts {
+		if s.header && keyPrefix(e.path, s.table) {
+			spans = append(spans, span{s.start, regionEnd(stmts, i)})
+		} else if !s.header && !s.array && !keyPrefix(e.path, s.table) && keyPrefix(e.path, s.fullKey()) {
+			spans = append(spans, span{s.start, s.end})
+		}
+	}
+	for i := len(spans) - 1; i >= 0; i-- {
+		raw = splice(raw, spans[i].start, spans[i].end, "")
+	}
+	if e.remove {
+		return raw, nil
+	}
+
+	if stmts, err = scanTOML(raw); err != nil {
+		return nil, err
+	}
+	return tomlInsert(raw, stmts, e.path, e.value), nil
+}
+
+//Add value at path, which the file doesn't set at all
+func tomlInsert(raw []byte, stmts []tomlStmt, path []string, value interface{}) []byte {
+	if table, ok := value.(map[string]interface{}); ok {
+		return tomlAppendTable(raw, path, table)
+	}
+
+	//Into the deepest table already declared which it belongs in
+	at := -1
+	for i, s := range stmts {
+		if s.header && !s.array && len(s.table) < len(path) && keyPrefix(s.table, path) &&
+			(at < 0 || len(s.table) > len(stmts[at].table)) {
+			at = i
+		}
+	}
+
+	//Only the root table is, so unless the root already sets some of the
+	//key's table with dotted keys, give the table a header of its own
+	if at < 0 && len(path) > 1 {
+		dotted := false
+		for _, s := range stmts {
+			if !s.header && len(s.table) == 0 && len(s.key) > 1 && sameKey(s.key[0], path[0]) {
+				dotted = true
+			}
+		}
+		if !dotted {
+			return tomlAppendTable(raw, path[:len(path)-1], map[string]interface{}{path[len(path)-1]: value})
+		}
+	}
+
+	var table []string
+	if at >= 0 {
+		table = stmts[at].table
+	}
+	line := tomlKey(path[len(table):]) + " = " + tomlValue(value) + "\n"
+
+	//After the table's last statement, which for the root table is
+	//before the first header
+	pos := len(raw)
+	if at >= 0 {
+		pos = regionEnd(stmts, at)
+	} else {
+		for i, s := range stmts {
+			if s.header {
+				if i == 0 {
+					pos, line = s.start, line+"\n"
+				}
+				break
+			}
+			pos = s.end
+		}
+	}
+
+	if pos > 0 && raw[pos-1] != '\n' {
+		line = "\n" + line
+	}
+	return splice(raw, pos, pos, line)
+}
+
+//The end of the last statement in the table declared by stmts[header]
+func regionEnd(stmts []tomlStmt, header int) int {
+	end := stmts[header].end
+	for i := header + 1; i < len(stmts) && !stmts[i].header; i++ {
+		end = stmts[i].end
+	}
+	return end
+}
+
+//Add table at path to the end of raw, with any tables inside it after
+func tomlAppendTable(raw []byte, path []string, table map[string]interface{}) []byte {
+	buf := &bytes.Buffer{}
+	writeTOMLTable(buf, path, table)
+
+	text := buf.String()
+	if len(raw) > 0 && raw[len(raw)-1] != '\n' {
+		text = "\n" + text
+	}
+	return append(raw[:len(raw):len(raw)], text...)
+}
+
+func writeTOMLTable(buf *bytes.Buffer, path []string, table map[string]interface{}) {
+	var keys, subtables []string
+	for key, value := range table {
+		if _, ok := value.(map[string]interface{}); ok {
+			subtables = append(subtables, key)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	sort.Strings(subtables)
+
+	if len(keys) > 0 || len(subtables) == 0 {
+		fmt.Fprintf(buf, "\n[%s]\n", tomlKey(path))
+		for _, key := range keys {
+			fmt.Fprintf(buf, "%s = %s\n", tomlKey([]string{key}), tomlValue(table[key]))
+		}
+	}
+	for _, key := range subtables {
+		writeTOMLTable(buf, append(path[:len(path):len(path)], key), table[key].(map[string]interface{}))
+	}
+}
+
+//Whether prefix is the start of path
+func keyPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if !sameKey(prefix[i], path[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+//A dotted TOML key for path
+func tomlKey(path []string) string {
+	var parts []string
+	for _, part := range path {
+		if tomlBareKeyRegex.MatchString(part) {
+			parts = append(parts, part)
+		} else {
+			parts = append(parts, jsonText(part, "", true))
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+//value as an inline TOML value
+func tomlValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return jsonText(v, "", true) //JSON's string escapes are all valid TOML
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			items = append(items, tomlValue(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case []map[string]interface{}:
+		var items []string
+		for _, item := range v {
+			items = append(items, tomlValue(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[string]interface{}:
+		var keys []string
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var items []string
+		for _, key := range keys {
+			items = append(items, tomlKey([]string{key})+" = "+tomlValue(v[key]))
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	}
+	return fmt.Sprint(value)
+}
+
+//Break raw up into headers and assignments, skipping comments and blank
+//lines
+func scanTOML(raw []byte) ([]tomlStmt, error) {
+	var stmts []tomlStmt
+	var table []string
+	array := false
+
+	for pos := 0; pos < len(raw); {
+		lineStart := pos
+		for pos < len(raw) && (raw[pos] == ' ' || raw[pos] == '\t' || raw[pos] == '\r') {
+			pos++
+		}
+		if pos >= len(raw) || raw[pos] == '\n' || raw[pos] == '#' {
+			pos = lineEnd(raw, pos)
+			continue
+		}
+
+		if raw[pos] == '[' {
+			s := tomlStmt{start: lineStart, header: true}
+			open, close := "[", "]"
+			if pos+1 < len(raw) && raw[pos+1] == '[' {
+				open, close, s.array = "[[", "]]", true
+			}
+			end := bytes.Index(raw[pos:], []byte(close))
+			if end < 0 {
+				return nil, errors.New("unterminated table header")
+			}
+			s.table = parseTOMLKey(string(raw[pos+len(open) : pos+end]))
+			s.end = lineEnd(raw, pos+end)
+			table, array = s.table, s.array
+			stmts = append(stmts, s)
+			pos = s.end
+			continue
+		}
+
+		eq := tomlKeyEnd(raw, pos)
+		if eq < 0 {
+			return nil, fmt.Errorf("can't make sense of line %q", strings.TrimSpace(string(raw[lineStart:lineEnd(raw, pos)])))
+		}
+		s := tomlStmt{start: lineStart, table: table, array: array}
+		s.key = parseTOMLKey(string(raw[pos:eq]))
+		s.valStart = eq + 1
+		for s.valStart < len(raw) && (raw[s.valStart] == ' ' || raw[s.valStart] == '\t') {
+			s.valStart++
+		}
+		s.valEnd = scanTOMLValue(raw, s.valStart)
+		s.end = lineEnd(raw, s.valEnd)
+		stmts = append(stmts, s)
+		pos = s.end
+	}
+	return stmts, nil
+}
+
+//Just past the end of the line pos is on
+func lineEnd(raw []byte, pos int) int {
+	if i := bytes.IndexByte(raw[pos:], '\n'); i >= 0 {
+		return pos + i + 1
+	}
+	return len(raw)
+}
+
+//Where the = after the key starting at pos is, or -1
+func tomlKeyEnd(raw []byte, pos int) int {
+	for pos < len(raw) && raw[pos] != '\n' {
+		switch raw[pos] {
+		case '=':
+			return pos
+		case '"', '\'':
+			pos = tomlStringEnd(raw, pos)
+		default:
+			pos++
+		}
+	}
+	return -1
+}
+
+//Just past the end of the string starting at pos
+func tomlStringEnd(raw []byte, pos int) int {
+	quote := raw[pos]
+	delim := []byte{quote}
+	if bytes.HasPrefix(raw[pos:], []byte{quote, quote, quote}) {
+		delim = []byte{quote, quote, quote}
+	}
+
+	for i := pos + len(delim); i < len(raw); i++ {
+		if quote == '"' && raw[i] == '\\' {
+			i++
+			continue
+		}
+		if bytes.HasPrefix(raw[i:], delim) {
+			return i + len(delim)
+		}
+	}
+	return len(raw)
+}
+
+//Just past the end of the value starting at pos, before any comment
+func scanTOMLValue(raw []byte, pos int) int {
+	depth := 0
+	end := pos
+	for pos < len(raw) {
+		c := raw[pos]
+		switch {
+		case c == '"' || c == '\'':
+			pos = tomlStringEnd(raw, pos)
+			end = pos
+			continue
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == '#':
+			if depth == 0 {
+				return end
+			}
+			pos = lineEnd(raw, pos)
+			continue
+		case c == '\n':
+			if depth == 0 {
+				return end
+			}
+		}
+		pos++
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			end = pos
+		}
+	}
+	return end
+}
+
+//The parts of a possibly dotted and quoted TOML key
+func parseTOMLKey(key string) []string {
+	var parts []string
+	for key = strings.TrimSpace(key); key != ""; {
+		var part string
+		switch key[0] {
+		case '"':
+			end := tomlStringEnd([]byte(key), 0)
+			if err := json.Unmarshal([]byte(key[:end]), &part); err != nil {
+				part = strings.Trim(key[:end], `"`)
+			}
+			key = key[end:]
+		case '\'':
+			end := tomlStringEnd([]byte(key), 0)
+			part, key = strings.Trim(key[:end], "'"), key[end:]
+		default:
+			end := strings.IndexByte(key, '.')
+			if end < 0 {
+				end = len(key)
+			}
+			part, key = strings.TrimSpace(key[:end]), key[end:]
+		}
+		parts = append(parts, part)
+		key = strings.TrimPrefix(strings.TrimSpace(key), ".")
+		key = strings.TrimSpace(key)
+	}
+	return parts
+}
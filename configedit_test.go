@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var configEditTests = []struct {
+	file string
+	raw  string
+	kept []string //Must survive an edit untouched
+}{
+	{"mcbot.yaml", `# The bot's nick
+Nick: MCBot
+Pass: ${MCBOT_TEST_PASS} # From the environment
+
+DefaultAccess: [help, list]
+AccessLevels:
+  # Staff
+  Admin:
+    Members: ["irc:cbeck"] # The boss
+    Allowed: [kick]
+`, []string{"# The bot's nick", "${MCBOT_TEST_PASS} # From the environment", "# Staff", "# The boss"}},
+
+	{"mcbot.conf", `{
+    // The bot's nick
+    "Nick" : "MCBot",
+    "Pass" : "${MCBOT_TEST_PASS}", /* From the environment */
+
+    "DefaultAccess" : ["help", "list"],
+    "AccessLevels" : {
+	// Staff
+	"Admin" : {
+	    "Members" : ["irc:cbeck"], // The boss
+	    "Allowed" : ["kick"]
+	}
+    }
+}
+`, []string{"// The bot's nick", `"${MCBOT_TEST_PASS}", /* From the environment */`, "// Staff", "// The boss"}},
+
+	{"mcbot.toml", `# The bot's nick
+Nick = "MCBot"
+Pass = "${MCBOT_TEST_PASS}" # From the environment
+DefaultAccess = ["help", "list"]
+
+# Staff
+[AccessLevels.Admin]
+Members = ["irc:cbeck"] # The boss
+Allowed = ["kick"]
+`, []string{"# The bot's nick", `"${MCBOT_TEST_PASS}" # From the environment`, "# Staff", "# The boss"}},
+}
+
+func TestWriteConfigInPlace(t *testing.T) {
+	os.Setenv("MCBOT_TEST_PASS", "hunter2")
+	defer os.Unsetenv("MCBOT_TEST_PASS")
+	defer setConfig(currentConfig())
+
+	for _, test := range configEditTests {
+		dir, err := ioutil.TempDir("", "mcbot-config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		file := filepath.Join(dir, test.file)
+		if err = ioutil.WriteFile(file, []byte(test.raw), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		conf, err := ReadConfig(file)
+		if err != nil {
+			t.Fatalf("%s: %s", test.file, err)
+		}
+		setConfig(conf)
+
+		err = updateConfig(func(c *Config) error {
+			admin := c.AccessLevels["Admin"]
+			admin.Allowed = append(admin.Allowed, "ban")
+			c.AccessLevels["Admin"] = admin
+			c.AccessLevels["Mod"] = AccessLevel{Members: []string{"irc:aardvark"}, Allowed: []string{"tp"}}
+			c.Ignore = append(c.Ignore, "spammer")
+			c.Relay.Muted = append(c.Relay.Muted, "griefer")
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", test.file, err)
+		}
+
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, kept := range test.kept {
+			if !strings.Contains(string(raw), kept) {
+				t.Errorf("%s: lost %q:\n%s", test.file, kept, raw)
+			}
+		}
+
+		for _, def := range []string{"ScrollbackSize", "ConsoleMaxLines", "IdentifyTimeout", "Formatting", "DataDir", "Events"} {
+			if strings.Contains(string(raw), def) {
+				t.Errorf("%s: default %s written out:\n%s", test.file, def, raw)
+			}
+		}
+
+		reread, err := ReadConfig(file)
+		if err != nil {
+			t.Fatalf("%s: rereading: %s\n%s", test.file, err, raw)
+		}
+		if got := reread.AccessLevels["Admin"].Allowed; !reflect.DeepEqual(got, []string{"kick", "ban"}) {
+			t.Errorf("%s: Admin allowed %v", test.file, got)
+		}
+		if got := reread.AccessLevels["Mod"].Members; !reflect.DeepEqual(got, []string{"irc:aardvark"}) {
+			t.Errorf("%s: Mod members %v", test.file, got)
+		}
+		if !reflect.DeepEqual(reread.Ignore, []string{"spammer"}) {
+			t.Errorf("%s: Ignore %v", test.file, reread.Ignore)
+		}
+		if !reflect.DeepEqual(reread.Relay.Muted, []string{"griefer"}) {
+			t.Errorf("%s: Muted %v", test.file, reread.Relay.Muted)
+		}
+		if reread.Pass != "hunter2" || strings.Contains(string(raw), "hunter2") {
+			t.Errorf("%s: secret mishandled:\n%s", test.file, raw)
+		}
+
+		//A second edit, to what the first left behind
+		err = updateConfig(func(c *Config) error {
+			delete(c.AccessLevels, "Mod")
+			c.Ignore = nil
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", test.file, err)
+		}
+		if reread, err = ReadConfig(file); err != nil {
+			t.Fatalf("%s: rereading: %s", test.file, err)
+		}
+		if _, ok := reread.AccessLevels["Mod"]; ok || len(reread.Ignore) != 0 {
+			t.Errorf("%s: Mod or Ignore not removed", test.file)
+		}
+	}
+}
+
+func TestDiffGeneric(t *testing.T) {
+	old := map[string]interface{}{
+		"Nick":   "MCBot",
+		"Ignore": []interface{}{"a"},
+		"Relay":  map[string]interface{}{"Command": "auto", "Muted": []interface{}{"x"}},
+	}
+	new := map[string]interface{}{
+		"Nick":   "MCBot",
+		"Relay":  map[string]interface{}{"Command": "say", "Muted": []interface{}{"x"}},
+		"Matrix": map[string]interface{}{"User": "bot"},
+	}
+
+	want := []configEdit{
+		{path: []string{"Ignore"}, remove: true},
+		{path: []string{"Matrix"}, value: map[string]interface{}{"User": "bot"}},
+		{path: []string{"Relay", "Command"}, value: "say"},
+	}
+	if got := diffGeneric(old, new, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStripJSONComments(t *testing.T) {
+	for raw, want := range map[string]string{
+		`{"a": 1} // note`:          `{"a": 1}        `,
+		"{/* x\ny */\"a\": \"//\"}": "{    \n    \"a\": \"//\"}",
+		`{"a": "\"/*"}`:             `{"a": "\"/*"}`,
+	} {
+		if got := string(stripJSONComments([]byte(raw))); got != want {
+			t.Errorf("%q: got %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func TestScanTOML(t *testing.T) {
+	raw := []byte(`a = "x # not a comment" # comment
+b.c = [1,
+  2] # more
+[t."u.v"]
+d = {e = 1}
+[[arr]]
+f = '''
+multi
+'''
+`)
+	stmts, err := scanTOML(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, s := range stmts {
+		if s.header {
+			got = append(got, "["+strings.Join(s.table, "|")+"]")
+		} else {
+			got = append(got, strings.Join(s.fullKey(), "|")+"="+string(raw[s.valStart:s.valEnd]))
+		}
+	}
+	want := []string{`a="x # not a comment"`, "b|c=[1,\n  2]", "[t|u.v]", "t|u.v|d={e = 1}", "[arr]", "arr|f='''\nmulti\n'''"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
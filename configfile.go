@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	FORMAT_JSON = "json"
+	FORMAT_TOML = "toml"
+	FORMAT_YAML = "yaml"
+)
+
+var tomlKeyRegex *regexp.Regexp = regexp.MustCompile(`(?m)^\s*(\[[\w.]+\]|[\w"]+\s*=)`)
+
+//Work out which format a config file is in, first by extension and then by
+//looking at its contents.  Anything unrecognisable is assumed to be JSON.
+func detectFormat(file string, raw []byte) string {
+	if format := formatForExtension(file); format != "" {
+		return format
+	}
+
+	trimmed := bytes.TrimSpace(stripJSONComments(raw))
+	switch {
+	case len(trimmed) > 0 && trimmed[0] == '{':
+		return FORMAT_JSON
+	case tomlKeyRegex.Match(raw):
+		return FORMAT_TOML
+	case len(trimmed) > 0:
+		return FORMAT_YAML
+	}
+
+	return FORMAT_JSON
+}
+
+func formatForExtension(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json", ".jsonc":
+		return FORMAT_JSON
+	case ".toml":
+		return FORMAT_TOML
+	case ".yaml", ".yml":
+		return FORMAT_YAML
+	}
+	return ""
+}
+
+//Decode raw into conf.  TOML and YAML are decoded generically and then
+//pushed through encoding/json so every format shares the JSON field names.
+func decodeConfig(raw []byte, format string, conf *Config) error {
+	if format == FORMAT_JSON {
+		return json.Unmarshal(stripJSONComments(raw), conf)
+	}
+
+	generic, err := decodeGeneric(raw, format)
+	if err != nil {
+		return err
+	}
+
+	asJSON, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(asJSON, conf)
+}
+
+//Decode raw as plain maps, slices and values
+func decodeGeneric(raw []byte, format string) (map[string]interface{}, error) {
+	generic := make(map[string]interface{})
+
+	switch format {
+	case FORMAT_JSON:
+		raw = bytes.TrimSpace(stripJSONComments(raw))
+		if len(raw) == 0 {
+			return generic, nil
+		}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		if err := dec.Decode(&generic); err != nil {
+			return nil, err
+		}
+		plainValues(generic)
+	case FORMAT_TOML:
+		if _, err := toml.Decode(string(raw), &generic); err != nil {
+			return nil, err
+		}
+	case FORMAT_YAML:
+		var v interface{}
+		if err := yaml.Unmarshal(raw, &v); err != nil {
+			return nil, err
+		}
+		if v != nil {
+			var ok bool
+			if generic, ok = stringKeys(v).(map[string]interface{}); !ok {
+				return nil, errors.New("the config isn't a YAML mapping")
+			}
+		}
+	default:
+		return nil, errors.New("Unknown config format: " + format)
+	}
+
+	return generic, nil
+}
+
+//Encode generic, as from decodeGeneric, in the given format
+func encodeGeneric(generic map[string]interface{}, format string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	switch format {
+	case FORMAT_JSON:
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(generic)
+		return buf.Bytes(), err
+	case FORMAT_TOML:
+		err := toml.NewEncoder(buf).Encode(generic)
+		return buf.Bytes(), err
+	case FORMAT_YAML:
+		enc := yaml.NewEncoder(buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(generic); err != nil {
+			return nil, err
+		}
+		err := enc.Close()
+		return buf.Bytes(), err
+	}
+
+	return nil, errors.New("Unknown config format: " + format)
+}
+
+//YAML mappings with keys other than strings decode as
+//map[interface{}]interface{}, which encoding/json refuses to marshal.
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprint(key)] = stringKeys(val)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = stringKeys(v[i])
+		}
+	}
+	return v
+}
+
+//Turn json.Numbers back into ints or floats and drop nulls, neither of
+//which the TOML and YAML encoders handle the way we'd like.
+func plainValues(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, val := range v {
+			if val == nil {
+				delete(v, key)
+			} else {
+				v[key] = plainValues(val)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = plainValues(v[i])
+		}
+	}
+	return v
+}
+
+//Blank out // and /* */ comments that aren't inside strings.  Everything
+//else, newlines included, stays where it was, so json error offsets and
+//offsets used to edit the file in place still point at the right place.
+func stripJSONComments(raw []byte) []byte {
+	out := make([]byte, len(raw))
+	copy(out, raw)
+	inString, escaped := false, false
+
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+
+		if inString {
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+
+		switch {
+		case c == '"':
+			inString = true
+		case c == '/' && i+1 < len(raw) && raw[i+1] == '/':
+			for ; i < len(raw) && raw[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case c == '/' && i+1 < len(raw) && raw[i+1] == '*':
+			out[i], out[i+1] = ' ', ' '
+			for i += 2; i < len(raw) && !(raw[i] == '*' && i+1 < len(raw) && raw[i+1] == '/'); i++ {
+				if raw[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+			for j := i; j < i+2 && j < len(raw); j++ {
+				out[j] = ' '
+			}
+			i++ //Skip the closing '/'
+		}
+	}
+
+	return out
+}
+
+//Write the config file confFile out again in the given format, next to
+//the original.  Only what the file sets is carried over; comments can't be.
+//Returns the name of the new file.
+func convertConfig(confFile, format string) (string, error) {
+	raw, err := ioutil.ReadFile(confFile)
+	if err != nil {
+		return "", err
+	}
+
+	conf := &Config{}
+	from := detectFormat(confFile, raw)
+	if err = decodeConfig(raw, from, conf); err != nil {
+		return "", err
+	}
+	if err = sanityCheck(conf); err != nil {
+		return "", err
+	}
+
+	switch format {
+	case FORMAT_JSON, FORMAT_TOML, FORMAT_YAML:
+	default:
+		return "", errors.New("Unknown config format: " + format)
+	}
+
+	target := strings.TrimSuffix(confFile, filepath.Ext(confFile)) + "." + format
+	if target == confFile {
+		return "", errors.New(confFile + " is already " + format)
+	}
+
+	if _, err = os.Stat(target); err == nil {
+		return "", errors.New(target + " already exists, not overwriting it")
+	}
+
+	generic, err := decodeGeneric(raw, from)
+	if err != nil {
+		return "", err
+	}
+	converted, err := encodeGeneric(generic, format)
+	if err != nil {
+		return "", err
+	}
+	return target, writeAtomic(target, converted, 0600)
+}
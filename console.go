@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Mirrors the server console to the rooms with the console role.  A busy
+//server can print far more than a chat network will take, so each room gets
+//at most ConsoleMaxLines lines every ConsoleWindow seconds and is told how
+//many it missed at the end of the window.  While a room's transport is
+//offline its latest ConsoleMaxLines lines are held apart from the chat
+//backlog, so a chatty console can't push chat out of it.
+
+type consoleRoom struct {
+	transport  chatTransport
+	room       string
+	sent       int
+	suppressed int
+}
+
+//Console lines held for a room while its transport is offline
+type consoleHeld struct {
+	lines   []string
+	dropped int
+}
+
+var (
+	consoleRooms     map[string]*consoleRoom = make(map[string]*consoleRoom)
+	consoleHolds     map[string]*consoleHeld = make(map[string]*consoleHeld)
+	consoleRoomsLock sync.Mutex
+)
+
+func consoleWindows() {
+	for {
+		time.Sleep(time.Duration(currentConfig().ConsoleWindow) * time.Second)
+		endConsoleWindow()
+	}
+}
+
+//Send a line of m's console output to each of its console rooms whose
+//filters it passes and which hasn't used up its allowance for this window
+func (m *minecraft) mirrorConsole(line string) {
+	max := currentConfig().ConsoleMaxLines
+
+	for _, t := range transports {
+		for _, room := range m.rooms(t, ROLE_CONSOLE) {
+			if c := roomConfig(t, room); c != nil && !c.shows(line) {
+				continue
+			}
+
+			key := t.Name() + " " + room
+			if !t.Online() {
+				holdConsole(key, line, max)
+				continue
+			}
+
+			consoleRoomsLock.Lock()
+			r, ok := consoleRooms[key]
+			if !ok {
+				r = &consoleRoom{transport: t, room: room}
+				consoleRooms[key] = r
+			}
+			send := r.sent < max
+			if send {
+				r.sent++
+			} else {
+				r.suppressed++
+			}
+			consoleRoomsLock.Unlock()
+
+			if send {
+				deliver(t, room, "", line)
+			}
+		}
+	}
+}
+
+//Keep line for the room known by key until its transport is back, along
+//with at most max-1 others
+func holdConsole(key, line string, max int) {
+	consoleRoomsLock.Lock()
+	defer consoleRoomsLock.Unlock()
+
+	h, ok := consoleHolds[key]
+	if !ok {
+		h = &consoleHeld{}
+		consoleHolds[key] = h
+	}
+	h.lines = append(h.lines, line)
+	if len(h.lines) > max {
+		h.dropped += len(h.lines) - max
+		h.lines = h.lines[len(h.lines)-max:]
+	}
+}
+
+//Send t's console rooms what was held for them while it was offline
+func flushConsole(t chatTransport) {
+	prefix := t.Name() + " "
+	consoleRoomsLock.Lock()
+	holds := make(map[string]*consoleHeld)
+	for key, h := range consoleHolds {
+		if strings.HasPrefix(key, prefix) {
+			holds[strings.TrimPrefix(key, prefix)] = h
+			delete(consoleHolds, key)
+		}
+	}
+	consoleRoomsLock.Unlock()
+
+	for room, h := range holds {
+		if h.dropped > 0 {
+			t.Send(room, fmt.Sprintf("[%d console lines missed while disconnected from %s]", h.dropped, t.Name()))
+		}
+		for _, line := range h.lines {
+			t.Send(room, toChat(t, line))
+		}
+	}
+}
+
+//Report what each room missed and give it a fresh allowance
+func endConsoleWindow() {
+	consoleRoomsLock.Lock()
+	var summaries []*consoleRoom
+	for key, r := range consoleRooms {
+		if r.suppressed > 0 {
+			summary := *r
+			summaries = append(summaries, &summary)
+		}
+		delete(consoleRooms, key)
+	}
+	consoleRoomsLock.Unlock()
+
+	for _, r := range summaries {
+		deliver(r.transport, r.room, "", fmt.Sprintf("[%d more console lines not shown]", r.suppressed))
+	}
+}
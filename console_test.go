@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+//A transport that records what it's sent, and can be taken offline
+type fakeTransport struct {
+	lock    sync.Mutex
+	offline bool
+	sent    []string
+}
+
+func (t *fakeTransport) Name() string                   { return "fake" }
+func (t *fakeTransport) Connect(conf *Config) error     { return nil }
+func (t *fakeTransport) Rooms(role string) []string     { return []string{"#" + role} }
+func (t *fakeTransport) Accepts(room, role string) bool { return room == "#"+role }
+
+func (t *fakeTransport) Send(room, text string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sent = append(t.sent, room+" "+text)
+}
+
+func (t *fakeTransport) Online() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return !t.offline
+}
+
+//What's been sent since the last call
+func (t *fakeTransport) take() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	sent := t.sent
+	t.sent = nil
+	return sent
+}
+
+func TestConsoleMirrorOffline(t *testing.T) {
+	fake := &fakeTransport{offline: true}
+	defer func(s []*minecraft, ts []chatTransport) { servers, transports = s, ts }(servers, transports)
+	m := &minecraft{name: "survival"}
+	servers = []*minecraft{m}
+	transports = []chatTransport{fake}
+
+	withTestConfig(t, &Config{ConsoleMaxLines: 3})
+
+	for i := 1; i <= 5; i++ {
+		m.mirrorConsole(fmt.Sprintf("line %d", i))
+	}
+
+	//None of it crowds the chat backlog
+	b := backlogFor(fake)
+	b.lock.Lock()
+	held := len(b.lines)
+	b.lock.Unlock()
+	if held != 0 {
+		t.Errorf("%d console lines in the chat backlog", held)
+	}
+
+	fake.lock.Lock()
+	fake.offline = false
+	fake.lock.Unlock()
+	flushBacklog(fake)
+	want := []string{
+		"#console [2 console lines missed while disconnected from fake]",
+		"#console line 3", "#console line 4", "#console line 5",
+	}
+	if got := fake.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	//Back online, the window's allowance applies again
+	for i := 1; i <= 4; i++ {
+		m.mirrorConsole(fmt.Sprintf("line %d", i))
+	}
+	endConsoleWindow()
+	want = []string{"#console line 1", "#console line 2", "#console line 3", "#console [1 more console lines not shown]"}
+	if got := fake.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Spots deaths and advancements in the server log, relays them and keeps
+//count of how often each player has died.
+
+//How vanilla death messages continue after the player's name, from Beta
+//through to current releases.  Messages naming a killer or weapon only need
+//the part before it.
+var deathMessages = []string{
+	"was slain by", "was shot by", "was fireballed by", "was pummeled by", "was killed",
+	"was blown up by", "blew up", "was struck by lightning", "was burnt to a crisp",
+	"burned to death", "went up in flames", "walked into fire", "walked into a cactus",
+	"was pricked to death", "drowned", "suffocated in a wall", "was squished too much",
+	"was squashed by", "was squished", "experienced kinetic energy", "fell from a high place",
+	"fell off a ladder", "fell off some vines", "fell off some weeping vines",
+	"fell off some twisting vines", "fell off scaffolding", "fell while climbing",
+	"fell out of the world", "fell out of the water", "fell into a patch of", "fell too far",
+	"was doomed to fall", "was knocked into the void", "didn't want to live in the same world as",
+	"hit the ground too hard", "tried to swim in lava", "was impaled", "starved to death",
+	"was poked to death", "withered away", "was stung to death", "was frozen to death",
+	"froze to death", "was skewered by", "discovered the floor was lava",
+	"walked into danger zone due to", "walked into the danger zone due to", "was obliterated by",
+	"was roasted in dragon breath", "was speared by", "was stomped by", "went off with a bang",
+	"left the confines of this world", "died",
+}
+
+var (
+	deathRegex *regexp.Regexp = regexp.MustCompile(`INFO\]:? (([a-zA-Z0-9_]+) (?:` +
+		quoteAll(deathMessages) + `)\b.*)$`)
+
+	//1.12 on, then the achievements of 1.7 to 1.11 and before
+	advancementRegex *regexp.Regexp = regexp.MustCompile(`INFO\]:? (([a-zA-Z0-9_]+) ` +
+		`(?:has made the advancement|has completed the challenge|has reached the goal|` +
+		`has just earned the achievement|earned the achievement) \[.+\])$`)
+)
+
+func quoteAll(phrases []string) string {
+	var quoted []string
+	for _, p := range phrases {
+		quoted = append(quoted, regexp.QuoteMeta(p))
+	}
+	return strings.Join(quoted, "|")
+}
+
+//A player's death record
+type deathCount struct {
+	Name        string
+	Count       int
+	Last        time.Time
+	LastMessage string
+}
+
+const deathsFile = "deaths.json"
+
+var (
+	deaths     map[string]*deathCount //By lowercased name, loaded on first use
+	deathsLock sync.Mutex
+)
+
+//Relay any death or advancement in line, and count deaths
+func (m *minecraft) trackMilestones(line string) {
+	event, player, message := milestone(line)
+	if event == EVENT_DEATH {
+		countDeath(player, message)
+	}
+	if event != "" {
+		m.relayEvent(event, player, message)
+	}
+}
+
+//The death or advancement reported by a line of server output, if any
+func milestone(line string) (event, player, message string) {
+	if match := deathRegex.FindStringSubmatch(line); match != nil {
+		return EVENT_DEATH, match[2], match[1]
+	} else if match := advancementRegex.FindStringSubmatch(line); match != nil {
+		return EVENT_ADVANCEMENT, match[2], match[1]
+	}
+	return "", "", ""
+}
+
+func countDeath(player, message string) {
+	deathsLock.Lock()
+	defer deathsLock.Unlock()
+
+	loadDeaths()
+	d, ok := deaths[strings.ToLower(player)]
+	if !ok {
+		d = &deathCount{Name: player}
+		deaths[strings.ToLower(player)] = d
+	}
+	d.Count++
+	d.Last = time.Now()
+	d.LastMessage = message
+
+	if err := saveData(deathsFile, deaths); err != nil {
+		logErr.Printf("Couldn't save %s: %s\n", deathsFile, err)
+	}
+}
+
+//Must be called with deathsLock held
+func loadDeaths() {
+	if deaths != nil {
+		return
+	}
+
+	deaths = make(map[string]*deathCount)
+	if err := loadData(deathsFile, &deaths); err != nil {
+		logErr.Printf("Couldn't read %s: %s\n", deathsFile, err)
+	}
+}
+
+//player's record, if they've ever died
+func deathsOf(player string) (deathCount, bool) {
+	deathsLock.Lock()
+	defer deathsLock.Unlock()
+
+	loadDeaths()
+	if d, ok := deaths[strings.ToLower(player)]; ok {
+		return *d, true
+	}
+	return deathCount{}, false
+}
+
+//The n players who have died most, most first
+func mostDeaths(n int) []deathCount {
+	deathsLock.Lock()
+	defer deathsLock.Unlock()
+
+	loadDeaths()
+	var all []deathCount
+	for _, d := range deaths {
+		all = append(all, *d)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Count != all[j].Count {
+			return all[i].Count > all[j].Count
+		}
+		return all[i].Name < all[j].Name
+	})
+
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
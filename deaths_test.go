@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMilestones(t *testing.T) {
+	for _, test := range []struct {
+		line                   string
+		event, player, message string
+	}{
+		//Beta to 1.6
+		{"2011-09-14 20:11:02 [INFO] Notch died", EVENT_DEATH, "Notch", "Notch died"},
+		{"2012-11-02 18:40:17 [INFO] Steve was slain by Zombie", EVENT_DEATH, "Steve", "Steve was slain by Zombie"},
+		{"2013-07-01 12:00:00 [INFO] Steve_01 fell from a high place", EVENT_DEATH, "Steve_01", "Steve_01 fell from a high place"},
+		{"2013-07-01 12:00:00 [INFO] Steve was shot by Skeleton", EVENT_DEATH, "Steve", "Steve was shot by Skeleton"},
+
+		//1.7 on
+		{"[12:00:00] [Server thread/INFO]: Steve was blown up by Creeper", EVENT_DEATH, "Steve", "Steve was blown up by Creeper"},
+		{"[12:00:00] [Server thread/INFO]: Steve has just earned the achievement [Taking Inventory]",
+			EVENT_ADVANCEMENT, "Steve", "Steve has just earned the achievement [Taking Inventory]"},
+
+		//Modern releases and Paper's log format
+		{"[12:00:00] [Server thread/INFO]: Steve drowned whilst trying to escape Zombie", EVENT_DEATH, "Steve", "Steve drowned whilst trying to escape Zombie"},
+		{"[12:00:00] [Server thread/INFO]: Steve was slain by Alex using [Excalibur]", EVENT_DEATH, "Steve", "Steve was slain by Alex using [Excalibur]"},
+		{"[12:00:00] [Server thread/INFO]: Steve experienced kinetic energy", EVENT_DEATH, "Steve", "Steve experienced kinetic energy"},
+		{"[12:00:00] [Server thread/INFO]: Steve discovered the floor was lava", EVENT_DEATH, "Steve", "Steve discovered the floor was lava"},
+		{"[12:00:00 INFO]: Steve fell out of the world", EVENT_DEATH, "Steve", "Steve fell out of the world"},
+		{"[12:00:00] [Server thread/INFO]: Steve has made the advancement [Stone Age]",
+			EVENT_ADVANCEMENT, "Steve", "Steve has made the advancement [Stone Age]"},
+		{"[12:00:00] [Server thread/INFO]: Steve has completed the challenge [Return to Sender]",
+			EVENT_ADVANCEMENT, "Steve", "Steve has completed the challenge [Return to Sender]"},
+		{"[12:00:00 INFO]: Steve has reached the goal [Sky's the Limit]",
+			EVENT_ADVANCEMENT, "Steve", "Steve has reached the goal [Sky's the Limit]"},
+
+		//Other server lines
+		{"[12:00:00] [Server thread/INFO]: Steve joined the game", "", "", ""},
+		{"[12:00:00] [Server thread/INFO]: Steve lost connection: Disconnected", "", "", ""},
+		{"[12:00:00] [Server thread/INFO]: Steve[/127.0.0.1:50000] logged in with entity id 1 at (0.5, 64.0, 0.5)", "", "", ""},
+		{"[12:00:00] [Server thread/INFO]: Villager EntityVillager['Villager'/52, l='ServerLevel[world]', x=1.5, y=64.0, z=2.5] died, message: 'Villager was slain by Zombie'", "", "", ""},
+		{"[12:00:00] [Server thread/INFO]: Named entity Wolf['Rex'/12, l='ServerLevel[world]', x=1.5, y=64.0, z=2.5] died: Rex was slain by Zombie", "", "", ""},
+		{"[12:00:00] [Server thread/INFO]: Steve issued server command: /kill", "", "", ""},
+		{"[12:00:00] [Server thread/INFO]: Steve diedtwice", "", "", ""},
+		{"[12:00:00] [Server thread/INFO]: Steve has made the advancement", "", "", ""},
+
+		//Chat which looks like the server
+		{"2012-11-02 18:40:17 [INFO] <Alex> Steve fell out of the world", "", "", ""},
+		{"[12:00:00] [Server thread/INFO]: <Alex> Steve was slain by Zombie", "", "", ""},
+		{"[12:00:00] [Server thread/INFO]: [Not Secure] <Alex> Steve drowned", "", "", ""},
+		{"[12:00:00] [Server thread/INFO]: <Alex> INFO]: Steve died", "", "", ""},
+		{"[12:00:00] [Server thread/INFO]: * Alex died laughing", "", "", ""},
+		{"[12:00:00] [Server thread/INFO]: [Server] Steve has made the advancement [Cheater]", "", "", ""},
+		{"[12:00:00 INFO]: [Rcon] Steve died", "", "", ""},
+	} {
+		//As teeOutput does, only lines nobody said count
+		var event, player, message string
+		if !saidRegex.MatchString(test.line) {
+			event, player, message = milestone(test.line)
+		}
+		if event != test.event || player != test.player || message != test.message {
+			t.Errorf("%s:\ngot %q %q %q, want %q %q %q", test.line, event, player, message,
+				test.event, test.player, test.message)
+		}
+	}
+}
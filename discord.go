@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Bridges the server to a Discord channel.  Incoming chat and slash commands
+//arrive over the gateway websocket; chat goes out through a webhook, so each
+//player shows up under their own name and skin, and command replies go out
+//through the REST API.
+
+const (
+	discordIntents = 1<<0 | 1<<9 | 1<<15 //GUILDS, GUILD_MESSAGES, MESSAGE_CONTENT
+
+	discordDefaultAPI     = "https://discord.com/api/v10"
+	discordDefaultGateway = "wss://gateway.discord.gg/?v=10&encoding=json"
+	discordDefaultAvatar  = "https://minotar.net/helm/%s/64"
+	discordMaxBackoff     = 5 * time.Minute
+
+	//Replies to slash commands are sent to this pseudo-room plus the
+	//interaction token
+	discordInteractionRoom = "interaction:"
+)
+
+type discordConfig struct {
+	Token     string //Bot token
+	GuildID   string //Guild to register slash commands in, global if empty
+	ChannelID string //Channel to relay
+	Server    string //Server the channel is bridged to, if not the first
+
+	//Webhook in ChannelID that relayed chat is posted through.  Without one
+	//chat is posted by the bot itself.
+	WebhookURL string
+
+	//Player avatar URL, %s is replaced with the player's name
+	AvatarURL string
+
+	//Only needed to point the bot at something other than Discord
+	APIURL     string
+	GatewayURL string
+}
+
+var discordChat *discordTransport = &discordTransport{}
+
+type discordTransport struct {
+	conf   discordConfig
+	client *http.Client
+
+	lock     sync.Mutex
+	conn     *websocket.Conn
+	online   bool
+	seq      *int64
+	appID    string
+	answered map[string]bool //Interaction tokens whose original response has been filled in
+}
+
+type discordPayload struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d,omitempty"`
+	S  *int64          `json:"s,omitempty"`
+	T  string          `json:"t,omitempty"`
+}
+
+type discordMember struct {
+	Nick  string       `json:"nick"`
+	Roles []string     `json:"roles"`
+	User  *discordUser `json:"user"`
+}
+
+type discordUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Bot      bool   `json:"bot"`
+}
+
+func (t *discordTransport) Name() string {
+	return "discord"
+}
+
+func (t *discordTransport) Connect(conf *Config) error {
+	t.conf = conf.Discord
+	if t.conf.APIURL == "" {
+		t.conf.APIURL = discordDefaultAPI
+	}
+	if t.conf.GatewayURL == "" {
+		t.conf.GatewayURL = discordDefaultGateway
+	}
+	if t.conf.AvatarURL == "" {
+		t.conf.AvatarURL = discordDefaultAvatar
+	}
+	t.client = &http.Client{Timeout: 30 * time.Second}
+	t.answered = make(map[string]bool)
+
+	go t.gatewayLoop()
+	return nil
+}
+
+func (t *discordTransport) Send(room, text string) {
+	if strings.HasPrefix(room, discordInteractionRoom) {
+		t.replyToInteraction(strings.TrimPrefix(room, discordInteractionRoom), text)
+		return
+	}
+
+	body := map[string]interface{}{
+		"content":          text,
+		"allowed_mentions": map[string][]string{"parse": {}},
+	}
+	if err := t.call("POST", "/channels/"+room+"/messages", body, nil); err != nil {
+		logErr.Printf("Discord send failed: %s\n", err)
+	}
+}
+
+func (t *discordTransport) SendAs(player, msg string, action bool) {
+	if t.conf.WebhookURL == "" {
+		text := fmt.Sprintf("<%s> %s", player, msg)
+		if action {
+			text = fmt.Sprintf("* %s %s", player, msg)
+		}
+		t.Send(t.conf.ChannelID, text)
+		return
+	}
+
+	if action {
+		msg = "_" + msg + "_"
+	}
+
+	body := map[string]interface{}{
+		"content":          msg,
+		"username":         player,
+		"avatar_url":       fmt.Sprintf(t.conf.AvatarURL, player),
+		"allowed_mentions": map[string][]string{"parse": {}},
+	}
+	if err := t.request("POST", t.conf.WebhookURL, body, nil); err != nil {
+		logErr.Printf("Discord webhook failed: %s\n", err)
+	}
+}
+
+func (t *discordTransport) Rooms(role string) []string {
+	if role == ROLE_CONSOLE {
+		return nil
+	}
+	return []string{t.conf.ChannelID}
+}
+
+func (t *discordTransport) Accepts(room, role string) bool {
+	return room == t.conf.ChannelID || strings.HasPrefix(room, discordInteractionRoom)
+}
+
+func (t *discordTransport) RoomServer(room string) string {
+	return t.conf.Server
+}
+
+func (t *discordTransport) Online() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.online
+}
+
+func (t *discordTransport) gatewayLoop() {
+	backoff := time.Second
+
+	for {
+		start := time.Now()
+		err := t.runGateway()
+
+		t.lock.Lock()
+		t.online = false
+		t.conn = nil
+		t.lock.Unlock()
+
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		logErr.Printf("Discord gateway: %s, reconnecting in %v\n", err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > discordMaxBackoff {
+			backoff = discordMaxBackoff
+		}
+	}
+}
+
+//Connect to the gateway and handle events until the connection fails
+func (t *discordTransport) runGateway() error {
+	conn, _, err := websocket.DefaultDialer.Dial(t.conf.GatewayURL, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var hello struct {
+		HeartbeatInterval int64 `json:"heartbeat_interval"`
+	}
+	var payload discordPayload
+	if err = conn.ReadJSON(&payload); err != nil {
+		return err
+	}
+	if err = json.Unmarshal(payload.D, &hello); err != nil || payload.Op != 10 {
+		return fmt.Errorf("expected hello, got op %d", payload.Op)
+	}
+
+	t.lock.Lock()
+	t.conn = conn
+	t.seq = nil
+	t.lock.Unlock()
+
+	stop := make(chan bool)
+	defer close(stop)
+	go t.heartbeat(time.Duration(hello.HeartbeatInterval)*time.Millisecond, stop)
+
+	err = t.write(2, map[string]interface{}{
+		"token":   t.conf.Token,
+		"intents": discordIntents,
+		"properties": map[string]string{
+			"os":      "linux",
+			"browser": "mc-bot",
+			"device":  "mc-bot",
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		payload = discordPayload{}
+		conn.SetReadDeadline(time.Now().Add(time.Duration(hello.HeartbeatInterval)*time.Millisecond + time.Minute))
+		if err = conn.ReadJSON(&payload); err != nil {
+			return err
+		}
+
+		if payload.S != nil {
+			t.lock.Lock()
+			t.seq = payload.S
+			t.lock.Unlock()
+		}
+
+		switch payload.Op {
+		case 0: //Dispatch
+			t.dispatch(payload.T, payload.D)
+		case 1: //Heartbeat request
+			t.sendHeartbeat()
+		case 7: //Reconnect
+			return fmt.Errorf("asked to reconnect")
+		case 9: //Invalid session
+			return fmt.Errorf("session invalidated")
+		}
+	}
+}
+
+func (t *discordTransport) heartbeat(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.sendHeartbeat()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (t *discordTransport) sendHeartbeat() {
+	t.lock.Lock()
+	seq := t.seq
+	t.lock.Unlock()
+
+	t.write(1, seq)
+}
+
+func (t *discordTransport) write(op int, d interface{}) error {
+	raw, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+	return t.conn.WriteJSON(discordPayload{Op: op, D: raw})
+}
+
+func (t *discordTransport) dispatch(event string, raw json.RawMessage) {
+	switch event {
+	case "READY":
+		var ready struct {
+			User        discordUser `json:"user"`
+			Application struct {
+				ID string `json:"id"`
+			} `json:"application"`
+		}
+		if err := json.Unmarshal(raw, &ready); err != nil {
+			logErr.Printf("Discord: bad READY: %s\n", err)
+			return
+		}
+
+		t.lock.Lock()
+		t.appID = ready.Application.ID
+		t.online = true
+		t.lock.Unlock()
+
+		logInfo.Printf("Connected to Discord as %s\n", ready.User.Username)
+		go t.registerCommands()
+		go flushBacklog(t)
+
+	case "MESSAGE_CREATE":
+		var msg struct {
+			ChannelID string         `json:"channel_id"`
+			WebhookID string         `json:"webhook_id"`
+			Content   string         `json:"content"`
+			Author    discordUser    `json:"author"`
+			Member    *discordMember `json:"member"`
+		}
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			return
+		}
+
+		//Skip bots, which includes ourselves and our own webhook posts
+		if msg.Author.Bot || msg.WebhookID != "" || msg.ChannelID != t.conf.ChannelID {
+			return
+		}
+
+		m := &chatMessage{
+			transport: t,
+			room:      msg.ChannelID,
+			sender:    msg.Author.Username,
+			account:   msg.Author.ID,
+			text:      msg.Content,
+		}
+		if msg.Member != nil {
+			if msg.Member.Nick != "" {
+				m.sender = msg.Member.Nick
+			}
+			m.groups = discordRoles(msg.Member.Roles)
+		}
+
+		attn := currentConfig().AttnChar
+		if strings.HasPrefix(m.text, attn) {
+			m.directed = true
+			m.text = strings.TrimPrefix(m.text, attn)
+		}
+
+		handleChat(m)
+
+	case "INTERACTION_CREATE":
+		var interaction struct {
+			ID     string         `json:"id"`
+			Token  string         `json:"token"`
+			Type   int            `json:"type"`
+			Member *discordMember `json:"member"`
+			User   *discordUser   `json:"user"` //Set instead of Member in DMs
+			Data   struct {
+				Name    string `json:"name"`
+				Options []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"options"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(raw, &interaction); err != nil || interaction.Type != 2 {
+			return
+		}
+
+		//Acknowledge now, commands can take longer than the 3 seconds
+		//Discord allows for a response
+		err := t.call("POST", fmt.Sprintf("/interactions/%s/%s/callback", interaction.ID, interaction.Token),
+			map[string]int{"type": 5}, nil)
+		if err != nil {
+			logErr.Printf("Discord: couldn't acknowledge /%s: %s\n", interaction.Data.Name, err)
+			return
+		}
+
+		m := &chatMessage{
+			transport: t,
+			room:      discordInteractionRoom + interaction.Token,
+			text:      interaction.Data.Name,
+			directed:  true,
+		}
+		user := interaction.User
+		if interaction.Member != nil {
+			user = interaction.Member.User
+			m.groups = discordRoles(interaction.Member.Roles)
+		}
+		if user != nil {
+			m.sender, m.account = user.Username, user.ID
+		}
+		for _, opt := range interaction.Data.Options {
+			if opt.Name == "server" && opt.Value != "" {
+				m.text = "@" + opt.Value + " " + m.text
+			} else if opt.Value != "" {
+				m.text += " " + opt.Value
+			}
+		}
+
+		handleChat(m)
+	}
+}
+
+func discordRoles(roles []string) []string {
+	var groups []string
+	for _, role := range roles {
+		groups = append(groups, "discord-role:"+role)
+	}
+	return groups
+}
+
+//Register a slash command for each bot command, each taking its arguments
+//as a single string, and which server to run it on if there's a choice
+func (t *discordTransport) registerCommands() {
+	var names []string
+	for name := range commandHelpMap {
+		if name != "?" { //Not a legal slash command name
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var choices []map[string]string
+	for _, m := range servers {
+		choices = append(choices, map[string]string{"name": m.name, "value": m.name})
+	}
+
+	var defs []map[string]interface{}
+	for _, name := range names {
+		desc := commandHelpMap[name]
+		if len(desc) > 100 {
+			desc = desc[:97] + "..."
+		}
+		options := []map[string]interface{}{{
+			"type":        3, //STRING
+			"name":        "args",
+			"description": "Arguments, as you'd type them after " + currentConfig().AttnChar + name,
+			"required":    false,
+		}}
+		if len(choices) > 1 {
+			options = append(options, map[string]interface{}{
+				"type":        3,
+				"name":        "server",
+				"description": "Server to run it on, if not this channel's",
+				"required":    false,
+				"choices":     choices,
+			})
+		}
+		defs = append(defs, map[string]interface{}{
+			"name":        name,
+			"description": desc,
+			"options":     options,
+		})
+	}
+
+	t.lock.Lock()
+	path := "/applications/" + t.appID + "/commands"
+	if t.conf.GuildID != "" {
+		path = "/applications/" + t.appID + "/guilds/" + t.conf.GuildID + "/commands"
+	}
+	t.lock.Unlock()
+
+	if err := t.call("PUT", path, defs, nil); err != nil {
+		logErr.Printf("Discord: couldn't register slash commands: %s\n", err)
+	}
+}
+
+//The first line of a reply fills in the deferred response, the rest are
+//followups
+func (t *discordTransport) replyToInteraction(token, text string) {
+	t.lock.Lock()
+	first := !t.answered[token]
+	t.answered[token] = true
+	appID := t.appID
+	t.lock.Unlock()
+
+	body := map[string]interface{}{
+		"content":          text,
+		"allowed_mentions": map[string][]string{"parse": {}},
+	}
+
+	var err error
+	if first {
+		err = t.call("PATCH", "/webhooks/"+appID+"/"+token+"/messages/@original", body, nil)
+
+		//Tokens are good for 15 minutes, forget about this one after that
+		time.AfterFunc(15*time.Minute, func() {
+			t.lock.Lock()
+			delete(t.answered, token)
+			t.lock.Unlock()
+		})
+	} else {
+		err = t.call("POST", "/webhooks/"+appID+"/"+token, body, nil)
+	}
+
+	if err != nil {
+		logErr.Printf("Discord: couldn't reply to interaction: %s\n", err)
+	}
+}
+
+//Make a REST API request with the bot's credentials
+func (t *discordTransport) call(method, path string, body, result interface{}) error {
+	return t.request(method, t.conf.APIURL+path, body, result)
+}
+
+//Make a JSON request, waiting out a rate limit once if need be.  body and
+//result are JSON encoded and decoded, either may be nil.
+func (t *discordTransport) request(method, url string, body, result interface{}) error {
+	var raw []byte
+	if body != nil {
+		var err error
+		if raw, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		var reqBody io.Reader
+		if raw != nil {
+			reqBody = bytes.NewReader(raw)
+		}
+
+		req, err := http.NewRequest(method, url, reqBody)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(url, t.conf.APIURL) {
+			req.Header.Set("Authorization", "Bot "+t.conf.Token)
+		}
+		if raw != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := t.client.Do(req)
+		if err != nil {
+			return err
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt == 0 {
+			var limit struct {
+				RetryAfter float64 `json:"retry_after"`
+			}
+			json.Unmarshal(respBody, &limit)
+			time.Sleep(time.Duration(limit.RetryAfter * float64(time.Second)))
+			continue
+		}
+
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("%s: %s %s", method, resp.Status, respBody)
+		}
+
+		if result != nil && len(respBody) > 0 {
+			return json.Unmarshal(respBody, result)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//A request the fake Discord saw
+type discordRequest struct {
+	method string
+	path   string
+	auth   string
+	body   json.RawMessage
+}
+
+//Discord's REST API, a webhook that's rate limited once, and a gateway
+//that sends whatever events the test gives it
+type fakeDiscord struct {
+	t        *testing.T
+	requests chan discordRequest
+	events   chan string
+	pending  []discordRequest
+
+	lock    sync.Mutex
+	limited bool
+}
+
+func (d *fakeDiscord) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/gateway" {
+		d.gateway(w, r)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+
+	if r.URL.Path == "/hook" {
+		d.lock.Lock()
+		limited := d.limited
+		d.limited = true
+		d.lock.Unlock()
+		if !limited {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"message":"You are being rate limited.","retry_after":0.05}`))
+			d.requests <- discordRequest{"429", r.URL.Path, "", nil}
+			return
+		}
+	}
+
+	d.requests <- discordRequest{r.Method, r.URL.Path, r.Header.Get("Authorization"), body}
+	if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/api/interactions/") {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Write([]byte(`{}`))
+}
+
+func (d *fakeDiscord) gateway(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		d.t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	conn.WriteJSON(map[string]interface{}{"op": 10, "d": map[string]int{"heartbeat_interval": 45000}})
+
+	var identify struct {
+		Op int `json:"op"`
+		D  struct {
+			Token string `json:"token"`
+		} `json:"d"`
+	}
+	if err := conn.ReadJSON(&identify); err != nil || identify.Op != 2 || identify.D.Token != "bottoken" {
+		d.t.Errorf("identified with %+v, %v", identify, err)
+		return
+	}
+
+	seq := 0
+	for event := range d.events {
+		seq++
+		split := strings.SplitN(event, " ", 2)
+		conn.WriteJSON(map[string]interface{}{"op": 0, "s": seq, "t": split[0], "d": json.RawMessage(split[1])})
+	}
+}
+
+//The next request for method and path, setting aside any others that come
+//first
+func (d *fakeDiscord) wait(t *testing.T, method, path string) discordRequest {
+	t.Helper()
+	for i, r := range d.pending {
+		if r.method == method && r.path == path {
+			d.pending = append(d.pending[:i], d.pending[i+1:]...)
+			return r
+		}
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case r := <-d.requests:
+			if r.method == method && r.path == path {
+				return r
+			}
+			d.pending = append(d.pending, r)
+		case <-timeout:
+			t.Fatalf("no %s %s, got %v", method, path, d.pending)
+		}
+	}
+}
+
+func (d *fakeDiscord) decode(t *testing.T, r discordRequest, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(r.body, v); err != nil {
+		t.Fatalf("%s %s: %s", r.method, r.path, err)
+	}
+}
+
+func nextCommand(t *testing.T) *command {
+	t.Helper()
+	select {
+	case cmd := <-commands:
+		return cmd
+	case <-time.After(5 * time.Second):
+		t.Fatal("no command")
+		return nil
+	}
+}
+
+func TestDiscord(t *testing.T) {
+	d := &fakeDiscord{t: t, requests: make(chan discordRequest, 16), events: make(chan string, 8)}
+	srv := httptest.NewServer(d)
+	defer srv.Close()
+	defer close(d.events)
+
+	defer func(s []*minecraft) { servers = s }(servers)
+	servers = []*minecraft{{name: "survival"}, {name: "creative"}}
+
+	conf := &Config{AttnChar: "!", Discord: discordConfig{
+		Token:      "bottoken",
+		GuildID:    "g1",
+		ChannelID:  "c1",
+		Server:     "creative",
+		WebhookURL: srv.URL + "/hook",
+		APIURL:     srv.URL + "/api",
+		GatewayURL: "ws" + strings.TrimPrefix(srv.URL, "http") + "/gateway",
+	}}
+	withTestConfig(t, conf)
+
+	dc := &discordTransport{}
+	if err := dc.Connect(conf); err != nil {
+		t.Fatal(err)
+	}
+	d.events <- `READY {"user":{"id":"b1","username":"mcbot","bot":true},"application":{"id":"app1"}}`
+
+	//A slash command for every bot command, from its help
+	reg := d.wait(t, "PUT", "/api/applications/app1/guilds/g1/commands")
+	if reg.auth != "Bot bottoken" {
+		t.Errorf("registered with %q", reg.auth)
+	}
+	var defs []struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Options     []struct {
+			Name    string              `json:"name"`
+			Choices []map[string]string `json:"choices"`
+		} `json:"options"`
+	}
+	d.decode(t, reg, &defs)
+	var want, got []string
+	for name := range commandHelpMap {
+		if name != "?" {
+			want = append(want, name)
+		}
+	}
+	sort.Strings(want)
+	for _, def := range defs {
+		got = append(got, def.Name)
+		if help := commandHelpMap[def.Name]; def.Description != help && (len(help) <= 100 || len(def.Description) != 100) {
+			t.Errorf("/%s described as %q", def.Name, def.Description)
+		}
+		if len(def.Options) != 2 || def.Options[1].Name != "server" || len(def.Options[1].Choices) != 2 {
+			t.Errorf("/%s has options %+v", def.Name, def.Options)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("registered %v, want %v", got, want)
+	}
+
+	//Chat in the channel, skipping bots and webhooks
+	d.events <- `MESSAGE_CREATE {"channel_id":"c1","webhook_id":"w1","content":"!echo","author":{"id":"w1","username":"Steve","bot":true}}`
+	d.events <- `MESSAGE_CREATE {"channel_id":"c1","content":"!list","author":{"id":"u1","username":"alice"},"member":{"nick":"Alice","roles":["r1"]}}`
+	cmd := nextCommand(t)
+	if cmd.raw != "list" || cmd.sender != "Alice" || cmd.channel != "c1" || cmd.server.name != "creative" ||
+		!reflect.DeepEqual(cmd.identities, []string{"discord:u1", "discord-role:r1"}) {
+		t.Errorf("got command %+v", cmd)
+	}
+
+	//A slash command is acknowledged straight away, its reply fills in the
+	//response and anything more follows up
+	d.events <- `INTERACTION_CREATE {"id":"i1","token":"tok1","type":2,"member":{"roles":["r2"],"user":{"id":"u2","username":"bob"}},
+		"data":{"name":"list","options":[{"name":"args","value":"full"},{"name":"server","value":"survival"}]}}`
+	var ack map[string]int
+	d.decode(t, d.wait(t, "POST", "/api/interactions/i1/tok1/callback"), &ack)
+	if ack["type"] != 5 {
+		t.Errorf("acknowledged with %v", ack)
+	}
+	cmd = nextCommand(t)
+	if cmd.raw != "@survival list full" || cmd.sender != "bob" || cmd.channel != "interaction:tok1" ||
+		!reflect.DeepEqual(cmd.identities, []string{"discord:u2", "discord-role:r2"}) {
+		t.Errorf("got command %+v", cmd)
+	}
+	if !dc.Accepts(cmd.channel, ROLE_COMMANDS) {
+		t.Error("interaction replies not accepted")
+	}
+
+	dc.Send(cmd.channel, "first")
+	dc.Send(cmd.channel, "second")
+	var reply map[string]interface{}
+	d.decode(t, d.wait(t, "PATCH", "/api/webhooks/app1/tok1/messages/@original"), &reply)
+	if reply["content"] != "first" {
+		t.Errorf("original response %v", reply)
+	}
+	d.decode(t, d.wait(t, "POST", "/api/webhooks/app1/tok1"), &reply)
+	if reply["content"] != "second" {
+		t.Errorf("followup %v", reply)
+	}
+
+	//Relayed chat goes through the webhook under the player's name, after
+	//waiting out the rate limit
+	start := time.Now()
+	dc.SendAs("Steve", "waves", true)
+	d.wait(t, "429", "/hook")
+	hook := d.wait(t, "POST", "/hook")
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("didn't wait out retry_after")
+	}
+	if hook.auth != "" {
+		t.Errorf("sent the bot token to the webhook: %q", hook.auth)
+	}
+	d.decode(t, hook, &reply)
+	if reply["content"] != "_waves_" || reply["username"] != "Steve" || reply["avatar_url"] != "https://minotar.net/helm/Steve/64" {
+		t.Errorf("webhook got %v", reply)
+	}
+
+	//Without a webhook, the bot posts it
+	dc.conf.WebhookURL = ""
+	dc.SendAs("Steve", "hi", false)
+	d.decode(t, d.wait(t, "POST", "/api/channels/c1/messages"), &reply)
+	if reply["content"] != "<Steve> hi" {
+		t.Errorf("posted %v", reply)
+	}
+}
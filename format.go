@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//Translates text formatting between Minecraft (legacy § codes and JSON text
+//components) and chat networks.  Everything is parsed into a run of
+//formatSpans and rendered from there.
+
+//What Formatting.ToGame and ToChat may be set to
+const (
+	FORMATTING_TRANSLATE = "translate"
+	FORMATTING_STRIP     = "strip"
+)
+
+type formatConfig struct {
+	//How formatting crosses from chat into the game, and from the game out
+	//to chat: translate (the default) or strip
+	ToGame string
+	ToChat string
+
+	//Formats chat may use in game: color, bold, italic, underline,
+	//strikethrough and obfuscated.  Everything but obfuscated if empty.
+	Allowed []string
+}
+
+var defaultAllowedFormats = []string{"color", "bold", "italic", "underline", "strikethrough"}
+
+//Transports with formatting of their own
+type formatter interface {
+	parseFormatting(text string) []formatSpan
+	renderFormatting(spans []formatSpan) string
+}
+
+//A run of text with the same formatting
+type formatSpan struct {
+	text          string
+	color         string //A Minecraft colour name, e.g. dark_red.  "" for the default.
+	bold          bool
+	italic        bool
+	underlined    bool
+	strikethrough bool
+	obfuscated    bool
+}
+
+func (s formatSpan) plain() bool {
+	return s.color == "" && !s.bold && !s.italic && !s.underlined && !s.strikethrough && !s.obfuscated
+}
+
+func (s formatSpan) sameFormat(o formatSpan) bool {
+	o.text = s.text
+	return s == o
+}
+
+//Legacy colour codes, in code order
+var mcColors = []string{"black", "dark_blue", "dark_green", "dark_aqua", "dark_red", "dark_purple",
+	"gold", "gray", "dark_gray", "blue", "green", "aqua", "red", "light_purple", "yellow", "white"}
+
+//The closest mIRC colour to each of mcColors
+var mcToIRCColor = []int{1, 2, 3, 10, 5, 6, 7, 15, 14, 12, 9, 11, 4, 13, 8, 0}
+
+//And the other way, for mIRC colours 0-15
+var ircToMCColor = []string{"white", "black", "dark_blue", "dark_green", "red", "dark_red", "dark_purple",
+	"gold", "yellow", "green", "dark_aqua", "aqua", "blue", "light_purple", "dark_gray", "gray"}
+
+const (
+	ircBold          = '\x02'
+	ircColor         = '\x03'
+	ircHexColor      = '\x04'
+	ircReset         = '\x0f'
+	ircMonospace     = '\x11'
+	ircReverse       = '\x16'
+	ircItalic        = '\x1d'
+	ircStrikethrough = '\x1e'
+	ircUnderline     = '\x1f'
+)
+
+//Split text on § codes.  Unknown codes are dropped.
+func parseLegacy(text string) []formatSpan {
+	var spans []formatSpan
+	var cur formatSpan
+	var buf strings.Builder
+
+	flush := func() {
+		if buf.Len() > 0 {
+			cur.text = buf.String()
+			spans = append(spans, cur)
+			buf.Reset()
+		}
+	}
+
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '§' {
+			buf.WriteRune(runes[i])
+			continue
+		}
+		if i+1 == len(runes) {
+			break
+		}
+
+		i++
+		flush()
+		code := strings.ToLower(string(runes[i]))
+		if n := strings.Index("0123456789abcdef", code); n >= 0 {
+			cur = formatSpan{color: mcColors[n]} //Colours reset formatting
+			continue
+		}
+
+		switch code {
+		case "k":
+			cur.obfuscated = true
+		case "l":
+			cur.bold = true
+		case "m":
+			cur.strikethrough = true
+		case "n":
+			cur.underlined = true
+		case "o":
+			cur.italic = true
+		case "r":
+			cur = formatSpan{}
+		}
+	}
+	flush()
+
+	return spans
+}
+
+//Render spans as § codes.  Any § in the text itself is removed, so it can't
+//smuggle in codes of its own.
+func renderLegacy(spans []formatSpan) string {
+	var out strings.Builder
+	var prev formatSpan
+
+	for _, s := range spans {
+		text := strings.Replace(s.text, "§", "", -1)
+		if text == "" {
+			continue
+		}
+
+		if !s.sameFormat(prev) {
+			if !prev.plain() {
+				out.WriteString("§r")
+			}
+			for n, color := range mcColors {
+				if color == s.color {
+					out.WriteString("§" + strconv.FormatInt(int64(n), 16))
+				}
+			}
+			for _, f := range []struct {
+				on   bool
+				code string
+			}{{s.obfuscated, "§k"}, {s.bold, "§l"}, {s.strikethrough, "§m"}, {s.underlined, "§n"}, {s.italic, "§o"}} {
+				if f.on {
+					out.WriteString(f.code)
+				}
+			}
+		}
+
+		out.WriteString(text)
+		prev = s
+	}
+
+	return out.String()
+}
+
+//Just the text, with any stray § removed
+func renderPlain(spans []formatSpan) string {
+	var out strings.Builder
+	for _, s := range spans {
+		out.WriteString(strings.Replace(s.text, "§", "", -1))
+	}
+	return out.String()
+}
+
+//Remove every § code from text
+func stripFormatting(text string) string {
+	return renderPlain(parseLegacy(text))
+}
+
+//Split text on mIRC control codes.  Colours outside the basic 16, hex
+//colours and backgrounds have no Minecraft equivalent and are dropped.
+func parseIRC(text string) []formatSpan {
+	var spans []formatSpan
+	var cur formatSpan
+	var buf strings.Builder
+
+	flush := func() {
+		if buf.Len() > 0 {
+			cur.text = buf.String()
+			spans = append(spans, cur)
+			buf.Reset()
+		}
+	}
+
+	//Up to max digits starting at i
+	digits := func(i, max int) (int, int) {
+		n := 0
+		for n < max && i+n < len(text) && text[i+n] >= '0' && text[i+n] <= '9' {
+			n++
+		}
+		if n == 0 {
+			return -1, i
+		}
+		v, _ := strconv.Atoi(text[i : i+n])
+		return v, i + n
+	}
+
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case ircBold:
+			flush()
+			cur.bold = !cur.bold
+		case ircItalic:
+			flush()
+			cur.italic = !cur.italic
+		case ircUnderline:
+			flush()
+			cur.underlined = !cur.underlined
+		case ircStrikethrough:
+			flush()
+			cur.strikethrough = !cur.strikethrough
+		case ircReset:
+			flush()
+			cur = formatSpan{}
+		case ircMonospace, ircReverse:
+		case ircColor:
+			flush()
+			fg, next := digits(i+1, 2)
+			if fg >= 0 && next < len(text)-1 && text[next] == ',' {
+				if _, after := digits(next+1, 2); after != next+1 {
+					next = after
+				}
+			}
+			i = next - 1
+
+			switch {
+			case fg < 0 || fg == 99:
+				cur.color = ""
+			case fg < len(ircToMCColor):
+				cur.color = ircToMCColor[fg]
+			}
+		case ircHexColor:
+			flush()
+			i += strings.IndexFunc(text[i+1:]+"\x00", func(r rune) bool {
+				return !strings.ContainsRune("0123456789abcdefABCDEF,", r)
+			})
+		default:
+			buf.WriteByte(text[i])
+		}
+	}
+	flush()
+
+	return spans
+}
+
+func renderIRC(spans []formatSpan) string {
+	var out strings.Builder
+	var prev formatSpan
+
+	for _, s := range spans {
+		if s.text == "" {
+			continue
+		}
+
+		if !s.sameFormat(prev) {
+			if !prev.plain() {
+				out.WriteByte(ircReset)
+			}
+			for n, color := range mcColors {
+				if color == s.color {
+					fmt.Fprintf(&out, "%c%02d", ircColor, mcToIRCColor[n])
+				}
+			}
+			for _, f := range []struct {
+				on   bool
+				code byte
+			}{{s.bold, ircBold}, {s.italic, ircItalic}, {s.underlined, ircUnderline}, {s.strikethrough, ircStrikethrough}} {
+				if f.on {
+					out.WriteByte(f.code)
+				}
+			}
+		}
+
+		out.WriteString(s.text)
+		prev = s
+	}
+
+	return out.String()
+}
+
+//The JSON text component form of a span
+type textComponent struct {
+	Text          string `json:"text"`
+	Color         string `json:"color,omitempty"`
+	Bold          bool   `json:"bold,omitempty"`
+	Italic        bool   `json:"italic,omitempty"`
+	Underlined    bool   `json:"underlined,omitempty"`
+	Strikethrough bool   `json:"strikethrough,omitempty"`
+	Obfuscated    bool   `json:"obfuscated,omitempty"`
+
+	ClickEvent *componentEvent `json:"clickEvent,omitempty"`
+	HoverEvent *componentEvent `json:"hoverEvent,omitempty"`
+}
+
+type componentEvent struct {
+	Action string `json:"action"`
+	Value  string `json:"value"`
+}
+
+var urlRegex *regexp.Regexp = regexp.MustCompile(`https?://[^\s<>"]+[^\s<>".,;:!?)\]'"]`)
+
+//Render spans as a JSON text component, as taken by tellraw.  Links are
+//made clickable.
+func renderComponents(spans []formatSpan) string {
+	//Children of "" so that nothing inherits from the first span
+	components := []interface{}{""}
+	for _, s := range spans {
+		text := strings.Replace(s.text, "§", "", -1)
+		c := textComponent{
+			Color:         s.color,
+			Bold:          s.bold,
+			Italic:        s.italic,
+			Underlined:    s.underlined,
+			Strikethrough: s.strikethrough,
+			Obfuscated:    s.obfuscated,
+		}
+
+		for _, loc := range urlRegex.FindAllStringIndex(text, -1) {
+			if loc[0] > 0 {
+				c.Text = text[:loc[0]]
+				components = append(components, c)
+			}
+
+			link := c
+			link.Text = text[loc[0]:loc[1]]
+			link.Underlined = true
+			link.ClickEvent = &componentEvent{"open_url", link.Text}
+			link.HoverEvent = &componentEvent{"show_text", "Open " + link.Text}
+			components = append(components, link)
+
+			text = text[loc[1]:]
+		}
+		if text != "" {
+			c.Text = text
+			components = append(components, c)
+		}
+	}
+
+	raw, _ := json.Marshal(components) //Can't fail, it's all strings and bools
+	return string(raw)
+}
+
+//Parse a JSON text component.  Only text and formatting are kept; click
+//events, translations and the like are ignored.  JSON which isn't a text
+//component, e.g. [1, 2], is an error.
+func parseComponents(raw string) ([]formatSpan, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		return nil, err
+	}
+
+	var spans []formatSpan
+	var err error
+	var walk func(v interface{}, style formatSpan)
+	walk = func(v interface{}, style formatSpan) {
+		switch c := v.(type) {
+		case string:
+			style.text = c
+			spans = append(spans, style)
+		case []interface{}:
+			//The first element is the parent of the rest
+			if len(c) == 0 {
+				return
+			}
+			first := len(spans)
+			walk(c[0], style)
+			if len(spans) > first {
+				style = spans[first]
+			}
+			for _, child := range c[1:] {
+				walk(child, style)
+			}
+		case map[string]interface{}:
+			if color, ok := c["color"].(string); ok {
+				style.color = color
+				if strings.HasPrefix(color, "#") || color == "reset" {
+					style.color = "" //Hex colours have no legacy code
+				}
+			}
+			for name, field := range map[string]*bool{"bold": &style.bold, "italic": &style.italic,
+				"underlined": &style.underlined, "strikethrough": &style.strikethrough,
+				"obfuscated": &style.obfuscated} {
+				if on, ok := c[name].(bool); ok {
+					*field = on
+				}
+			}
+
+			text, _ := c["text"].(string)
+			style.text = text
+			spans = append(spans, style)
+
+			if extra, ok := c["extra"].([]interface{}); ok {
+				for _, child := range extra {
+					walk(child, style)
+				}
+			}
+		default:
+			err = fmt.Errorf("%v isn't a text component", c)
+		}
+	}
+	walk(v, formatSpan{})
+
+	return spans, err
+}
+
+//Remove the formats chat isn't allowed to use in game
+func allowFormats(spans []formatSpan, allowed map[string]bool) []formatSpan {
+	out := make([]formatSpan, len(spans))
+	for i, s := range spans {
+		if !allowed["color"] {
+			s.color = ""
+		}
+		s.bold = s.bold && allowed["bold"]
+		s.italic = s.italic && allowed["italic"]
+		s.underlined = s.underlined && allowed["underline"]
+		s.strikethrough = s.strikethrough && allowed["strikethrough"]
+		s.obfuscated = s.obfuscated && allowed["obfuscated"]
+		out[i] = s
+	}
+	return out
+}
+
+//Parse text received from t, keeping only the formats allowed in game
+func chatSpans(t chatTransport, text string) []formatSpan {
+	conf := currentConfig()
+
+	spans := []formatSpan{{text: text}}
+	if f, ok := t.(formatter); ok {
+		spans = f.parseFormatting(text)
+	}
+
+	if conf.Formatting.ToGame == FORMATTING_STRIP {
+		return allowFormats(spans, nil)
+	}
+	return allowFormats(spans, conf.formatAllowed)
+}
+
+//Text received from t, as it should be said in game
+func toGame(t chatTransport, text string) string {
+	return renderLegacy(chatSpans(t, text))
+}
+
+//Parse text from the game, which is a JSON text component when it comes
+//from tellraw or a plugin that logs them, and § codes otherwise
+func gameSpans(text string) []formatSpan {
+	if strings.HasPrefix(text, "{") || strings.HasPrefix(text, "[") {
+		if spans, err := parseComponents(text); err == nil {
+			return spans
+		}
+	}
+	return parseLegacy(text)
+}
+
+//Game text, as it should be sent to t
+func toChat(t chatTransport, text string) string {
+	spans := gameSpans(text)
+	if f, ok := t.(formatter); ok && currentConfig().Formatting.ToChat != FORMATTING_STRIP {
+		return f.renderFormatting(spans)
+	}
+	return renderPlain(spans)
+}
+
+func checkFormatting(f formatConfig) error {
+	for _, mode := range []string{f.ToGame, f.ToChat} {
+		if mode != "" && mode != FORMATTING_TRANSLATE && mode != FORMATTING_STRIP {
+			return fmt.Errorf("Formatting: %s should be %s or %s", mode, FORMATTING_TRANSLATE, FORMATTING_STRIP)
+		}
+	}
+
+	for _, format := range f.Allowed {
+		switch format {
+		case "color", "bold", "italic", "underline", "strikethrough", "obfuscated":
+		default:
+			return fmt.Errorf("Formatting: unknown format %s", format)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+var red, bold = formatSpan{color: "red"}, formatSpan{bold: true}
+
+func span(text string, style formatSpan) formatSpan {
+	style.text = text
+	return style
+}
+
+func TestParseLegacy(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want []formatSpan
+	}{
+		{"plain", []formatSpan{{text: "plain"}}},
+		{"§chello §lworld", []formatSpan{span("hello ", red), span("world", formatSpan{color: "red", bold: true})}},
+		{"§lloud§r quiet", []formatSpan{span("loud", bold), {text: " quiet"}}},
+		{"§l§cred resets bold", []formatSpan{span("red resets bold", red)}},
+		{"§C§Nupper", []formatSpan{span("upper", formatSpan{color: "red", underlined: true})}},
+		{"§xunknown§", []formatSpan{{text: "unknown"}}},
+	} {
+		if got := parseLegacy(test.in); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestRenderLegacy(t *testing.T) {
+	for _, test := range []struct {
+		in   []formatSpan
+		want string
+	}{
+		{[]formatSpan{{text: "plain"}}, "plain"},
+		{[]formatSpan{span("a§4b", red)}, "§ca4b"},
+		{[]formatSpan{span("loud", bold), {text: " quiet"}}, "§lloud§r quiet"},
+		{[]formatSpan{span("a", red), span("b", red), span("", bold)}, "§cab"},
+		{[]formatSpan{span("all", formatSpan{obfuscated: true, bold: true, strikethrough: true, underlined: true, italic: true})}, "§k§l§m§n§oall"},
+	} {
+		if got := renderLegacy(test.in); got != test.want {
+			t.Errorf("%+v: got %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseIRC(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want []formatSpan
+	}{
+		{"\x0304red\x03 plain", []formatSpan{span("red", red), {text: " plain"}}},
+		{"\x02b\x02 \x1fu", []formatSpan{span("b", bold), {text: " "}, span("u", formatSpan{underlined: true})}},
+		{"\x0304,12background", []formatSpan{span("background", red)}},
+		{"\x034,", []formatSpan{span(",", red)}},
+		{"\x0342unknown", []formatSpan{{text: "unknown"}}},
+		{"\x04ff0000hex", []formatSpan{{text: "hex"}}},
+		{"\x1d\x1eboth\x0f", []formatSpan{span("both", formatSpan{italic: true, strikethrough: true})}},
+		{"\x16reverse\x11mono", []formatSpan{{text: "reversemono"}}},
+	} {
+		if got := parseIRC(test.in); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestRenderIRC(t *testing.T) {
+	for _, test := range []struct {
+		in   []formatSpan
+		want string
+	}{
+		{[]formatSpan{span("red", formatSpan{color: "red", bold: true}), {text: " plain"}}, "\x0304\x02red\x0f plain"},
+		{[]formatSpan{span("gold", formatSpan{color: "gold"})}, "\x0307gold"},
+		{[]formatSpan{span("hidden", formatSpan{obfuscated: true})}, "hidden"},
+	} {
+		if got := renderIRC(test.in); got != test.want {
+			t.Errorf("%+v: got %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestRenderComponents(t *testing.T) {
+	got := renderComponents([]formatSpan{span("see https://example.org/a. §cok", formatSpan{color: "gold"})})
+	want := `["",{"text":"see ","color":"gold"},` +
+		`{"text":"https://example.org/a","color":"gold","underlined":true,` +
+		`"clickEvent":{"action":"open_url","value":"https://example.org/a"},` +
+		`"hoverEvent":{"action":"show_text","value":"Open https://example.org/a"}},` +
+		`{"text":". cok","color":"gold"}]`
+	if got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+}
+
+func TestParseComponents(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want []formatSpan
+		err  bool
+	}{
+		{`{"text":"a","color":"red","extra":[{"text":"b","bold":true},"c"]}`,
+			[]formatSpan{span("a", red), span("b", formatSpan{color: "red", bold: true}), span("c", red)}, false},
+		{`["",{"text":"hex","color":"#ff0000"},{"text":"reset","color":"reset"}]`,
+			[]formatSpan{{}, {text: "hex"}, {text: "reset"}}, false},
+		{`[{"text":"parent","italic":true},"child",{"text":"not","italic":false}]`,
+			[]formatSpan{span("parent", formatSpan{italic: true}), span("child", formatSpan{italic: true}), {text: "not"}}, false},
+		{`[1, 2]`, nil, true},
+		{`[12:00] not json`, nil, true},
+	} {
+		got, err := parseComponents(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v", test.in, err)
+		}
+		if !test.err && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestGameSpans(t *testing.T) {
+	for in, want := range map[string]string{
+		`{"text":"Hello ","extra":[{"text":"world","color":"green"}]}`: "Hello world",
+		`["",{"text":"<Steve> "},{"text":"hi"}]`:                       "<Steve> hi",
+		"§aLegacy §lcodes":                                             "Legacy codes",
+		"[12:00] brackets aren't JSON":                                 "[12:00] brackets aren't JSON",
+		"[1]":                                                          "[1]",
+		"{not json}":                                                   "{not json}",
+	} {
+		if got := renderPlain(gameSpans(in)); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
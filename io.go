@@ -3,99 +3,140 @@ package main
 import (
 	"bufio"
 	"fmt"
-	irc "github.com/ckolbeck/ircbot"
 	"os"
 	"os/signal"
 	"regexp"
+	"strings"
 	"syscall"
 )
 
 var (
-	chatRegex          *regexp.Regexp
-	sanitizeRegex      *regexp.Regexp
-	commands           chan *command
-	commandResponse    chan string
-	serverErrors       int
-	severeServerErrors int
-	serverVersion      string
+	sanitizeRegex *regexp.Regexp
+	commands      chan *command
+
+	//Anything a player or the console said, which mustn't be mistaken for
+	//the server reporting something
+	saidRegex *regexp.Regexp
 )
 
+//How many of its own lines the bot remembers per server
+const EchoMemory = 64
+
 const (
-	SOURCE_MC = iota
-	SOURCE_IRC
+	SOURCE_MC       = iota
+	SOURCE_CHAT     //Any chat transport
+	SOURCE_INTERNAL //Scheduled jobs and the like
 )
 
 func init() {
-	chatRegex = regexp.MustCompile(`\[INFO\]( \* [a-zA-Z0-9\-_]+| <[a-zA-Z0-9\-_]+> )(.*)`)
 	sanitizeRegex = regexp.MustCompile("[\n\r]")
+	saidRegex = regexp.MustCompile(`INFO\]:? (?:\[Not Secure\] )?(<[a-zA-Z0-9\-_]+>|\* [a-zA-Z0-9\-_]+|\[(?:Server|CONSOLE|Rcon)\]) (.*)$`)
 	commands = make(chan *command, 1024)
-	commandResponse = make(chan string, 2048)
-	dieSignal := make(chan os.Signal)
-	reloadSignal := make(chan os.Signal)
+	dieSignal := make(chan os.Signal, 1)
+	reloadSignal := make(chan os.Signal, 1)
 	signal.Notify(dieSignal, syscall.SIGINT, syscall.SIGTERM)
 	signal.Notify(reloadSignal, syscall.SIGHUP)
 	go func() {
 		for {
 			select {
 			case <-dieSignal:
-				server.Destroy()
+				for _, m := range servers {
+					m.Destroy()
+				}
+				saveScrollback()
 				os.Exit(1)
 			case <-reloadSignal:
-				err := config.Reparse()
+				changes, err := reloadConfig()
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Config reparse failed: %s\n", err)
+					continue
+				}
+				for _, line := range changes {
+					logInfo.Println(line)
 				}
 			}
 		}
 	}()
 }
 
-func teeServerOutput() {
+func (m *minecraft) teeOutput() {
 	var line string
-	senderRegex := regexp.MustCompile(`\[INFO\] (\* |<)([a-zA-Z0-9\-_]+)[> ]`)
 	errorRegex := regexp.MustCompile(`java.*Exception`)
 	severeErrorRegex := regexp.MustCompile(`\[SEVERE\] Unexpected exception`)
+	startedRegex := regexp.MustCompile(`INFO\]:? Done \(`)
+	stoppingRegex := regexp.MustCompile(`INFO\]:? Stopping (the )?server`)
 
 	for {
 		//The MC Server uses Stderr for almost, but not quite, everything.
 		//Monitor both
 		select {
-		case line = <-server.Out:
-		case line = <-server.Err:
+		case line = <-m.Out:
+		case line = <-m.Err:
 		}
 
-		if errorRegex.MatchString(line) {
-			serverErrors++
-		} else if severeErrorRegex.MatchString(line) {
-			severeServerErrors++
+		//Chat can say anything, including what looks like the server
+		//reporting a death or login, so only the server's own lines count
+		said := saidRegex.FindStringSubmatch(line)
+		consoleSay := said != nil && said[1][0] == '['
+
+		if said == nil {
+			if errorRegex.MatchString(line) {
+				m.errors++
+			} else if severeErrorRegex.MatchString(line) {
+				m.severeErrors++
+				m.alert("Server error: " + line)
+			}
+			m.trackPlayers(line)
+			m.trackMilestones(line)
+
+			if match := versionRegex.FindStringSubmatch(line); match != nil {
+				m.version = match[1]
+			} else if startedRegex.MatchString(line) {
+				m.relayEvent(EVENT_START, "", m.version)
+				go m.reconcileSanctions()
+			} else if stoppingRegex.MatchString(line) {
+				m.relayEvent(EVENT_STOP, "", "")
+			}
 		}
 
 		//And dispatch to:
 
-		fmt.Println(line) //The server console
-
-		if matches := chatRegex.FindStringSubmatch(line); matches != nil { //Irc, if it looks like chat
-			if len(matches) < 3 {
-				continue
-			}
+		fmt.Println(m.tag(line)) //The server console
+		if !consoleSay || !m.isEcho(said[2]) {
+			m.mirrorConsole(line) //Staff channels mirroring it, less what the bot said itself
+		}
 
-			if matches[2][0] == bot.Attention { //Command issued from inside server
-				senderMatches := senderRegex.FindStringSubmatch(line)
-				commands <- &command{matches[2][1:], senderMatches[2], "", SOURCE_MC}
-				logInfo.Printf("%s sent command '%s' from in-server", senderMatches[2], matches[2][1:])
-			} else { //Chat
-				bot.Send(&irc.Message{
-					Command:  "PRIVMSG",
-					Args:     []string{config.IrcChan},
-					Trailing: matches[1] + matches[2],
-				})
+		//Relayed chat and command replies come back as the console's, and
+		//are never treated as a player's
+		if said != nil && !consoleSay { //Irc, if it's a player's chat
+			player, message := strings.Trim(said[1], "<>* "), said[2]
+			attn := currentConfig().AttnChar
+
+			if attn != "" && strings.HasPrefix(message, attn) { //Command issued from inside server
+				raw := strings.TrimPrefix(message, attn)
+				if !m.playerOnline(player) {
+					logErr.Printf("Ignoring command '%s' from %s, who isn't online", raw, player)
+				} else {
+					commands <- &command{
+						raw:        raw,
+						sender:     player,
+						identities: []string{"mc:" + player},
+						source:     SOURCE_MC,
+						server:     m,
+					}
+					logInfo.Printf("%s sent command '%s' from in-server", player, raw)
+				}
+			} else if strings.HasPrefix(said[1], "* ") { //Chat
+				m.relayEvent(EVENT_ACTION, player, message)
+			} else {
+				m.relayEvent(EVENT_CHAT, player, message)
 			}
 		}
 
 		select {
-		case commandResponse <- line: //The server output queue
-		case <-commandResponse: //If the buffer has filled, drop the oldest line
-			commandResponse <- line
+		case m.response <- line: //The server output queue
+		case <-m.response: //If the buffer has filled, drop the oldest line
+			m.response <- line
 		}
 	}
 }
@@ -112,26 +153,89 @@ func readConsoleInput() {
 			continue
 		}
 
-		//A 'stop' issued at the console could easily muck things up.
-		//Hijack it.
-		if string(line) == "stop" {
-			server.Stop(1e9, "Stop issued at console. Going down now!")
-			serverErrors = 0
-			severeServerErrors = 0
-		} else {
-			server.In <- string(line)
+		//'@name command' goes to the named server, anything else to the default
+		m, raw := findServer(""), string(line)
+		if split := strings.SplitN(raw, " ", 2); len(split) == 2 && strings.HasPrefix(split[0], "@") {
+			if m = findServer(split[0][1:]); m == nil {
+				logErr.Println("Unknown server: " + split[0][1:])
+				continue
+			}
+			raw = split[1]
 		}
+		if m == nil {
+			continue
+		}
+
+		consoleInput(m, raw)
 	}
 }
 
-func echoIRCToServer(_ string, m *irc.Message) string {
-	sanitized := sanitizeRegex.ReplaceAllString(m.Trailing, " ")
+//Pass a line typed at the bot's console on to m.  A stop (or restart)
+//issued there could easily muck things up, so it's hijacked and run as the
+//bot's own command.
+func consoleInput(m *minecraft, raw string) {
+	switch consoleHijack(raw) {
+	case "stop":
+		commands <- &command{raw: "stop 1s Stop issued at console. Going down now!",
+			sender: "console", source: SOURCE_INTERNAL, server: m}
+	case "restart":
+		commands <- &command{raw: "restart", sender: "console", source: SOURCE_INTERNAL, server: m}
+	default:
+		m.In <- raw
+	}
+}
 
-	if m.Ctcp == "" { //Line was normal chat
-		server.In <- fmt.Sprintf("say <%s> %s", m.GetSender(), sanitized)
-	} else if m.Ctcp == "ACTION" { //Line was a Ctcp req
-		server.In <- fmt.Sprintf("say * %s %s", m.GetSender(), sanitized)
-	} //Else ignore
+//Which of the bot's commands a server command line should be left to,
+//"stop" or "restart", or "" if it's fine as is.  Servers take their commands
+//with or without a slash and in any case, and proxies stop on end.
+func consoleHijack(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
 
+	switch strings.ToLower(strings.TrimPrefix(fields[0], "/")) {
+	case "stop", "end":
+		return "stop"
+	case "restart":
+		return "restart"
+	}
 	return ""
 }
+
+//Broadcast text in game with say, remembering it so it's known when the
+//server logs it
+func (m *minecraft) say(text string) {
+	text = sanitizeRegex.ReplaceAllString(text, " ")
+
+	m.echoLock.Lock()
+	m.echoes = append(m.echoes, stripFormatting(strings.TrimSpace(text)))
+	if len(m.echoes) > EchoMemory {
+		m.echoes = m.echoes[1:]
+	}
+	m.echoLock.Unlock()
+
+	m.In <- "say " + text
+}
+
+//Send text to player alone
+func (m *minecraft) tell(player, text string) {
+	m.In <- "tell " + player + " " + sanitizeRegex.ReplaceAllString(text, " ")
+}
+
+//Whether text, logged as said by the console, was something the bot said.
+//Each thing said is only recognised once.
+func (m *minecraft) isEcho(text string) bool {
+	text = stripFormatting(strings.TrimSpace(text))
+
+	m.echoLock.Lock()
+	defer m.echoLock.Unlock()
+
+	for i, echo := range m.echoes {
+		if echo == text {
+			m.echoes = append(m.echoes[:i], m.echoes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ckolbeck/mcserver"
+)
+
+func TestConsoleHijack(t *testing.T) {
+	for line, want := range map[string]string{
+		"stop":          "stop",
+		"STOP":          "stop",
+		"/stop":         "stop",
+		"/Stop now":     "stop",
+		"end":           "stop",
+		"  /END":        "stop",
+		"restart":       "restart",
+		"/RESTART":      "restart",
+		"say stop":      "",
+		"stopwatch":     "",
+		"list":          "",
+		"":              "",
+		"//stop":        "",
+		"whitelist end": "",
+	} {
+		if got := consoleHijack(line); got != want {
+			t.Errorf("%q: got %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestConsoleInput(t *testing.T) {
+	m := &minecraft{Server: &mcserver.Server{In: make(chan string, 1)}, name: "survival"}
+
+	for line, want := range map[string]string{
+		"/Stop":    "stop 1s Stop issued at console. Going down now!",
+		"end":      "stop 1s Stop issued at console. Going down now!",
+		"RESTART":  "restart",
+		"/restart": "restart",
+	} {
+		consoleInput(m, line)
+		select {
+		case cmd := <-commands:
+			if cmd.raw != want || cmd.server != m || cmd.source != SOURCE_INTERNAL {
+				t.Errorf("%q: queued %q for %v", line, cmd.raw, cmd.server)
+			}
+		default:
+			t.Errorf("%q: nothing queued", line)
+		}
+		select {
+		case sent := <-m.In:
+			t.Errorf("%q: %q went straight to the server", line, sent)
+		default:
+		}
+	}
+
+	consoleInput(m, "say hi")
+	select {
+	case sent := <-m.In:
+		if sent != "say hi" {
+			t.Errorf("sent %q", sent)
+		}
+	default:
+		t.Error("say hi wasn't sent")
+	}
+	select {
+	case cmd := <-commands:
+		t.Errorf("queued %q", cmd.raw)
+	default:
+	}
+}
+
+func TestTeeOutputChat(t *testing.T) {
+	m := &minecraft{
+		Server:   &mcserver.Server{Out: make(chan string), Err: make(chan string)},
+		name:     "survival",
+		response: make(chan string, 1),
+		players:  map[string]*presence{"steve": {name: "Steve", server: "survival"}},
+	}
+	defer func(s []*minecraft, ts []chatTransport) { servers, transports = s, ts }(servers, transports)
+	servers, transports = []*minecraft{m}, nil
+	withTestConfig(t, &Config{AttnChar: "!"})
+	go m.teeOutput()
+
+	//Each line's handled once it's queued as output
+	feed := func(line string) {
+		m.Out <- line
+		<-m.response
+	}
+
+	feed("[12:00:01] [Server thread/INFO]: <Steve> hello there")
+	feed("[12:00:02] [Server thread/INFO]: * Steve waves")
+	feed("[12:00:03] [Server thread/INFO]: <Steve> ")
+	feed("[12:00:04] [Server thread/INFO]: [Server] !op Steve")
+	feed("[12:00:05] [Server thread/INFO]: <Alex> !op Alex")
+	feed("2013-05-01 12:00:06 [INFO] <Steve> the old way")
+	feed("[12:00:07] [Server thread/INFO]: [Not Secure] <Steve> !help seen")
+
+	select {
+	case cmd := <-commands:
+		if cmd.raw != "help seen" || cmd.sender != "Steve" || cmd.source != SOURCE_MC ||
+			cmd.server != m || !reflect.DeepEqual(cmd.identities, []string{"mc:Steve"}) {
+			t.Errorf("queued %+v", cmd)
+		}
+	default:
+		t.Error("Steve's command wasn't queued")
+	}
+	select {
+	case cmd := <-commands:
+		t.Errorf("also queued %q from %s", cmd.raw, cmd.sender)
+	default:
+	}
+
+	scrollbackLock.Lock()
+	var got []string
+	for _, e := range scrollback {
+		if e.Event == EVENT_CHAT || e.Event == EVENT_ACTION {
+			got = append(got, e.Event+" "+e.Player+": "+e.Text)
+		}
+	}
+	scrollbackLock.Unlock()
+	want := []string{
+		EVENT_CHAT + " Steve: <Steve> hello there",
+		EVENT_ACTION + " Steve: * Steve waves",
+		EVENT_CHAT + " Steve: <Steve> ",
+		EVENT_CHAT + " Steve: <Steve> the old way",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("relayed %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"github.com/ckolbeck/ircbot"
+	"strings"
+)
+
+var ircChat *ircTransport = &ircTransport{}
+
+type ircTransport struct {
+	bot *ircbot.Bot
+}
+
+func (t *ircTransport) Name() string {
+	return "irc"
+}
+
+func (t *ircTransport) Connect(conf *Config) error {
+	host, port, ssl, pass, err := ircDialParams(conf)
+	if err != nil {
+		return err
+	}
+
+	if t.bot, err = ircbot.NewBot(conf.Nick, pass, conf.IrcDomain, host, port, ssl, conf.AttnChar[0]); err != nil {
+		return err
+	}
+
+	t.bot.SetPrivmsgHandler(t.directed, t.undirected)
+	for _, c := range conf.ircChannels {
+		t.bot.JoinChannel(c.Name, c.Key)
+	}
+	return nil
+}
+
+func (t *ircTransport) Send(room, text string) {
+	t.bot.Send(&ircbot.Message{
+		Command:  "PRIVMSG",
+		Args:     []string{room},
+		Trailing: text,
+	})
+}
+
+func (t *ircTransport) Rooms(role string) []string {
+	var rooms []string
+	for _, c := range currentConfig().ircChannels {
+		if c.roles[role] {
+			rooms = append(rooms, c.Name)
+		}
+	}
+	return rooms
+}
+
+func (t *ircTransport) Accepts(room, role string) bool {
+	if c := t.RoomConfig(room); c != nil {
+		return c.roles[role]
+	}
+
+	//Not a channel we know, so a private message.  Those can only be commands.
+	return role == ROLE_COMMANDS && !isIRCChannel(room)
+}
+
+func (t *ircTransport) RoomConfig(room string) *ChannelConfig {
+	for _, c := range currentConfig().ircChannels {
+		if strings.EqualFold(c.Name, room) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (t *ircTransport) RoomServer(room string) string {
+	if c := t.RoomConfig(room); c != nil {
+		return c.Server
+	}
+	return ""
+}
+
+func (t *ircTransport) parseFormatting(text string) []formatSpan {
+	return parseIRC(text)
+}
+
+func (t *ircTransport) renderFormatting(spans []formatSpan) string {
+	return renderIRC(spans)
+}
+
+func isIRCChannel(name string) bool {
+	return strings.HasPrefix(name, "#") || strings.HasPrefix(name, "&")
+}
+
+func (t *ircTransport) Online() bool {
+	return ircOnline()
+}
+
+//Part the channels which have gone from the config and join the new ones
+func (t *ircTransport) syncChannels(old, new []*ChannelConfig) {
+	part, join := channelChanges(old, new)
+	for _, c := range part {
+		t.bot.Send(&ircbot.Message{Command: "PART", Args: []string{c.Name}})
+	}
+	for _, c := range join {
+		t.bot.JoinChannel(c.Name, c.Key)
+	}
+}
+
+//The channels to part and then join to go from old to new.  Channels whose
+//key changed are in both, as the key only counts when joining.
+func channelChanges(old, new []*ChannelConfig) (part, join []*ChannelConfig) {
+	wanted := make(map[string]*ChannelConfig)
+	for _, c := range new {
+		wanted[strings.ToLower(c.Name)] = c
+	}
+
+	joined := make(map[string]bool)
+	for _, c := range old {
+		if n, ok := wanted[strings.ToLower(c.Name)]; !ok || n.Key != c.Key {
+			part = append(part, c)
+		} else {
+			joined[strings.ToLower(c.Name)] = true
+		}
+	}
+
+	for _, c := range new {
+		if !joined[strings.ToLower(c.Name)] {
+			join = append(join, c)
+		}
+	}
+	return part, join
+}
+
+//Lines addressed to the bot with the attention char, or sent to it privately
+func (t *ircTransport) directed(cmd string, m *ircbot.Message) string {
+	room := m.Args[0]
+	if room == currentConfig().Nick {
+		room = m.GetSender()
+	}
+
+	handleChat(&chatMessage{
+		transport: t,
+		room:      room,
+		sender:    m.GetSender(),
+		account:   ircAccount(m.GetSender()),
+		text:      cmd,
+		directed:  true,
+	})
+
+	return ""
+}
+
+func (t *ircTransport) undirected(_ string, m *ircbot.Message) string {
+	if m.Ctcp != "" && m.Ctcp != "ACTION" { //Ignore other CTCP requests
+		return ""
+	}
+
+	handleChat(&chatMessage{
+		transport: t,
+		room:      m.Args[0],
+		sender:    m.GetSender(),
+		account:   ircAccount(m.GetSender()),
+		text:      m.Trailing,
+		action:    m.Ctcp == "ACTION",
+	})
+
+	return ""
+}
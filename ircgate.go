@@ -0,0 +1,929 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ircbot connects to the IRC server once and never notices if that connection
+//goes away.  So the bot instead connects to a gateway on the loopback
+//interface, which owns the real connection.  The gateway:
+//
+// - dials the real server (with a client certificate if need be)
+// - performs SASL or NickServ identification on the bot's behalf and holds
+//   back JOINs until that has finished, so +r channels can be joined
+// - notices when the connection drops and reconnects with backoff,
+//   replaying the bot's registration and rejoining its channels
+// - regains the configured nick if it comes back to find it taken
+// - keeps track of which account each nick is logged in to, from the
+//   account-tag, extended-join and account-notify capabilities and WHOX,
+//   so links can't be used by whoever picks up someone else's nick
+//
+//Everything else passes through untouched.  Anything on the box can reach
+//the loopback interface, so the bot has to open with a PASS of a random
+//token only it was given before the gateway will talk to it.
+
+const (
+	AUTH_NICKSERV      = "nickserv"
+	AUTH_SASL_PLAIN    = "sasl-plain"
+	AUTH_SASL_EXTERNAL = "sasl-external"
+
+	ircPingInterval  = 2 * time.Minute
+	ircMinBackoff    = time.Second
+	ircMaxBackoff    = 5 * time.Minute
+	ircNickRetry     = time.Minute
+	gatewayPingToken = "mcbot-gateway"
+	gatewayWhoToken  = "152" //Marks the replies to our WHOX queries
+	gatewayAdmitWait = 10 * time.Second
+	gatewayAdmitMax  = 4 //Lines the bot may send before its PASS
+)
+
+//What NickServ says once it's accepted our password: Atheme, Anope and
+//friends.  Anything merely mentioning being identified won't do, that's
+//just as likely "You are not identified".
+var nickServSuccessRegex *regexp.Regexp = regexp.MustCompile(
+	`(?i)^(?:you are now (?:identified|recogni[sz]ed|logged in)\b|password accepted\b)`)
+
+type ircAuth struct {
+	Mechanism string //"" (server password only), nickserv, sasl-plain or sasl-external
+
+	//Credentials for nickserv and sasl-plain.  Account defaults to Nick,
+	//and Password to Pass, in which case Pass isn't also sent as the server
+	//password.
+	Account  string
+	Password string
+
+	//PEM encoded client certificate and key, required for sasl-external
+	ClientCert string
+	ClientKey  string
+
+	//Seconds to wait for NickServ to confirm identification before joining
+	//channels regardless
+	IdentifyTimeout int
+}
+
+var gateway *ircGateway
+
+//Start the gateway and return the parameters the bot should connect with.
+//pass is the token the gateway expects, the real server password is sent
+//by the gateway itself.
+func ircDialParams(conf *Config) (host string, port int, ssl bool, pass string, err error) {
+	raw := make([]byte, 16)
+	if _, err = rand.Read(raw); err != nil {
+		return "", 0, false, "", err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", 0, false, "", err
+	}
+
+	gateway = &ircGateway{
+		conf:     conf,
+		auth:     conf.IrcAuth,
+		password: conf.IrcAuth.Password,
+		token:    hex.EncodeToString(raw),
+		channels: make(map[string]string),
+	}
+	if gateway.auth.Account == "" {
+		gateway.auth.Account = conf.Nick
+	}
+	if gateway.password == "" {
+		gateway.password = conf.Pass
+	}
+
+	//Pass is only a server password when it isn't being used for something else
+	if conf.Pass != "" && (conf.IrcAuth.Mechanism == "" || conf.IrcAuth.Password != "") {
+		gateway.registration = []string{"PASS " + conf.Pass}
+	}
+
+	go gateway.serve(listener)
+
+	return "127.0.0.1", listener.Addr().(*net.TCPAddr).Port, false, gateway.token, nil
+}
+
+//Whether the bot is currently connected to IRC and in its channels
+func ircOnline() bool {
+	if gateway == nil {
+		return false
+	}
+
+	gateway.lock.Lock()
+	defer gateway.lock.Unlock()
+	return gateway.ready
+}
+
+type ircGateway struct {
+	conf     *Config //As it was at startup, changes to these need a restart anyway
+	auth     ircAuth
+	password string
+	token    string //What the bot has to send as its PASS
+
+	client     net.Conn
+	clientLock sync.Mutex
+
+	lock         sync.Mutex
+	upstream     net.Conn          //nil while disconnected
+	registration []string          //Our PASS, and NICK and USER as the bot sent them
+	channels     map[string]string //Channel -> key, as the bot joined them
+	registered   bool              //Welcomed by the server this session
+	ready        bool              //Registered, identified and in our channels
+	nick         string            //What the server currently calls us
+	session      int               //Bumped on every reconnect, so stale timers can tell
+	offered      []string          //Capabilities the server listed
+	caps         map[string]bool   //Capabilities enabled this session
+	whox         bool              //Whether the server answers WHOX queries
+
+	//The account each nick we know of is logged in to, by lowercased nick
+	accounts map[string]string
+
+	//Everyone sharing a channel with us, by lowercased nick, to those
+	//channels
+	present map[string]map[string]bool
+}
+
+func (g *ircGateway) serve(listener net.Listener) {
+	var in *bufio.Reader
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			listener.Close()
+			logErr.Printf("IRC gateway: %s\n", err)
+			return
+		}
+
+		var early []string
+		if in, early, err = g.admit(client); err != nil {
+			logErr.Printf("IRC gateway: turned away %s: %s\n", client.RemoteAddr(), err)
+			client.Close()
+			continue
+		}
+
+		listener.Close()
+		g.client = client
+		for _, line := range early {
+			g.fromClient(line)
+		}
+		break
+	}
+
+	go g.readClient(in)
+
+	backoff := ircMinBackoff
+	for {
+		upstream, err := dialIRC(g.conf)
+		if err != nil {
+			logErr.Printf("IRC gateway: couldn't reach %s: %s, retrying in %v\n", g.conf.IrcServer, err, backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > ircMaxBackoff {
+				backoff = ircMaxBackoff
+			}
+			continue
+		}
+
+		if g.runSession(upstream) {
+			backoff = ircMinBackoff
+		}
+
+		logErr.Printf("IRC gateway: lost connection to %s, reconnecting in %v\n", g.conf.IrcServer, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > ircMaxBackoff {
+			backoff = ircMaxBackoff
+		}
+	}
+}
+
+func dialIRC(conf *Config) (net.Conn, error) {
+	addr := net.JoinHostPort(conf.IrcServer, strconv.Itoa(conf.IrcPort))
+	if !conf.SSL {
+		return net.DialTimeout("tcp", addr, 30*time.Second)
+	}
+
+	tlsConf := &tls.Config{ServerName: conf.IrcServer}
+	if conf.IrcAuth.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.IrcAuth.ClientCert, conf.IrcAuth.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	return tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, tlsConf)
+}
+
+//Register on upstream and shuttle lines until it dies.  Returns whether the
+//session got as far as being registered.
+func (g *ircGateway) runSession(upstream net.Conn) (registered bool) {
+	g.lock.Lock()
+	g.upstream = upstream
+	g.session++
+	g.registered = false
+	g.nick = g.conf.Nick
+	g.present = make(map[string]map[string]bool)
+	g.offered, g.caps, g.whox = nil, make(map[string]bool), false
+	g.accounts = make(map[string]string)
+
+	//Sent before NICK/USER, so the server holds off on registration until
+	//we send CAP END.  Servers without capabilities just ignore it.
+	g.writeUpstream("CAP LS 302")
+	for _, line := range g.registration {
+		g.writeUpstream(line)
+	}
+	g.lock.Unlock()
+
+	defer func() {
+		g.lock.Lock()
+		g.upstream.Close()
+		g.upstream = nil
+		g.ready = false
+		g.lock.Unlock()
+	}()
+
+	in := bufio.NewReader(upstream)
+	pinged := false
+
+	for {
+		upstream.SetReadDeadline(time.Now().Add(ircPingInterval))
+		line, err := in.ReadString('\n')
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !pinged {
+				//Quiet for a while, make sure the server is still there
+				g.sendUpstream("PING :" + gatewayPingToken)
+				pinged = true
+				continue
+			}
+			return
+		}
+		pinged = false
+
+		//ircbot doesn't know about message tags, so they stop here
+		tags, line := splitTags(strings.TrimRight(line, "\r\n"))
+		prefix, command, params := parseIRCLine(line)
+
+		if command == "001" {
+			registered = true
+		}
+
+		g.handlePresence(prefix, command, params)
+		if g.handleAccounts(tags, prefix, command, params) {
+			continue
+		}
+		if g.handleAuth(prefix, command, params, line) || g.handleNick(prefix, command, params) {
+			continue
+		}
+
+		//Nor about extended-join's extra parameters
+		if command == "JOIN" && len(params) > 1 {
+			line = ":" + prefix + " JOIN " + params[0]
+		}
+
+		if command == "PONG" && len(params) > 0 && params[len(params)-1] == gatewayPingToken {
+			continue
+		}
+
+		g.sendClient(g.rewriteTarget(command, params, line))
+	}
+}
+
+func (g *ircGateway) sendClient(line string) {
+	g.clientLock.Lock()
+	defer g.clientLock.Unlock()
+
+	if _, err := fmt.Fprintf(g.client, "%s\r\n", line); err != nil {
+		logErr.Printf("IRC gateway: lost the bot: %s\n", err)
+	}
+}
+
+func (g *ircGateway) sendUpstream(line string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.writeUpstream(line)
+}
+
+//Callers must hold g.lock.  Lines sent while disconnected are dropped.
+func (g *ircGateway) writeUpstream(line string) {
+	if g.upstream == nil {
+		return
+	}
+
+	if _, err := fmt.Fprintf(g.upstream, "%s\r\n", line); err != nil {
+		g.upstream.Close() //runSession will notice and clean up
+	}
+}
+
+//We're registered and identified, (re)join everything the bot asked for
+func (g *ircGateway) markReady() {
+	g.lock.Lock()
+	joined := g.joinChannels()
+	g.lock.Unlock()
+
+	if joined {
+		go flushBacklog(ircChat)
+	}
+}
+
+//markReady, unless session has since ended
+func (g *ircGateway) markReadyIn(session int) {
+	g.lock.Lock()
+	joined := g.session == session && g.joinChannels()
+	g.lock.Unlock()
+
+	if joined {
+		go flushBacklog(ircChat)
+	}
+}
+
+//Callers must hold g.lock.  Returns whether we weren't ready before.
+func (g *ircGateway) joinChannels() bool {
+	if g.ready || g.upstream == nil {
+		return false
+	}
+
+	g.ready = true
+	for channel, key := range g.channels {
+		g.writeUpstream(strings.TrimSpace("JOIN " + channel + " " + key))
+	}
+	return true
+}
+
+//Check that whoever connected to the gateway is the bot, by the token it
+//sends as its PASS.  Returns the reader to carry on with and any lines that
+//came before the PASS, which are the bot's registration.
+func (g *ircGateway) admit(client net.Conn) (*bufio.Reader, []string, error) {
+	client.SetReadDeadline(time.Now().Add(gatewayAdmitWait))
+	defer client.SetReadDeadline(time.Time{})
+
+	in := bufio.NewReader(client)
+	var early []string
+	for len(early) < gatewayAdmitMax {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		_, command, params := parseIRCLine(line)
+		if command != "PASS" {
+			early = append(early, line)
+			continue
+		}
+		if len(params) == 0 || subtle.ConstantTimeCompare([]byte(params[0]), []byte(g.token)) != 1 {
+			return nil, nil, errors.New("wrong PASS")
+		}
+		return in, early, nil
+	}
+
+	return nil, nil, errors.New("no PASS")
+}
+
+func (g *ircGateway) readClient(in *bufio.Reader) {
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			logErr.Printf("IRC gateway: lost the bot: %s\n", err)
+			return
+		}
+		g.fromClient(strings.TrimRight(line, "\r\n"))
+	}
+}
+
+//Pass on a line from the bot, or hold on to it for later
+func (g *ircGateway) fromClient(line string) {
+	_, command, params := parseIRCLine(line)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	switch command {
+	case "CAP", "AUTHENTICATE", "PASS": //Ours to handle
+	case "USER":
+		g.registration = append(g.registration, line)
+		g.writeUpstream(line)
+	case "NICK":
+		if g.ready {
+			g.writeUpstream(line)
+		} else {
+			g.registration = append(g.registration, line)
+			g.writeUpstream(line)
+		}
+	case "JOIN":
+		//Remembered so we can rejoin, and sent once we're ready
+		if len(params) > 0 {
+			key := ""
+			if len(params) > 1 {
+				key = params[1]
+			}
+			g.channels[params[0]] = key
+		}
+		if g.ready {
+			g.writeUpstream(line)
+		}
+	case "PART":
+		if len(params) > 0 {
+			delete(g.channels, params[0])
+		}
+		g.writeUpstream(line)
+	default:
+		g.writeUpstream(line)
+	}
+}
+
+//Drive the authentication exchange.  Returns true if line was part of it
+//and shouldn't be passed on to the bot.
+func (g *ircGateway) handleAuth(prefix, command string, params []string, line string) bool {
+	switch command {
+	case "CAP":
+		if len(params) < 3 {
+			return true
+		}
+		switch params[1] {
+		case "LS":
+			if params[2] == "*" && len(params) > 3 { //More to come
+				g.lock.Lock()
+				g.offered = append(g.offered, strings.Fields(params[3])...)
+				g.lock.Unlock()
+				return true
+			}
+			g.lock.Lock()
+			g.offered = append(g.offered, strings.Fields(params[2])...)
+			want := g.wantedCaps()
+			g.lock.Unlock()
+
+			if len(want) == 0 {
+				g.sendUpstream("CAP END")
+			} else {
+				g.sendUpstream("CAP REQ :" + strings.Join(want, " "))
+			}
+		case "ACK":
+			g.lock.Lock()
+			for _, c := range strings.Fields(params[2]) {
+				g.caps[strings.ToLower(c)] = true
+			}
+			sasl := g.caps["sasl"]
+			g.lock.Unlock()
+
+			switch {
+			case !sasl:
+				g.sendUpstream("CAP END")
+			case g.auth.Mechanism == AUTH_SASL_EXTERNAL:
+				g.sendUpstream("AUTHENTICATE EXTERNAL")
+			default:
+				g.sendUpstream("AUTHENTICATE PLAIN")
+			}
+		case "NAK":
+			if strings.HasPrefix(g.auth.Mechanism, "sasl") {
+				logErr.Println("IRC server refused SASL, continuing unauthenticated")
+			}
+			g.sendUpstream("CAP END")
+		}
+		return true
+
+	case "421": //ERR_UNKNOWNCOMMAND, from servers without capabilities
+		return len(params) > 1 && params[1] == "CAP"
+
+	case "AUTHENTICATE":
+		if len(params) > 0 && params[0] == "+" {
+			if g.auth.Mechanism == AUTH_SASL_EXTERNAL {
+				g.sendUpstream("AUTHENTICATE +")
+			} else {
+				g.sendSASLPlain()
+			}
+		}
+		return true
+
+	case "900": //RPL_LOGGEDIN
+		logInfo.Printf("Logged in to IRC as %s\n", g.auth.Account)
+		if g.auth.Mechanism == AUTH_NICKSERV { //SASL waits for 001, we aren't registered yet
+			g.markReady()
+		}
+		return true
+
+	case "903": //RPL_SASLSUCCESS
+		g.sendUpstream("CAP END")
+		return true
+
+	case "902", "904", "905", "906", "908":
+		logErr.Printf("SASL authentication failed: %s\n", line)
+		g.sendUpstream("CAP END")
+		return true
+
+	case "001":
+		switch g.auth.Mechanism {
+		case AUTH_NICKSERV:
+			g.sendUpstream(fmt.Sprintf("PRIVMSG NickServ :IDENTIFY %s %s", g.auth.Account, g.password))
+
+			g.lock.Lock()
+			session := g.session
+			g.lock.Unlock()
+
+			time.AfterFunc(time.Duration(g.auth.IdentifyTimeout)*time.Second, func() {
+				g.lock.Lock()
+				waiting := !g.ready && g.session == session
+				g.lock.Unlock()
+				if waiting {
+					logErr.Println("NickServ didn't confirm identification in time, joining anyway")
+					g.markReadyIn(session)
+				}
+			})
+		default:
+			//SASL has already succeeded or failed by the time we're welcomed
+			g.markReady()
+		}
+
+	case "NOTICE":
+		if g.auth.Mechanism == AUTH_NICKSERV && strings.HasPrefix(strings.ToLower(prefix), "nickserv!") &&
+			len(params) > 1 && nickServSuccessRegex.MatchString(renderPlain(parseIRC(params[len(params)-1]))) {
+			g.markReady()
+		}
+	}
+
+	return false
+}
+
+//The capabilities to ask for out of those offered.  Callers must hold
+//g.lock.
+func (g *ircGateway) wantedCaps() []string {
+	offered := make(map[string]bool)
+	for _, c := range g.offered {
+		offered[strings.ToLower(strings.SplitN(c, "=", 2)[0])] = true
+	}
+
+	var want []string
+	sasl := strings.HasPrefix(g.auth.Mechanism, "sasl")
+	if sasl && !offered["sasl"] {
+		logErr.Println("IRC server doesn't offer SASL, continuing unauthenticated")
+	}
+	for _, c := range []string{"sasl", "account-tag", "extended-join", "account-notify"} {
+		if offered[c] && (c != "sasl" || sasl) {
+			want = append(want, c)
+		}
+	}
+	return want
+}
+
+//Keep track of the accounts people are logged in to.  Returns true if line
+//was meant for the gateway and shouldn't be passed on to the bot.
+func (g *ircGateway) handleAccounts(tags map[string]string, prefix, command string, params []string) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	nick := strings.ToLower(strings.SplitN(prefix, "!", 2)[0])
+	set := func(nick, account string) {
+		if account == "" || account == "*" || account == "0" {
+			delete(g.accounts, nick)
+		} else {
+			g.accounts[nick] = account
+		}
+	}
+
+	//With account-tag, every message from someone says which account
+	//they're in, if any
+	if account, ok := tags["account"]; ok {
+		set(nick, account)
+	} else if g.caps["account-tag"] && strings.Contains(prefix, "!") && (command == "PRIVMSG" || command == "NOTICE") {
+		set(nick, "")
+	}
+
+	switch command {
+	case "005": //RPL_ISUPPORT
+		for _, token := range params {
+			if token == "WHOX" {
+				g.whox = true
+			}
+		}
+
+	case "JOIN":
+		if g.caps["extended-join"] && len(params) > 1 {
+			set(nick, params[1])
+		}
+		if nick == strings.ToLower(g.nick) && g.whox && len(params) > 0 {
+			//Who's in the channel we've just joined, and their accounts
+			g.writeUpstream("WHO " + params[0] + " %tna," + gatewayWhoToken)
+		}
+
+	case "354": //RPL_WHOSPCRPL: us, token, nick, account
+		if len(params) == 4 && params[1] == gatewayWhoToken {
+			set(strings.ToLower(params[2]), params[3])
+			return true
+		}
+
+	case "ACCOUNT": //account-notify
+		if len(params) > 0 {
+			set(nick, params[0])
+		}
+		return true
+
+	case "NICK":
+		if len(params) > 0 {
+			account := g.accounts[nick]
+			delete(g.accounts, nick)
+			set(strings.ToLower(params[0]), account)
+		}
+
+	case "QUIT":
+		delete(g.accounts, nick)
+
+	case "PART", "KICK":
+		//Once they're out of sight we won't hear if they log out
+		if command == "KICK" && len(params) > 1 {
+			nick = strings.ToLower(params[1])
+		}
+		if len(g.present[nick]) == 0 {
+			delete(g.accounts, nick)
+		}
+	}
+
+	return false
+}
+
+//The account nick is logged in to, or "" if it isn't or we can't tell
+func ircAccount(nick string) string {
+	if gateway == nil {
+		return ""
+	}
+
+	gateway.lock.Lock()
+	defer gateway.lock.Unlock()
+	return gateway.accounts[strings.ToLower(nick)]
+}
+
+//Keep track of our nick and win back the configured one if someone (often
+//our own ghost from before a disconnect) has it.  Returns true if line
+//shouldn't be passed on to the bot, which always believes it has its
+//configured nick.
+func (g *ircGateway) handleNick(prefix, command string, params []string) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	switch command {
+	case "001":
+		g.registered = true
+		if len(params) > 0 {
+			g.nick = params[0]
+		}
+		if g.nick != g.conf.Nick {
+			g.regainNick(g.session)
+		}
+
+	case "433": //ERR_NICKNAMEINUSE
+		if len(params) > 1 && !g.registered {
+			//Still registering, take a stand-in for now and regain the
+			//real one once we're in
+			g.nick = params[1] + "_"
+			g.writeUpstream("NICK " + g.nick)
+		}
+		return true
+
+	case "NICK":
+		old := strings.SplitN(prefix, "!", 2)[0]
+		if old == g.nick && len(params) > 0 {
+			g.nick = params[0]
+			logInfo.Printf("IRC nick is now %s\n", g.nick)
+			return true
+		}
+	}
+
+	return false
+}
+
+//Keep track of who's in our channels, from NAMES replies, joins, parts,
+//kicks, quits and nick changes
+func (g *ircGateway) handlePresence(prefix, command string, params []string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	who := strings.SplitN(prefix, "!", 2)[0]
+	nick := strings.ToLower(who)
+	us := strings.ToLower(g.nick)
+
+	arrive := func(nick, channel string) {
+		if g.present[nick] == nil {
+			g.present[nick] = make(map[string]bool)
+		}
+		g.present[nick][strings.ToLower(channel)] = true
+	}
+	leave := func(nick, channel string) {
+		delete(g.present[nick], strings.ToLower(channel))
+		if len(g.present[nick]) == 0 {
+			delete(g.present, nick)
+		}
+	}
+
+	switch command {
+	case "353": //RPL_NAMREPLY: us, channel type, channel, names
+		if len(params) < 4 {
+			return
+		}
+		for _, name := range strings.Fields(params[3]) {
+			arrive(strings.ToLower(strings.TrimLeft(name, "~&@%+")), params[2])
+		}
+
+	case "JOIN":
+		if len(params) > 0 && nick != us { //We'll get NAMES for our own
+			arrive(nick, params[0])
+			go ircUserJoined(who, params[0])
+		}
+
+	case "PART", "KICK":
+		if len(params) == 0 {
+			return
+		}
+		if command == "KICK" {
+			if len(params) < 2 {
+				return
+			}
+			nick = strings.ToLower(params[1])
+		}
+		if nick != us {
+			//Only gone once they're in none of our channels
+			if leave(nick, params[0]); g.present[nick] == nil {
+				go ircUserLeft(nick)
+			}
+			return
+		}
+		for other := range g.present {
+			leave(other, params[0])
+		}
+
+	case "QUIT":
+		if g.present[nick] != nil {
+			delete(g.present, nick)
+			go ircUserLeft(nick)
+		}
+
+	case "NICK":
+		if len(params) > 0 && g.present[nick] != nil {
+			g.present[strings.ToLower(params[0])] = g.present[nick]
+			delete(g.present, nick)
+		}
+	}
+}
+
+//Whether nick is in any of the bot's IRC channels
+func ircNickPresent(nick string) bool {
+	if gateway == nil {
+		return false
+	}
+
+	gateway.lock.Lock()
+	defer gateway.lock.Unlock()
+	return len(gateway.present[strings.ToLower(nick)]) > 0
+}
+
+//Everyone else in the bot's IRC channels, by lowercased nick
+func ircPresentNicks() []string {
+	if gateway == nil {
+		return nil
+	}
+
+	gateway.lock.Lock()
+	defer gateway.lock.Unlock()
+	var nicks []string
+	for nick := range gateway.present {
+		if nick != strings.ToLower(gateway.nick) {
+			nicks = append(nicks, nick)
+		}
+	}
+	return nicks
+}
+
+//Callers must hold g.lock
+func (g *ircGateway) regainNick(session int) {
+	if g.auth.Mechanism != "" && g.password != "" {
+		g.writeUpstream(fmt.Sprintf("PRIVMSG NickServ :GHOST %s %s", g.conf.Nick, g.password))
+	}
+	g.writeUpstream("NICK " + g.conf.Nick)
+
+	time.AfterFunc(ircNickRetry, func() {
+		g.lock.Lock()
+		defer g.lock.Unlock()
+		if g.session == session && g.upstream != nil && g.nick != g.conf.Nick {
+			g.regainNick(session)
+		}
+	})
+}
+
+//Messages addressed to a stand-in nick are handed to the bot as though they
+//were addressed to its real one
+func (g *ircGateway) rewriteTarget(command string, params []string, line string) string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if (command == "PRIVMSG" || command == "NOTICE" || command == "001") && len(params) > 0 &&
+		params[0] == g.nick && g.nick != g.conf.Nick {
+		return strings.Replace(line, " "+command+" "+g.nick+" ", " "+command+" "+g.conf.Nick+" ", 1)
+	}
+
+	return line
+}
+
+//Send the PLAIN credentials, split into 400 byte chunks per the SASL spec
+func (g *ircGateway) sendSASLPlain() {
+	encoded := base64.StdEncoding.EncodeToString(
+		[]byte(g.auth.Account + "\x00" + g.auth.Account + "\x00" + g.password))
+
+	for len(encoded) >= 400 {
+		g.sendUpstream("AUTHENTICATE " + encoded[:400])
+		encoded = encoded[400:]
+	}
+
+	if encoded == "" {
+		encoded = "+"
+	}
+	g.sendUpstream("AUTHENTICATE " + encoded)
+}
+
+//Split the IRCv3 message tags off the front of a line
+func splitTags(line string) (map[string]string, string) {
+	if !strings.HasPrefix(line, "@") {
+		return nil, line
+	}
+
+	split := strings.SplitN(line[1:], " ", 2)
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(split[0], ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = unescapeTag(kv[1])
+		} else {
+			tags[kv[0]] = ""
+		}
+	}
+
+	if len(split) < 2 {
+		return tags, ""
+	}
+	return tags, strings.TrimLeft(split[1], " ")
+}
+
+var tagUnescaper = strings.NewReplacer(`\:`, ";", `\s`, " ", `\\`, `\`, `\r`, "\r", `\n`, "\n")
+
+func unescapeTag(value string) string {
+	return tagUnescaper.Replace(value)
+}
+
+//Split a raw IRC line into its prefix (without the ':'), command and
+//parameters, with any trailing parameter last.
+func parseIRCLine(line string) (prefix, command string, params []string) {
+	if strings.HasPrefix(line, ":") {
+		split := strings.SplitN(line[1:], " ", 2)
+		prefix = split[0]
+		if len(split) < 2 {
+			return
+		}
+		line = split[1]
+	}
+
+	var trailing string
+	hasTrailing := false
+	if i := strings.Index(line, " :"); i >= 0 {
+		trailing, hasTrailing = line[i+2:], true
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+
+	command = strings.ToUpper(fields[0])
+	params = fields[1:]
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+
+	return
+}
+
+func checkIRCAuth(auth ircAuth, ssl bool) error {
+	switch auth.Mechanism {
+	case "", AUTH_NICKSERV:
+	case AUTH_SASL_PLAIN:
+		if !ssl {
+			logErr.Println("IrcAuth: sasl-plain without SSL sends the password in the clear, consider enabling SSL")
+		}
+	case AUTH_SASL_EXTERNAL:
+		if !ssl {
+			return errors.New("IrcAuth: sasl-external requires SSL")
+		}
+		if auth.ClientCert == "" || auth.ClientKey == "" {
+			return errors.New("IrcAuth: sasl-external requires ClientCert and ClientKey")
+		}
+	default:
+		return errors.New("IrcAuth: unknown Mechanism " + auth.Mechanism)
+	}
+
+	return nil
+}
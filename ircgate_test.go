@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//An IRC server the gateway can be pointed at, handing each connection it
+//gets to the test
+type fakeIRC struct {
+	listener net.Listener
+	conns    chan *ircPeer
+}
+
+//One end of a conversation, read and written a line at a time
+type ircPeer struct {
+	conn net.Conn
+	in   *bufio.Reader
+}
+
+func newFakeIRC(t *testing.T) *fakeIRC {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeIRC{listener: listener, conns: make(chan *ircPeer, 4)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.conns <- &ircPeer{conn, bufio.NewReader(conn)}
+		}
+	}()
+	return f
+}
+
+func (f *fakeIRC) accept(t *testing.T) *ircPeer {
+	select {
+	case p := <-f.conns:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("the gateway never connected")
+		return nil
+	}
+}
+
+//Point conf at f and start a gateway for it, connecting a bot that sends
+//what ircbot would
+func (f *fakeIRC) start(t *testing.T, conf *Config) *ircPeer {
+	conf.IrcServer = "127.0.0.1"
+	conf.IrcPort = f.listener.Addr().(*net.TCPAddr).Port
+	if conf.Nick == "" {
+		conf.Nick = "MCBot"
+	}
+	applyDefaults(conf)
+
+	host, port, _, pass, err := ircDialParams(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pass == "" || pass == conf.Pass {
+		t.Fatalf("the bot was given %q to connect with", pass)
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot := &ircPeer{conn, bufio.NewReader(conn)}
+	bot.send("PASS " + pass)
+	bot.send("NICK " + conf.Nick)
+	bot.send("USER mcbot 0 * :mcbot")
+	bot.send("JOIN #mc")
+	return bot
+}
+
+func (p *ircPeer) send(line string) {
+	fmt.Fprintf(p.conn, "%s\r\n", line)
+}
+
+//Read lines until each of want has been seen as the start of one, in any
+//order.  Returns everything read.
+func (p *ircPeer) expect(t *testing.T, want ...string) []string {
+	t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var read []string
+	for len(want) > 0 {
+		line, err := p.in.ReadString('\n')
+		if err != nil {
+			t.Fatalf("still waiting for %q after %q: %s", want, read, err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		read = append(read, line)
+
+		for i, w := range want {
+			if strings.HasPrefix(line, w) {
+				want = append(want[:i], want[i+1:]...)
+				break
+			}
+		}
+	}
+	return read
+}
+
+func TestGatewayTurnsAwayStrangers(t *testing.T) {
+	f := newFakeIRC(t)
+	defer f.listener.Close()
+
+	conf := &Config{IrcServer: "127.0.0.1", IrcPort: f.listener.Addr().(*net.TCPAddr).Port, Nick: "MCBot"}
+	applyDefaults(conf)
+	host, port, _, pass, err := ircDialParams(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, first := range []string{"PASS wrong", "NICK intruder"} {
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stranger := &ircPeer{conn, bufio.NewReader(conn)}
+		stranger.send(first)
+		stranger.send("USER x 0 * :x")
+		stranger.send("PRIVMSG NickServ :help")
+		stranger.send("JOIN #mc")
+		stranger.send("QUIT")
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := stranger.in.ReadString('\n'); err == nil {
+			t.Errorf("%s: the gateway talked to a stranger", first)
+		}
+		conn.Close()
+	}
+
+	select {
+	case <-f.conns:
+		t.Fatal("the gateway connected upstream for a stranger")
+	default:
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bot := &ircPeer{conn, bufio.NewReader(conn)}
+	bot.send("NICK MCBot")
+	bot.send("PASS " + pass)
+	bot.send("USER mcbot 0 * :mcbot")
+
+	server := f.accept(t)
+	defer server.conn.Close()
+	server.expect(t, "NICK MCBot", "USER mcbot")
+}
+
+func TestGatewaySASLReconnectAndRegain(t *testing.T) {
+	f := newFakeIRC(t)
+	defer f.listener.Close()
+
+	bot := f.start(t, &Config{
+		Pass:    "serverpass",
+		IrcAuth: ircAuth{Mechanism: AUTH_SASL_PLAIN, Account: "mcbot", Password: "secret"},
+	})
+	defer bot.conn.Close()
+	creds := base64.StdEncoding.EncodeToString([]byte("mcbot\x00mcbot\x00secret"))
+
+	server := f.accept(t)
+	read := server.expect(t, "CAP LS 302", "PASS serverpass", "NICK MCBot", "USER mcbot")
+	if read[0] != "CAP LS 302" {
+		t.Errorf("CAP LS wasn't sent first: %q", read)
+	}
+	server.send(":irc.test CAP * LS * :multi-prefix sasl=PLAIN,EXTERNAL")
+	server.send(":irc.test CAP * LS :account-notify away-notify")
+	server.expect(t, "CAP REQ :sasl account-notify")
+	server.send(":irc.test CAP * ACK :sasl account-notify")
+	server.expect(t, "AUTHENTICATE PLAIN")
+	server.send("AUTHENTICATE +")
+	server.expect(t, "AUTHENTICATE "+creds)
+	server.send(":irc.test 900 MCBot MCBot!mcbot@host mcbot :You are now logged in")
+	server.send(":irc.test 903 MCBot :SASL authentication successful")
+	server.expect(t, "CAP END")
+	if ircOnline() {
+		t.Error("online before being welcomed")
+	}
+	server.send(":irc.test 001 MCBot :Welcome")
+	server.expect(t, "JOIN #mc")
+	bot.expect(t, ":irc.test 001 MCBot")
+	if !ircOnline() {
+		t.Error("not online once welcomed")
+	}
+
+	//The connection drops and our ghost still has the nick when we're back
+	server.conn.Close()
+	server = f.accept(t)
+	defer server.conn.Close()
+	server.expect(t, "CAP LS 302", "PASS serverpass", "NICK MCBot", "USER mcbot")
+	server.send(":irc.test 433 * MCBot :Nickname is already in use")
+	server.expect(t, "NICK MCBot_")
+	server.send(":irc.test CAP * LS :sasl")
+	server.expect(t, "CAP REQ :sasl")
+	server.send(":irc.test CAP * ACK :sasl")
+	server.expect(t, "AUTHENTICATE PLAIN")
+	server.send("AUTHENTICATE +")
+	server.expect(t, "AUTHENTICATE "+creds)
+	server.send(":irc.test 903 MCBot_ :SASL authentication successful")
+	server.expect(t, "CAP END")
+	server.send(":irc.test 001 MCBot_ :Welcome")
+	server.expect(t, "JOIN #mc", "PRIVMSG NickServ :GHOST MCBot secret", "NICK MCBot")
+
+	//The bot only ever hears about its configured nick
+	server.send(":MCBot_!mcbot@host NICK :MCBot")
+	server.send(":someone!x@y PRIVMSG MCBot :hello")
+	read = bot.expect(t, ":someone!x@y PRIVMSG MCBot :hello")
+	for _, line := range read {
+		if strings.Contains(line, "MCBot_") {
+			t.Errorf("the bot saw the stand-in nick: %q", line)
+		}
+	}
+}
+
+func TestGatewayNickServ(t *testing.T) {
+	f := newFakeIRC(t)
+	defer f.listener.Close()
+
+	bot := f.start(t, &Config{
+		Pass:    "secret",
+		IrcAuth: ircAuth{Mechanism: AUTH_NICKSERV, IdentifyTimeout: 1},
+	})
+	defer bot.conn.Close()
+
+	//Pass is the NickServ password here, not a server password
+	server := f.accept(t)
+	read := server.expect(t, "NICK MCBot", "USER mcbot")
+	for _, line := range read {
+		if strings.HasPrefix(line, "PASS") {
+			t.Errorf("sent %q", line)
+		}
+	}
+
+	//A server without capabilities carries on regardless
+	server.send(":irc.test 421 MCBot CAP :Unknown command")
+	server.send(":irc.test 001 MCBot :Welcome")
+	server.expect(t, "PRIVMSG NickServ :IDENTIFY MCBot secret")
+	server.send(":NickServ!services@irc.test NOTICE MCBot :You are now identified for MCBot.")
+	server.expect(t, "JOIN #mc")
+
+	//Services are down after a reconnect, so channels are joined once
+	//IdentifyTimeout is up
+	server.conn.Close()
+	server = f.accept(t)
+	defer server.conn.Close()
+	server.expect(t, "NICK MCBot", "USER mcbot")
+	server.send(":irc.test 001 MCBot :Welcome")
+	server.expect(t, "PRIVMSG NickServ :IDENTIFY MCBot secret")
+	start := time.Now()
+	server.expect(t, "JOIN #mc")
+	if waited := time.Since(start); waited < 500*time.Millisecond {
+		t.Errorf("joined after %v without being identified", waited)
+	}
+}
+
+func TestGatewayAccounts(t *testing.T) {
+	f := newFakeIRC(t)
+	defer f.listener.Close()
+
+	conf := &Config{}
+	bot := f.start(t, conf)
+	defer bot.conn.Close()
+	mungeConfig(conf)
+	defer setConfig(currentConfig())
+	setConfig(conf) //For the joins
+
+	server := f.accept(t)
+	defer server.conn.Close()
+	server.expect(t, "CAP LS 302", "NICK MCBot", "USER mcbot")
+	server.send(":irc.test CAP * LS :multi-prefix account-tag extended-join account-notify sasl")
+	server.expect(t, "CAP REQ :account-tag extended-join account-notify")
+	server.send(":irc.test CAP * ACK :account-tag extended-join account-notify")
+	server.expect(t, "CAP END")
+	server.send(":irc.test 001 MCBot :Welcome")
+	server.send(":irc.test 005 MCBot WHOX CHANTYPES=# :are supported by this server")
+	server.expect(t, "JOIN #mc")
+
+	//Everyone in the channel when we join, by WHOX
+	server.send(":MCBot!mcbot@host JOIN #mc * :mcbot")
+	server.expect(t, "WHO #mc %tna,152")
+	server.send(":irc.test 353 MCBot = #mc :MCBot alice @mallory")
+	server.send(":irc.test 354 MCBot 152 alice AliceAcct")
+	server.send(":irc.test 354 MCBot 152 mallory 0")
+	server.send(":irc.test 315 MCBot #mc :End of WHO list")
+
+	//Then as people come and go and log in and out
+	server.send(":bob!b@host JOIN #mc bobacct :Bob")
+	server.send(":carol!c@host JOIN #mc * :Carol")
+	server.send(":carol!c@host ACCOUNT carolacct")
+	server.send("@account=dave;time=2024-01-01T00:00:00.000Z :dave!d@host PRIVMSG MCBot :hi")
+	server.send(":dave!d@host NICK dave2")
+	read := bot.expect(t, ":dave!d@host NICK dave2")
+	for _, line := range read {
+		if strings.Contains(line, " 354 ") || strings.Contains(line, "ACCOUNT") ||
+			strings.HasPrefix(line, "@") || strings.Contains(line, "bobacct") {
+			t.Errorf("the bot was sent %q", line)
+		}
+	}
+	for _, want := range []string{":bob!b@host JOIN #mc", ":dave!d@host PRIVMSG MCBot :hi"} {
+		found := false
+		for _, line := range read {
+			found = found || line == want
+		}
+		if !found {
+			t.Errorf("the bot wasn't sent %q: %q", want, read)
+		}
+	}
+
+	for nick, want := range map[string]string{
+		"alice": "AliceAcct", "ALICE": "AliceAcct", "mallory": "", "bob": "bobacct",
+		"carol": "carolacct", "dave": "", "dave2": "dave",
+	} {
+		if got := ircAccount(nick); got != want {
+			t.Errorf("%s is logged in as %q, want %q", nick, got, want)
+		}
+	}
+
+	//Messages without an account tag are from someone logged out
+	server.send(":alice!a@host PRIVMSG #mc :hello")
+	server.send(":bob!b@host ACCOUNT *")
+	server.send(":carol!c@host PART #mc")
+	bot.expect(t, ":carol!c@host PART #mc")
+	for _, nick := range []string{"alice", "bob", "carol"} {
+		if got := ircAccount(nick); got != "" {
+			t.Errorf("%s still logged in as %q", nick, got)
+		}
+	}
+}
+
+func TestGatewayDepartures(t *testing.T) {
+	withTestConfig(t, nil)
+	g := &ircGateway{nick: "MCBot", present: make(map[string]map[string]bool)}
+	for _, line := range []string{
+		":irc.test 353 MCBot = #mc :MCBot alice bob carol dave",
+		":irc.test 353 MCBot = #staff :MCBot @alice dave",
+		":alice!a@host PART #mc",
+		":op!o@host KICK #staff dave :bye",
+		":bob!b@host PART #mc",
+		":op!o@host KICK #mc dave :bye",
+		":carol!c@host QUIT :gone",
+	} {
+		prefix, command, params := parseIRCLine(line)
+		g.handlePresence(prefix, command, params)
+	}
+
+	left := func(nick string) bool {
+		departuresLock.Lock()
+		defer departuresLock.Unlock()
+		_, ok := departures[nick]
+		return ok
+	}
+	for _, nick := range []string{"bob", "carol", "dave"} {
+		for i := 0; !left(nick); i++ {
+			if i == 100 {
+				t.Fatalf("%s's departure wasn't noted", nick)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	//Still in #staff
+	if left("alice") || !g.present["alice"]["#staff"] {
+		t.Errorf("alice left one channel of two, and was taken as gone: %v", g.present)
+	}
+}
+
+func TestSplitTags(t *testing.T) {
+	tags, line := splitTags(`@account=a\sb\:c;draft/x :n!u@h PRIVMSG #c :hi`)
+	if want := map[string]string{"account": "a b;c", "draft/x": ""}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags %v, want %v", tags, want)
+	}
+	if line != ":n!u@h PRIVMSG #c :hi" {
+		t.Errorf("line %q", line)
+	}
+	if tags, line = splitTags(":n!u@h QUIT"); tags != nil || line != ":n!u@h QUIT" {
+		t.Errorf("untagged line became %v %q", tags, line)
+	}
+}
+
+func TestNickServSuccess(t *testing.T) {
+	for notice, ok := range map[string]bool{
+		"You are now identified for \x02MCBot\x02.":                                      true,
+		"Password accepted - you are now recognized.":                                    true,
+		"You are now logged in as MCBot.":                                                true,
+		"You are not identified.":                                                        false,
+		"This nickname is registered. You must be identified to use it.":                 false,
+		"Invalid password for \x02MCBot\x02.":                                            false,
+		"\x02MCBot\x02 is not a registered nickname, you are now identified for nothing": false,
+	} {
+		if got := nickServSuccessRegex.MatchString(renderPlain(parseIRC(notice))); got != ok {
+			t.Errorf("%q: success %v", notice, got)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Links between chat identities and Minecraft players, so one person's
+//permissions follow them between chat and the game.  A link is asked for
+//from chat with 'link <player>', which gives a one time code the player then
+//confirms in game with 'link <code>'.
+
+//A chat identity, e.g. irc:cbeck, linked to a player
+type accountLink struct {
+	Player   string
+	Identity string
+	Since    time.Time
+}
+
+//A link waiting to be confirmed in game
+type pendingLink struct {
+	player   string
+	identity string
+	expires  time.Time
+}
+
+const (
+	linksFile = "links.json"
+
+	LinkCodeLength  = 6
+	LinkCodeTimeout = 10 //Minutes a code can be confirmed within
+
+	linkCodeChars = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" //No 0/O or 1/I to mix up
+)
+
+var (
+	links        map[string]accountLink         //By lowercased player, loaded on first use
+	pendingLinks = make(map[string]pendingLink) //By code
+	linksLock    sync.Mutex
+)
+
+//Must be called with linksLock held
+func loadLinks() {
+	if links != nil {
+		return
+	}
+
+	links = make(map[string]accountLink)
+	if err := loadData(linksFile, &links); err != nil {
+		logErr.Printf("Couldn't read %s: %s\n", linksFile, err)
+	}
+}
+
+//Must be called with linksLock held
+func saveLinks() {
+	if err := saveData(linksFile, links); err != nil {
+		logErr.Printf("Couldn't save %s: %s\n", linksFile, err)
+	}
+}
+
+func newLinkCode() (string, error) {
+	raw := make([]byte, LinkCodeLength)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	code := make([]byte, LinkCodeLength)
+	for i, b := range raw {
+		code[i] = linkCodeChars[int(b)%len(linkCodeChars)]
+	}
+	return string(code), nil
+}
+
+//Start linking identity to player, returning the code player must confirm
+//with
+func requestLink(identity, player string) (string, error) {
+	code, err := newLinkCode()
+	if err != nil {
+		return "", err
+	}
+
+	linksLock.Lock()
+	defer linksLock.Unlock()
+
+	for c, p := range pendingLinks { //One request at a time, and clear out stale ones
+		if strings.EqualFold(p.identity, identity) || time.Now().After(p.expires) {
+			delete(pendingLinks, c)
+		}
+	}
+	pendingLinks[code] = pendingLink{player, identity, time.Now().Add(LinkCodeTimeout * time.Minute)}
+	return code, nil
+}
+
+//player has typed code in game.  Returns the identity now linked to them.
+func confirmLink(player, code string) (string, error) {
+	linksLock.Lock()
+	defer linksLock.Unlock()
+
+	code = strings.ToUpper(code)
+	p, ok := pendingLinks[code]
+	if !ok || time.Now().After(p.expires) || !strings.EqualFold(p.player, player) {
+		return "", fmt.Errorf("That code isn't valid for %s.", player)
+	}
+	delete(pendingLinks, code)
+
+	loadLinks()
+	for key, l := range links { //Each identity links to one player
+		if strings.EqualFold(l.Identity, p.identity) {
+			delete(links, key)
+		}
+	}
+	links[strings.ToLower(player)] = accountLink{player, p.identity, time.Now()}
+	saveLinks()
+	return p.identity, nil
+}
+
+//Remove whatever link identity is part of, returning whether there was one
+func unlink(identity string) bool {
+	linksLock.Lock()
+	defer linksLock.Unlock()
+
+	loadLinks()
+	found := false
+	for key, l := range links {
+		if strings.EqualFold(l.Identity, identity) || strings.EqualFold("mc:"+l.Player, identity) {
+			delete(links, key)
+			found = true
+		}
+	}
+	if found {
+		saveLinks()
+	}
+	return found
+}
+
+//The link identity is part of, from either end
+func findLink(identity string) (accountLink, bool) {
+	linksLock.Lock()
+	defer linksLock.Unlock()
+
+	loadLinks()
+	if strings.HasPrefix(strings.ToLower(identity), "mc:") {
+		l, ok := links[strings.ToLower(identity[3:])]
+		return l, ok
+	}
+	for _, l := range links {
+		if strings.EqualFold(l.Identity, identity) {
+			return l, true
+		}
+	}
+	return accountLink{}, false
+}
+
+//identities, plus whatever each is linked to
+func withLinks(identities []string) []string {
+	all := append([]string{}, identities...)
+	for _, identity := range identities {
+		if l, ok := findLink(identity); ok {
+			if strings.HasPrefix(strings.ToLower(identity), "mc:") {
+				all = append(all, l.Identity)
+			} else {
+				all = append(all, "mc:"+l.Player)
+			}
+		}
+	}
+	return all
+}
+
+//player's name, with the chat identity they're linked to if any
+func showLinked(player string) string {
+	if l, ok := findLink("mc:" + player); ok {
+		return player + " (" + l.Identity + ")"
+	}
+	return player
+}
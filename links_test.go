@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLinksNeedAnAccount(t *testing.T) {
+	withTestConfig(t, &Config{AccessLevels: map[string]AccessLevel{"Mod": {Members: []string{"mc:Steve"}, Allowed: []string{"kick"}}}})
+	linksLock.Lock()
+	links = map[string]accountLink{"steve": {Player: "Steve", Identity: "irc:alice"}}
+	linksLock.Unlock()
+
+	//alice logged in to her account gets Steve's permissions, someone
+	//who's only taken her nick doesn't
+	verified := &command{identities: []string{"irc:alice"}, source: SOURCE_CHAT}
+	if !allowed(verified, "kick") {
+		t.Error("link not followed for a verified account")
+	}
+	impostor := &command{identities: []string{"irc:alice"}, source: SOURCE_CHAT, unverified: true}
+	if allowed(impostor, "kick") {
+		t.Error("link followed for an unverified nick")
+	}
+
+	for _, args := range [][]string{{}, {"Steve"}, {"remove"}} {
+		reply := linkCmd(impostor, args, new(bool))
+		if len(reply) != 1 || !strings.Contains(reply[0], "account") {
+			t.Errorf("link %v by an unverified nick: %q", args, reply)
+		}
+	}
+	if _, ok := findLink("irc:alice"); !ok {
+		t.Error("an unverified nick removed the link")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Private messages between chat and the game.  Messages for someone who isn't
+//around are kept as mail, and handed over when a player next joins or an IRC
+//user next speaks.  Anyone can take a nick, so IRC users are only handed
+//mail when logged in to the account it was sent to, and otherwise just told
+//it's there.
+
+//A message waiting for, or already delivered to, its recipient
+type mailMessage struct {
+	From string
+	Text string
+	Sent time.Time
+	Read bool
+}
+
+const (
+	mailFile  = "mail.json"
+	MailMax   = 50 //Messages kept per recipient before the oldest are dropped
+	MailDelay = 3  //Seconds after a player joins before their mail is delivered
+)
+
+var (
+	mailboxes map[string][]*mailMessage //By lowercased identity, e.g. mc:steve, loaded on first use
+	mailLock  sync.Mutex
+
+	//How much unread mail each IRC nick not logged in has been told about,
+	//so they're only told again when there's more
+	mailNoticed = make(map[string]int)
+)
+
+//Must be called with mailLock held
+func loadMail() {
+	if mailboxes != nil {
+		return
+	}
+
+	mailboxes = make(map[string][]*mailMessage)
+	if err := loadData(mailFile, &mailboxes); err != nil {
+		logErr.Printf("Couldn't read %s: %s\n", mailFile, err)
+	}
+}
+
+//Must be called with mailLock held
+func saveMail() {
+	if err := saveData(mailFile, mailboxes); err != nil {
+		logErr.Printf("Couldn't save %s: %s\n", mailFile, err)
+	}
+}
+
+//Leave text from from in to's mailbox
+func sendMail(to, from, text string) {
+	mailLock.Lock()
+	defer mailLock.Unlock()
+
+	loadMail()
+	to = strings.ToLower(to)
+	box := append(mailboxes[to], &mailMessage{From: from, Text: text, Sent: time.Now()})
+	if len(box) > MailMax {
+		box = box[len(box)-MailMax:]
+	}
+	mailboxes[to] = box
+	saveMail()
+}
+
+//Everything in identity's mailbox, oldest first.  If unread, only what
+//hasn't been read, which is then marked read.
+func readMail(identity string, unread bool) []mailMessage {
+	mailLock.Lock()
+	defer mailLock.Unlock()
+
+	loadMail()
+	var messages []mailMessage
+	changed := false
+	for _, msg := range mailboxes[strings.ToLower(identity)] {
+		if unread && msg.Read {
+			continue
+		}
+		messages = append(messages, *msg)
+		if unread {
+			msg.Read = true
+			changed = true
+		}
+	}
+
+	if changed {
+		saveMail()
+	}
+	return messages
+}
+
+//How many messages in identity's mailbox haven't been read
+func unreadMail(identity string) int {
+	mailLock.Lock()
+	defer mailLock.Unlock()
+
+	loadMail()
+	n := 0
+	for _, msg := range mailboxes[strings.ToLower(identity)] {
+		if !msg.Read {
+			n++
+		}
+	}
+	return n
+}
+
+//Empty identity's mailbox, returning how many messages were in it
+func clearMail(identity string) int {
+	mailLock.Lock()
+	defer mailLock.Unlock()
+
+	loadMail()
+	n := len(mailboxes[strings.ToLower(identity)])
+	if n > 0 {
+		delete(mailboxes, strings.ToLower(identity))
+		saveMail()
+	}
+	return n
+}
+
+func (msg mailMessage) String() string {
+	return fmt.Sprintf("From %s, %v ago: %s", msg.From, time.Since(msg.Sent)/time.Second*time.Second, msg.Text)
+}
+
+//Hand player their unread mail, now they've joined server.  Behind a proxy
+//that's the backend they joined, if the bot runs it.
+func (m *minecraft) deliverMail(player, server string) {
+	to := m
+	if m.config().Type != "" {
+		if to = findServer(server); to == nil || server == "" {
+			return
+		}
+	}
+
+	//Give them a moment to arrive, so it isn't lost among the join messages
+	time.Sleep(MailDelay * time.Second)
+	for _, msg := range readMail("mc:"+player, true) {
+		to.tell(player, "Mail: "+msg.String())
+	}
+}
+
+//Hand the sender of m, an IRC user, their unread mail now they've spoken.
+//If they aren't logged in to an account, only say that there's some.
+func deliverIRCMail(m *chatMessage) {
+	if m.account != "" {
+		for _, msg := range readMail(m.identity(), true) {
+			ircChat.Send(m.sender, toChat(ircChat, "Mail: "+msg.String()))
+		}
+		return
+	}
+
+	n := unreadMail(m.identity())
+	mailLock.Lock()
+	noticed := mailNoticed[strings.ToLower(m.sender)]
+	if n == 0 {
+		delete(mailNoticed, strings.ToLower(m.sender))
+	} else {
+		mailNoticed[strings.ToLower(m.sender)] = n
+	}
+	mailLock.Unlock()
+
+	if n > noticed {
+		ircChat.Send(m.sender, fmt.Sprintf("You have %d unread messages for %s, log in to your account to read them.",
+			n, m.identity()))
+	}
+}
+
+//Send reply to whoever ran cmd and nobody else, where the transport makes
+//that possible.  Returns what's left to reply with in the usual way.
+func replyPrivately(cmd *command, reply []string) []string {
+	switch {
+	case cmd.source == SOURCE_MC:
+		for _, s := range reply {
+			cmd.origin.tell(cmd.sender, s)
+		}
+		return nil
+	case cmd.source == SOURCE_CHAT && cmd.transport == chatTransport(ircChat):
+		for _, s := range reply {
+			ircChat.Send(cmd.sender, toChat(ircChat, s))
+		}
+		return nil
+	}
+	return reply
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ckolbeck/mcserver"
+)
+
+func TestMailForUnverified(t *testing.T) {
+	withTestConfig(t, nil)
+
+	sendMail("irc:Alice", "mc:Steve", "secret")
+	sendMail("irc:Alice", "mc:Steve", "another")
+
+	//Only an account can read it, so someone else on the nick can't
+	cmd := &command{identities: []string{"irc:alice"}, unverified: true, source: SOURCE_CHAT}
+	if reply := mailCmd(cmd, []string{"read"}, new(bool)); len(reply) != 1 || reply[0] != "Mail is kept for your account, log in to it first." {
+		t.Errorf("unverified read got %q", reply)
+	}
+
+	//Counting it leaves it unread
+	if n := unreadMail("irc:alice"); n != 2 {
+		t.Errorf("%d unread, want 2", n)
+	}
+	if n := unreadMail("irc:alice"); n != 2 {
+		t.Errorf("%d unread after counting, want 2", n)
+	}
+	if messages := readMail("irc:alice", true); len(messages) != 2 || messages[0].Text != "secret" {
+		t.Errorf("read %+v", messages)
+	}
+	if n := unreadMail("irc:alice"); n != 0 {
+		t.Errorf("%d unread after reading", n)
+	}
+}
+
+func TestTellIRCMail(t *testing.T) {
+	withTestConfig(t, nil)
+	defer func(g *ircGateway) { gateway = g }(gateway)
+	origin := &minecraft{Server: &mcserver.Server{In: make(chan string, 4)}, name: "survival"}
+	cmd := &command{sender: "Steve", identities: []string{"mc:Steve"}, source: SOURCE_MC, origin: origin, server: origin}
+
+	//Where the gateway knows bob's account, it's kept for that
+	gateway = &ircGateway{
+		accounts: map[string]string{"bob": "robert"},
+		present:  map[string]map[string]bool{"bob": {"#mc": true}},
+	}
+	tellCmd(cmd, []string{"Bob", "hello"}, new(bool))
+	if said := <-origin.In; said != "tell Steve Couldn't reach Bob on IRC, they'll get your message when they're next around." {
+		t.Errorf("told %q", said)
+	}
+	if n := unreadMail("irc:robert"); n != 1 {
+		t.Errorf("%d messages for bob's account", n)
+	}
+	if n := unreadMail("irc:bob"); n != 0 {
+		t.Errorf("%d messages for the account named bob", n)
+	}
+
+	//Otherwise there's only the nick to go by, and Steve's warned of that
+	gateway = nil
+	tellCmd(cmd, []string{"Bob", "hello"}, new(bool))
+	if said := <-origin.In; !strings.Contains(said, "kept for the IRC account Bob, which isn't necessarily") {
+		t.Errorf("told %q", said)
+	}
+	if n := unreadMail("irc:bob"); n != 1 {
+		t.Errorf("%d messages for the account named bob", n)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Bridges the server to a Matrix room using the client-server API: a long
+//polling /sync loop for incoming messages and m.room.message events out.
+
+const (
+	matrixSyncTimeout = 30 * time.Second
+	matrixMaxBackoff  = 5 * time.Minute
+)
+
+type matrixConfig struct {
+	Homeserver  string //Base URL, e.g. https://matrix.example.org
+	UserID      string //The bot's own user, e.g. @mcbot:example.org
+	AccessToken string
+	Room        string //Room ID or alias to bridge
+	Server      string //Server the room is bridged to, if not the first
+}
+
+var matrixChat *matrixTransport = &matrixTransport{}
+
+type matrixTransport struct {
+	conf   matrixConfig
+	client *http.Client
+	roomID string
+
+	lock   sync.Mutex
+	online bool
+	txn    int64
+}
+
+func (t *matrixTransport) Name() string {
+	return "matrix"
+}
+
+func (t *matrixTransport) Connect(conf *Config) error {
+	t.conf = conf.Matrix
+	t.conf.Homeserver = strings.TrimRight(t.conf.Homeserver, "/")
+	t.client = &http.Client{Timeout: matrixSyncTimeout + 30*time.Second}
+	t.txn = time.Now().UnixNano()
+
+	var joined struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := t.call("POST", "/join/"+url.PathEscape(t.conf.Room), struct{}{}, &joined); err != nil {
+		return err
+	}
+	t.roomID = joined.RoomID
+
+	go t.syncLoop()
+	return nil
+}
+
+func (t *matrixTransport) Send(room, text string) {
+	t.lock.Lock()
+	t.txn++
+	txn := t.txn
+	t.lock.Unlock()
+
+	content := map[string]string{"msgtype": "m.notice", "body": text}
+	path := fmt.Sprintf("/rooms/%s/send/m.room.message/mcbot%d", url.PathEscape(room), txn)
+
+	if err := t.call("PUT", path, content, nil); err != nil {
+		logErr.Printf("Matrix send failed: %s\n", err)
+	}
+}
+
+func (t *matrixTransport) Rooms(role string) []string {
+	if role == ROLE_CONSOLE || t.roomID == "" {
+		return nil
+	}
+	return []string{t.roomID}
+}
+
+func (t *matrixTransport) Accepts(room, role string) bool {
+	return role == ROLE_COMMANDS || room == t.roomID
+}
+
+func (t *matrixTransport) RoomServer(room string) string {
+	return t.conf.Server
+}
+
+func (t *matrixTransport) Online() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.online
+}
+
+func (t *matrixTransport) setOnline(online bool) {
+	t.lock.Lock()
+	was := t.online
+	t.online = online
+	t.lock.Unlock()
+
+	if online && !was {
+		go flushBacklog(t)
+	}
+}
+
+type matrixSync struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+	} `json:"rooms"`
+}
+
+type matrixEvent struct {
+	Type    string `json:"type"`
+	Sender  string `json:"sender"`
+	Content struct {
+		MsgType string `json:"msgtype"`
+		Body    string `json:"body"`
+	} `json:"content"`
+}
+
+func (t *matrixTransport) syncLoop() {
+	since := ""
+	backoff := time.Second
+
+	for {
+		query := url.Values{}
+		if since == "" {
+			//Skip the history, we only want what's said from now on
+			query.Set("filter", `{"room":{"timeline":{"limit":0}}}`)
+		} else {
+			query.Set("since", since)
+			query.Set("timeout", fmt.Sprint(int64(matrixSyncTimeout/time.Millisecond)))
+		}
+
+		var resp matrixSync
+		if err := t.call("GET", "/sync?"+query.Encode(), nil, &resp); err != nil {
+			t.setOnline(false)
+			logErr.Printf("Matrix sync failed: %s, retrying in %v\n", err, backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > matrixMaxBackoff {
+				backoff = matrixMaxBackoff
+			}
+			continue
+		}
+
+		backoff = time.Second
+		t.setOnline(true)
+
+		if since != "" {
+			for roomID, room := range resp.Rooms.Join {
+				for _, event := range room.Timeline.Events {
+					t.handleEvent(roomID, event)
+				}
+			}
+		}
+		since = resp.NextBatch
+	}
+}
+
+func (t *matrixTransport) handleEvent(roomID string, event matrixEvent) {
+	if event.Type != "m.room.message" || event.Sender == t.conf.UserID {
+		return
+	}
+
+	m := &chatMessage{
+		transport: t,
+		room:      roomID,
+		sender:    matrixLocalpart(event.Sender),
+		account:   event.Sender, //The homeserver vouches for this
+		text:      event.Content.Body,
+	}
+
+	switch event.Content.MsgType {
+	case "m.text":
+	case "m.emote":
+		m.action = true
+	default: //Images, notices from other bots and so on
+		return
+	}
+
+	attn := currentConfig().AttnChar
+	if !m.action && strings.HasPrefix(m.text, attn) {
+		m.directed = true
+		m.text = strings.TrimPrefix(m.text, attn)
+	}
+
+	handleChat(m)
+}
+
+//@alice:example.org -> alice
+func matrixLocalpart(userID string) string {
+	return strings.SplitN(strings.TrimPrefix(userID, "@"), ":", 2)[0]
+}
+
+//Make a client-server API request.  body and result are JSON encoded and
+//decoded, either may be nil.
+func (t *matrixTransport) call(method, path string, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequest(method, t.conf.Homeserver+"/_matrix/client/v3"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.conf.AccessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var matrixErr struct {
+			ErrCode string `json:"errcode"`
+			Error   string `json:"error"`
+		}
+		json.Unmarshal(raw, &matrixErr)
+		return fmt.Errorf("%s %s: %s %s %s", method, strings.SplitN(path, "?", 2)[0],
+			resp.Status, matrixErr.ErrCode, matrixErr.Error)
+	}
+
+	if result != nil {
+		return json.Unmarshal(raw, result)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMatrixRoom = "!room:example.org"
+
+//A homeserver with one room, which hands out a batch of messages on the
+//first incremental sync and records what's sent to it
+type fakeHomeserver struct {
+	t     *testing.T
+	sent  chan map[string]string
+	txns  chan string
+	done  chan struct{}
+	syncs chan string
+}
+
+func (h *fakeHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer sekrit" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Invalid access token"}`))
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/client/v3")
+	switch {
+	case r.Method == "POST" && path == "/join/#mc:example.org":
+		w.Write([]byte(`{"room_id":"` + testMatrixRoom + `"}`))
+
+	case r.Method == "GET" && path == "/sync":
+		since := r.URL.Query().Get("since")
+		h.syncs <- since
+		switch since {
+		case "":
+			if r.URL.Query().Get("filter") == "" {
+				h.t.Error("initial sync without a filter")
+			}
+			w.Write([]byte(`{"next_batch":"s1","rooms":{"join":{"` + testMatrixRoom + `":{"timeline":{"events":[
+				{"type":"m.room.message","sender":"@old:example.org","content":{"msgtype":"m.text","body":"!history"}}]}}}}}`))
+		case "s1":
+			w.Write([]byte(`{"next_batch":"s2","rooms":{"join":{"` + testMatrixRoom + `":{"timeline":{"events":[
+				{"type":"m.room.member","sender":"@bob:example.org","content":{}},
+				{"type":"m.room.message","sender":"@mcbot:example.org","content":{"msgtype":"m.text","body":"!echo"}},
+				{"type":"m.room.message","sender":"@otherbot:example.org","content":{"msgtype":"m.notice","body":"!notice"}},
+				{"type":"m.room.message","sender":"@alice:example.org","content":{"msgtype":"m.text","body":"!list"}}]}}}}}`))
+		default:
+			select {
+			case <-h.done:
+			case <-r.Context().Done():
+			}
+			w.Write([]byte(`{"next_batch":"` + since + `"}`))
+		}
+
+	case r.Method == "PUT" && strings.HasPrefix(path, "/rooms/"+testMatrixRoom+"/send/m.room.message/"):
+		var content map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&content); err != nil {
+			h.t.Error(err)
+		}
+		h.txns <- path[strings.LastIndex(path, "/")+1:]
+		h.sent <- content
+		w.Write([]byte(`{"event_id":"$1"}`))
+
+	default:
+		h.t.Errorf("unexpected %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	h := &fakeHomeserver{
+		t:     t,
+		sent:  make(chan map[string]string, 4),
+		txns:  make(chan string, 4),
+		done:  make(chan struct{}),
+		syncs: make(chan string, 16),
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	defer close(h.done)
+
+	defer func(s []*minecraft) { servers = s }(servers)
+	servers = []*minecraft{{name: "survival"}, {name: "creative"}}
+
+	conf := &Config{AttnChar: "!", Matrix: matrixConfig{
+		Homeserver:  srv.URL + "/",
+		UserID:      "@mcbot:example.org",
+		AccessToken: "sekrit",
+		Room:        "#mc:example.org",
+		Server:      "creative",
+	}}
+	withTestConfig(t, conf)
+
+	bad := &matrixTransport{}
+	badConf := *conf
+	badConf.Matrix.AccessToken = "wrong"
+	if err := bad.Connect(&badConf); err == nil || !strings.Contains(err.Error(), "M_UNKNOWN_TOKEN") {
+		t.Errorf("connecting with a bad token: %v", err)
+	}
+
+	m := &matrixTransport{}
+	if err := m.Connect(conf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"", "s1", "s2"} {
+		select {
+		case since := <-h.syncs:
+			if since != want {
+				t.Errorf("synced since %q, want %q", since, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no sync since %q", want)
+		}
+	}
+	if !m.Online() {
+		t.Error("not online after syncing")
+	}
+
+	//Only alice's message is a command: history, our own messages, other
+	//bots' notices and state events are all skipped
+	select {
+	case cmd := <-commands:
+		if cmd.raw != "list" || cmd.sender != "alice" || cmd.channel != testMatrixRoom || cmd.transport != m {
+			t.Errorf("got command %+v", cmd)
+		}
+		if want := []string{"matrix:@alice:example.org"}; !reflect.DeepEqual(cmd.identities, want) {
+			t.Errorf("identities %v, want %v", cmd.identities, want)
+		}
+		if cmd.server == nil || cmd.server.name != "creative" {
+			t.Errorf("the room's command went to %v", cmd.server)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no command from the sync")
+	}
+	select {
+	case cmd := <-commands:
+		t.Errorf("unexpected command %q from %s", cmd.raw, cmd.sender)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	//The room carries everything but the console, and commands are taken
+	//from anywhere
+	for role, want := range map[string][]string{
+		ROLE_RELAY:    {testMatrixRoom},
+		ROLE_ALERTS:   {testMatrixRoom},
+		ROLE_COMMANDS: {testMatrixRoom},
+		ROLE_CONSOLE:  nil,
+	} {
+		if got := m.Rooms(role); !reflect.DeepEqual(got, want) {
+			t.Errorf("rooms for %s: %v, want %v", role, got, want)
+		}
+	}
+	if !m.Accepts(testMatrixRoom, ROLE_RELAY) || m.Accepts("!dm:example.org", ROLE_RELAY) ||
+		!m.Accepts("!dm:example.org", ROLE_COMMANDS) {
+		t.Error("wrong rooms accepted")
+	}
+
+	m.Send(testMatrixRoom, "hello")
+	m.Send(testMatrixRoom, "again")
+	var txns []string
+	for _, want := range []string{"hello", "again"} {
+		select {
+		case content := <-h.sent:
+			if content["msgtype"] != "m.notice" || content["body"] != want {
+				t.Errorf("sent %v, want %q", content, want)
+			}
+			txns = append(txns, <-h.txns)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q never sent", want)
+		}
+	}
+	if txns[0] == txns[1] {
+		t.Errorf("transaction ID %s reused", txns[0])
+	}
+}
@@ -10,23 +10,17 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"github.com/ckolbeck/ircbot"
-	"github.com/ckolbeck/mcserver"
 	"log"
 	"os"
 	"os/exec"
 )
 
 var (
-	bot     *ircbot.Bot
-	server  *mcserver.Server
-	config  *Config
 	logErr  *log.Logger = log.New(os.Stderr, "[E] ", log.Ldate|log.Ltime)
 	logInfo *log.Logger = log.New(os.Stdout, "[I] ", log.Ldate|log.Ltime)
 )
 
 func main() {
-	var err error
 	defer func() {
 		if x := recover(); x != nil {
 			fmt.Fprintf(os.Stderr, "Fatal error: %s\nExiting.", x)
@@ -35,27 +29,33 @@ func main() {
 	}()
 
 	confFile := flag.String("c", "./mcbot.conf", "The location of the configuration file to be used.")
+	convertTo := flag.String("convert", "", "Convert the configuration file to json, toml or yaml and exit.")
 	flag.Parse()
 
-	if config, err = ReadConfig(*confFile); err != nil {
-		fmt.Fprintf(os.Stderr, "%s\n", err)
+	if *convertTo != "" {
+		target, err := convertConfig(*confFile, *convertTo)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %s\n", target)
+		return
 	}
 
-	if bot, err = ircbot.NewBot(config.Nick, config.Pass, config.IrcDomain, config.IrcServer, config.IrcPort,
-		config.SSL, config.AttnChar[0]); err != nil {
+	conf, err := ReadConfig(*confFile)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 	}
+	setConfig(conf)
 
-	if server, err = mcserver.NewServer(config.MCServerCommand.Command, config.MCServerCommand.Args,
-		config.MCServerDir, logInfo, logErr); err != nil {
-		fmt.Fprintf(os.Stderr, "%s\n", err)
-	}
+	startServers(conf)
 
 	go commandDispatch()
 	go readConsoleInput()
-	go teeServerOutput()
-	bot.SetPrivmsgHandler(directedIRC, echoIRCToServer)
-	bot.JoinChannel(config.IrcChan, config.IrcChanKey)
+	go consoleWindows()
+	go sanctionScheduler()
+	connectTransports(conf)
+	scheduleFromConfig(conf)
 
 	select {}
 }
@@ -65,7 +65,7 @@ func copyWorld(worlddir, target string) error {
 	var args []string
 	var err error
 
-	switch config.HostOS {
+	switch currentConfig().HostOS {
 	case "linux":
 		cmd, err = exec.LookPath("rsync")
 		if err == nil {
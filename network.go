@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Keeps track of who is online where.  Behind a BungeeCord or Velocity proxy
+//players join, leave and move between backends on the proxy, so its console
+//is followed instead of the backends'.  Standalone servers are followed
+//through their own login and logout lines.
+
+const (
+	PROXY_BUNGEECORD = "bungeecord"
+	PROXY_VELOCITY   = "velocity"
+)
+
+var (
+	loginRegex  *regexp.Regexp = regexp.MustCompile(`INFO\]:? ([a-zA-Z0-9_]+) ?\[[^\]]*\] logged in with entity id`)
+	logoutRegex *regexp.Regexp = regexp.MustCompile(`INFO\]:? ([a-zA-Z0-9_]+) lost connection`)
+
+	//[Steve] or, from older versions, [/1.2.3.4:5678|Steve] and [Steve,/1.2.3.4:5678]
+	bungeeConnectRegex    *regexp.Regexp = regexp.MustCompile(`\[(?:[^\]|]*\|)?([a-zA-Z0-9_]+)(?:,[^\]]*)?\] <-> ServerConnector \[([^\]]+)\] has connected`)
+	bungeeDisconnectRegex *regexp.Regexp = regexp.MustCompile(`\[(?:[^\]|]*\|)?([a-zA-Z0-9_]+)(?:,[^\]]*)?\] -> UpstreamBridge has disconnected`)
+
+	velocityConnectRegex    *regexp.Regexp = regexp.MustCompile(`\[server connection\] ([a-zA-Z0-9_]+) -> (\S+) has connected`)
+	velocityDisconnectRegex *regexp.Regexp = regexp.MustCompile(`\[connected player\] ([a-zA-Z0-9_]+) \([^)]*\) has disconnected`)
+)
+
+//Where an online player is
+type presence struct {
+	name   string //As the server spells it
+	server string //The backend, for proxies
+	since  time.Time
+}
+
+//Where and when a player was last seen
+type seenEntry struct {
+	Name   string
+	Server string
+	Last   time.Time
+}
+
+const seenFile = "seen.json"
+
+var (
+	seen     map[string]seenEntry //By lowercased name, loaded on first use
+	seenLock sync.Mutex
+)
+
+//Follow players joining, switching servers and leaving
+func (m *minecraft) trackPlayers(line string) {
+	conf := m.config()
+	if conf.Proxy != "" { //Its proxy keeps track
+		return
+	}
+
+	connect, disconnect := loginRegex, logoutRegex
+	switch conf.Type {
+	case PROXY_BUNGEECORD:
+		connect, disconnect = bungeeConnectRegex, bungeeDisconnectRegex
+	case PROXY_VELOCITY:
+		connect, disconnect = velocityConnectRegex, velocityDisconnectRegex
+	}
+
+	if match := connect.FindStringSubmatch(line); match != nil {
+		where := m.name
+		if len(match) > 2 {
+			where = match[2]
+		}
+		m.joined(match[1], where)
+	} else if match := disconnect.FindStringSubmatch(line); match != nil {
+		m.left(match[1])
+	}
+}
+
+//player connected to server, which for a proxy may be a switch from another
+func (m *minecraft) joined(player, server string) {
+	m.playersLock.Lock()
+	p, switched := m.players[strings.ToLower(player)]
+	if switched {
+		p.server = server
+	} else {
+		m.players[strings.ToLower(player)] = &presence{player, server, time.Now()}
+	}
+	m.playersLock.Unlock()
+
+	noteSeen(player, server)
+	if !switched {
+		m.relayEvent(EVENT_JOIN, player, server)
+		go m.deliverMail(player, server)
+	}
+}
+
+func (m *minecraft) left(player string) {
+	if m.forget(player) {
+		m.relayEvent(EVENT_LEAVE, player, "")
+	}
+}
+
+//Take player off the online list, returning whether they were on it
+func (m *minecraft) forget(player string) bool {
+	m.playersLock.Lock()
+	p, ok := m.players[strings.ToLower(player)]
+	delete(m.players, strings.ToLower(player))
+	m.playersLock.Unlock()
+
+	if ok {
+		noteSeen(p.name, p.server)
+	}
+	return ok
+}
+
+//Everyone leaves when the server goes down, there's no need to announce it
+func (m *minecraft) clearPlayers() {
+	for _, p := range m.online() {
+		m.forget(p.name)
+	}
+}
+
+//Who's online, by name
+func (m *minecraft) online() []presence {
+	m.playersLock.Lock()
+	defer m.playersLock.Unlock()
+
+	var online []presence
+	for _, p := range m.players {
+		online = append(online, *p)
+	}
+	sort.Slice(online, func(i, j int) bool {
+		return strings.ToLower(online[i].name) < strings.ToLower(online[j].name)
+	})
+	return online
+}
+
+//Where player is, or nil if they're not online
+func (m *minecraft) find(player string) *presence {
+	m.playersLock.Lock()
+	defer m.playersLock.Unlock()
+
+	if p, ok := m.players[strings.ToLower(player)]; ok {
+		found := *p
+		return &found
+	}
+	return nil
+}
+
+//Whether player is online on m.  Behind a proxy, that's whether the proxy
+//has them connected to m.
+func (m *minecraft) playerOnline(player string) bool {
+	net := m.network()
+	if net == nil {
+		return m.find(player) != nil
+	}
+
+	p := net.find(player)
+	return p != nil && (net == m || strings.EqualFold(p.server, m.name))
+}
+
+//The running server player is playing on, and their name as it spells it,
+//or nil if they're not online anywhere the bot can reach them
+func playerServer(player string) (*minecraft, string) {
+	for _, m := range servers {
+		if m.config().Proxy != "" { //Its proxy knows better
+			continue
+		}
+		p := m.find(player)
+		if p == nil {
+			continue
+		}
+
+		target := m
+		if m.config().Type != "" {
+			target = findServer(p.server)
+		}
+		if target != nil && target.IsRunning() {
+			return target, p.name
+		}
+	}
+	return nil, ""
+}
+
+//The proxy m's players come through, m itself if it's a proxy, or nil for
+//a standalone server
+func (m *minecraft) network() *minecraft {
+	conf := m.config()
+	if conf.Type != "" {
+		return m
+	}
+	if conf.Proxy != "" {
+		return findServer(conf.Proxy)
+	}
+	return nil
+}
+
+//The servers behind proxy m
+func (m *minecraft) backends() []*minecraft {
+	var backends []*minecraft
+	for _, s := range servers {
+		if strings.EqualFold(s.config().Proxy, m.name) {
+			backends = append(backends, s)
+		}
+	}
+	return backends
+}
+
+//Send 'command target' to s, or if s is part of a proxied network to the
+//whole network: as the proxy's version of the command if it has one, or
+//else to every backend.  Servers which are stopped have bans and pardons
+//written straight to their ban lists instead.
+func networkSend(s *minecraft, command, target string) error {
+	net := s.network()
+	if net == nil {
+		return sendOrEdit(s, command, target)
+	}
+
+	if format := net.config().ProxyCommands[command]; format != "" {
+		if !net.IsRunning() {
+			return errors.New(net.name + " not currently running")
+		}
+		net.In <- fmt.Sprintf(format, target)
+		return nil
+	}
+
+	var firstErr error
+	for _, b := range net.backends() {
+		if err := sendOrEdit(b, command, target); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %s", b.name, err)
+		}
+	}
+	return firstErr
+}
+
+//Send 'command target' to m's console if it's running, or else, for bans
+//and pardons, make the change to its files
+func sendOrEdit(m *minecraft, command, target string) error {
+	if m.IsRunning() {
+		m.In <- command + " " + target
+		return nil
+	}
+
+	switch command {
+	case "ban", "ban-ip", "pardon", "pardon-ip":
+		return m.offlineBan(command, target)
+	}
+	return errors.New(m.name + " not currently running")
+}
+
+//list for a whole proxied network, grouped by backend
+func (m *minecraft) networkList() []string {
+	online := m.online()
+
+	var names []string
+	byServer := make(map[string][]string)
+	for _, p := range online {
+		if _, ok := byServer[p.server]; !ok {
+			names = append(names, p.server)
+		}
+		byServer[p.server] = append(byServer[p.server], showLinked(p.name))
+	}
+	sort.Strings(names)
+
+	reply := []string{fmt.Sprintf("There are %d players on the network.", len(online))}
+	for _, name := range names {
+		reply = append(reply, name+": "+strings.Join(byServer[name], ", "))
+	}
+	return reply
+}
+
+func noteSeen(player, server string) {
+	seenLock.Lock()
+	defer seenLock.Unlock()
+
+	loadSeen()
+	seen[strings.ToLower(player)] = seenEntry{player, server, time.Now()}
+	if err := saveData(seenFile, seen); err != nil {
+		logErr.Printf("Couldn't save %s: %s\n", seenFile, err)
+	}
+}
+
+//Must be called with seenLock held
+func loadSeen() {
+	if seen != nil {
+		return
+	}
+
+	seen = make(map[string]seenEntry)
+	if err := loadData(seenFile, &seen); err != nil {
+		logErr.Printf("Couldn't read %s: %s\n", seenFile, err)
+	}
+}
+
+//When and where player was last seen, if ever
+func lastSeen(player string) (seenEntry, bool) {
+	seenLock.Lock()
+	defer seenLock.Unlock()
+
+	loadSeen()
+	entry, ok := seen[strings.ToLower(player)]
+	return entry, ok
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+//How chat from the transports is shown in game, and what happens in game
+//is shown in chat.  Servers new enough to have tellraw get JSON text
+//components, so the sender's name can carry hover text and links can be
+//clicked; older ones get a plain say.
+
+//What Relay.Command may be set to
+const (
+	RELAY_AUTO    = "auto"
+	RELAY_TELLRAW = "tellraw"
+	RELAY_SAY     = "say"
+)
+
+//Things that happen in game which can be relayed to chat
+const (
+	EVENT_CHAT        = "chat"
+	EVENT_ACTION      = "action"
+	EVENT_JOIN        = "join"
+	EVENT_LEAVE       = "leave"
+	EVENT_DEATH       = "death"
+	EVENT_ADVANCEMENT = "advancement"
+	EVENT_START       = "start"
+	EVENT_STOP        = "stop"
+)
+
+//Default layouts for each event, given a gameEvent
+var defaultEventTemplates = map[string]string{
+	EVENT_CHAT:        "<{{.Player}}> {{.Message}}",
+	EVENT_ACTION:      "* {{.Player}} {{.Message}}",
+	EVENT_JOIN:        "{{.Player}} joined the game",
+	EVENT_LEAVE:       "{{.Player}} left the game",
+	EVENT_DEATH:       "§c{{.Message}}",
+	EVENT_ADVANCEMENT: "§a{{.Message}}",
+	EVENT_START:       "{{.Server}} is up{{if .Message}}, running {{.Message}}{{end}}",
+	EVENT_STOP:        "{{.Server}} is going down",
+}
+
+type relayConfig struct {
+	//tellraw, say, or auto (the default) for tellraw on servers which have it
+	Command string
+
+	//text/template layouts for a chat message, given a chatRelay.
+	//TellrawTemplate must produce a JSON text component.
+	SayTemplate     string
+	TellrawTemplate string
+
+	//Set by 'relay off' to stop relaying in either direction
+	Disabled bool
+
+	//How each kind of game event is shown in chat, and whether it is
+	Events map[string]relayEvent
+
+	//Players and chat users, by name or identity, whose messages aren't
+	//relayed
+	Muted []string
+}
+
+type relayEvent struct {
+	Template string //text/template layout, given a gameEvent
+	Disabled bool
+}
+
+//What event templates are given
+type gameEvent struct {
+	Event   string
+	Server  string
+	Player  string //If the event is about a player
+	Message string //What was said, the whole death or advancement message, version, or server joined
+}
+
+const defaultSayTemplate = `{{if .Action}}* {{.Sender}} {{.Text}}{{else}}<{{.Sender}}> {{.Text}}{{end}}`
+
+const defaultTellrawTemplate = `["",{{if .Action}}"* "{{else}}"<"{{end}},` +
+	`{"text":{{json .Sender}},"color":"aqua","hoverEvent":{"action":"show_text","value":{{json .Hover}}}},` +
+	`{{if .Action}}" "{{else}}"> "{{end}},{{.Message}}]`
+
+//What relay templates are given
+type chatRelay struct {
+	Sender    string //Display name
+	Account   string //The account the transport vouches for, if any
+	Transport string //irc, matrix or discord
+	Room      string
+	Hover     string //Where the message came from, for the sender's hover text
+	Action    bool   //A /me
+	Text      string //The message with its formatting as § codes
+	Message   string //The message as JSON text components, for tellraw
+}
+
+var relayTemplateFuncs = template.FuncMap{
+	//A value as a JSON string, quotes included
+	"json": func(v interface{}) (string, error) {
+		raw, err := json.Marshal(fmt.Sprint(v))
+		return string(raw), err
+	},
+}
+
+//The compiled forms of relayConfig's templates
+type relayTemplates struct {
+	say     *template.Template
+	tellraw *template.Template
+	events  map[string]*template.Template
+}
+
+func (c relayConfig) compile() (t relayTemplates, err error) {
+	switch c.Command {
+	case "", RELAY_AUTO, RELAY_TELLRAW, RELAY_SAY:
+	default:
+		return t, fmt.Errorf("Relay: unknown command %s", c.Command)
+	}
+
+	if t.say, err = template.New("SayTemplate").Funcs(relayTemplateFuncs).Parse(c.SayTemplate); err != nil {
+		return
+	}
+	if t.tellraw, err = template.New("TellrawTemplate").Funcs(relayTemplateFuncs).Parse(c.TellrawTemplate); err != nil {
+		return
+	}
+
+	t.events = make(map[string]*template.Template)
+	for event, e := range c.Events {
+		if _, known := defaultEventTemplates[event]; !known {
+			return t, fmt.Errorf("Relay: unknown event %s", event)
+		}
+		if t.events[event], err = template.New(event).Funcs(relayTemplateFuncs).Parse(e.Template); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//Fill in the event layouts that haven't been given
+func (c *relayConfig) applyDefaults() {
+	if c.Events == nil {
+		c.Events = make(map[string]relayEvent)
+	}
+	for event, layout := range defaultEventTemplates {
+		if e := c.Events[event]; e.Template == "" {
+			e.Template = layout
+			c.Events[event] = e
+		}
+	}
+}
+
+//Whether any of names is muted
+func (c *Config) relayMuted(names ...string) bool {
+	for _, name := range names {
+		if c.muted[strings.ToLower(name)] {
+			return true
+		}
+	}
+	return false
+}
+
+var mcVersionRegex *regexp.Regexp = regexp.MustCompile(`version (\d+)\.(\d+)|version (\d\d)w(\d\d)`)
+
+//Whether m is running a version with tellraw, which arrived in 1.7.2.
+//Unknown versions are assumed not to.
+func (m *minecraft) hasTellraw() bool {
+	match := mcVersionRegex.FindStringSubmatch(m.version)
+	if match == nil {
+		return false
+	}
+	if match[3] != "" { //A snapshot, 13w37a had it
+		year, _ := strconv.Atoi(match[3])
+		week, _ := strconv.Atoi(match[4])
+		return year > 13 || year == 13 && week >= 37
+	}
+
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	return major > 1 || minor >= 7
+}
+
+//Show chat from a transport in game
+func (m *minecraft) relayToGame(msg *chatMessage) {
+	conf := currentConfig()
+	if conf.Relay.Disabled || conf.relayMuted(msg.sender, msg.identity()) {
+		return
+	}
+	spans := chatSpans(msg.transport, msg.text)
+
+	data := chatRelay{
+		Sender:    stripFormatting(msg.sender),
+		Account:   msg.account,
+		Transport: msg.transport.Name(),
+		Room:      stripFormatting(msg.room),
+		Action:    msg.action,
+		Text:      renderLegacy(spans),
+	}
+	data.Hover = data.Transport + " " + data.Room
+	if data.Account != "" && data.Account != data.Sender {
+		data.Hover += "\n" + data.Account
+	}
+
+	relayCmd := conf.Relay.Command
+	if relayCmd == RELAY_TELLRAW || relayCmd == RELAY_AUTO && m.hasTellraw() {
+		data.Message = renderComponents(spans)
+
+		var out bytes.Buffer
+		if err := conf.relayTemplates.tellraw.Execute(&out, data); err != nil {
+			logErr.Printf("TellrawTemplate: %s\n", err)
+		} else if !json.Valid(out.Bytes()) {
+			logErr.Printf("TellrawTemplate didn't produce JSON: %s\n", out.String())
+		} else {
+			m.In <- "tellraw @a " + sanitizeRegex.ReplaceAllString(out.String(), " ")
+			return
+		}
+	}
+
+	var out bytes.Buffer
+	if err := conf.relayTemplates.say.Execute(&out, data); err != nil {
+		logErr.Printf("SayTemplate: %s\n", err)
+		return
+	}
+	m.say(out.String())
+}
+
+//The servers whose relay rooms hear about m's events: just m, unless it's a
+//proxy, in which case its backends' rooms too
+func (m *minecraft) relayServers() []*minecraft {
+	if m.config().Type != "" {
+		return append([]*minecraft{m}, m.backends()...)
+	}
+	return []*minecraft{m}
+}
+
+//Show something that happened in m's game in its relay rooms, if that kind
+//of event is relayed and player isn't muted
+func (m *minecraft) relayEvent(event, player, message string) {
+	conf := currentConfig()
+	if conf.Relay.Disabled || conf.Relay.Events[event].Disabled {
+		return
+	}
+	if player != "" && conf.relayMuted(player, "mc:"+player) {
+		return
+	}
+
+	var out bytes.Buffer
+	if err := conf.relayTemplates.events[event].Execute(&out, gameEvent{event, m.name, player, message}); err != nil {
+		logErr.Printf("Relay template for %s: %s\n", event, err)
+		return
+	}
+	text := sanitizeRegex.ReplaceAllString(out.String(), " ")
+	chat := event == EVENT_CHAT || event == EVENT_ACTION
+	remember(event, m.name, player, text)
+
+	for _, t := range transports {
+		var rooms []string
+		for _, s := range m.relayServers() {
+			rooms = append(rooms, s.rooms(t, ROLE_RELAY)...)
+		}
+
+		//Chat goes out under the player's own name where the transport can
+		//manage that
+		if pr, ok := t.(playerRelay); ok && chat && t.Online() && len(rooms) > 0 {
+			pr.SendAs(player, toChat(t, message), event == EVENT_ACTION)
+			continue
+		}
+
+		for _, room := range rooms {
+			sendTo(t, room, player, text)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEventTemplateDefaults(t *testing.T) {
+	c := relayConfig{Events: map[string]relayEvent{
+		EVENT_DEATH: {Template: "RIP {{.Player}}"},
+		EVENT_JOIN:  {Disabled: true},
+	}}
+	c.applyDefaults()
+
+	if len(c.Events) != len(defaultEventTemplates) {
+		t.Errorf("%d events after defaults, want %d", len(c.Events), len(defaultEventTemplates))
+	}
+	if c.Events[EVENT_DEATH].Template != "RIP {{.Player}}" {
+		t.Errorf("given death template replaced with %q", c.Events[EVENT_DEATH].Template)
+	}
+	if e := c.Events[EVENT_JOIN]; !e.Disabled || e.Template != defaultEventTemplates[EVENT_JOIN] {
+		t.Errorf("disabled join event became %+v", e)
+	}
+
+	//Every default renders as it should
+	c = relayConfig{}
+	c.applyDefaults()
+	templates, err := c.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		event, player, message, want string
+	}{
+		{EVENT_CHAT, "Steve", "hello", "<Steve> hello"},
+		{EVENT_ACTION, "Steve", "waves", "* Steve waves"},
+		{EVENT_JOIN, "Steve", "", "Steve joined the game"},
+		{EVENT_LEAVE, "Steve", "", "Steve left the game"},
+		{EVENT_DEATH, "Steve", "Steve drowned", "§cSteve drowned"},
+		{EVENT_ADVANCEMENT, "Steve", "Steve has made the advancement [Stone Age]", "§aSteve has made the advancement [Stone Age]"},
+		{EVENT_START, "", "1.20.4", "survival is up, running 1.20.4"},
+		{EVENT_START, "", "", "survival is up"},
+		{EVENT_STOP, "", "", "survival is going down"},
+	} {
+		var out bytes.Buffer
+		if err := templates.events[test.event].Execute(&out, gameEvent{test.event, "survival", test.player, test.message}); err != nil {
+			t.Errorf("%s: %s", test.event, err)
+		} else if out.String() != test.want {
+			t.Errorf("%s: got %q, want %q", test.event, out.String(), test.want)
+		}
+	}
+
+	for _, bad := range []map[string]relayEvent{
+		{"explode": {Template: "boom"}},
+		{EVENT_DEATH: {Template: "{{.Player"}},
+	} {
+		c := relayConfig{Events: bad}
+		c.applyDefaults()
+		if _, err := c.compile(); err == nil {
+			t.Errorf("%v compiled", bad)
+		}
+	}
+}
+
+func TestRelayEvent(t *testing.T) {
+	fake := &fakeTransport{}
+	defer func(s []*minecraft, ts []chatTransport) { servers, transports = s, ts }(servers, transports)
+	m := &minecraft{name: "survival"}
+	servers = []*minecraft{m}
+	transports = []chatTransport{fake}
+
+	withTestConfig(t, &Config{Relay: relayConfig{
+		Events: map[string]relayEvent{EVENT_JOIN: {Disabled: true}},
+		Muted:  []string{"Griefer"},
+	}})
+
+	m.relayEvent(EVENT_JOIN, "Steve", "")
+	m.relayEvent(EVENT_DEATH, "griefer", "griefer fell from a high place")
+	m.relayEvent(EVENT_DEATH, "Steve", "Steve drowned")
+	m.relayEvent(EVENT_START, "", "1.20.4")
+	want := []string{"#relay Steve drowned", "#relay survival is up, running 1.20.4"}
+	if got := fake.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Bans and kickbans the bot has handed out, with who issued them, why, and
+//when they run out.  They're kept on disk so a temporary ban is still lifted
+//on time if the bot restarts in between, and checked against the server's
+//own ban list whenever it starts, in case someone pardoned them by hand.
+
+//What a sanction can be
+const (
+	SANCTION_BAN     = "ban"
+	SANCTION_KICKBAN = "kickban"
+
+	SanctionCheckInterval = 30 //Seconds between checks for bans to lift
+)
+
+type sanction struct {
+	Target  string //Player or IP address
+	Kind    string
+	Reason  string
+	Issuer  string
+	Server  string //Where it was issued, which behind a proxy means the whole network
+	Issued  time.Time
+	Expires time.Time //Zero if it doesn't
+}
+
+const sanctionsFile = "sanctions.json"
+
+var (
+	sanctions     map[string]sanction //By key(), loaded on first use
+	sanctionsLock sync.Mutex
+)
+
+//Must be called with sanctionsLock held
+func loadSanctions() {
+	if sanctions != nil {
+		return
+	}
+
+	loaded := make(map[string]sanction)
+	if err := loadData(sanctionsFile, &loaded); err != nil {
+		logErr.Printf("Couldn't read %s: %s\n", sanctionsFile, err)
+	}
+
+	//Keyed afresh, as older files have the target alone and servers may
+	//have moved behind a proxy or out from one since
+	sanctions = make(map[string]sanction, len(loaded))
+	for _, s := range loaded {
+		if held, ok := sanctions[s.key()]; !ok || held.Issued.Before(s.Issued) {
+			sanctions[s.key()] = s
+		}
+	}
+}
+
+//Must be called with sanctionsLock held
+func saveSanctions() {
+	if err := saveData(sanctionsFile, sanctions); err != nil {
+		logErr.Printf("Couldn't save %s: %s\n", sanctionsFile, err)
+	}
+}
+
+//What a sanction is kept under: the network it covers, which is the proxy
+//server is behind or server alone, and its target
+func sanctionKey(server, target string) string {
+	network := server
+	if m := findServer(server); m != nil && m.network() != nil {
+		network = m.network().name
+	}
+	return strings.ToLower(network + ":" + target)
+}
+
+func (s sanction) key() string {
+	return sanctionKey(s.Server, s.Target)
+}
+
+//Record s, replacing whatever was held against its target on its network
+//before
+func impose(s sanction) {
+	sanctionsLock.Lock()
+	defer sanctionsLock.Unlock()
+
+	loadSanctions()
+	s.Issued = time.Now()
+	sanctions[s.key()] = s
+	saveSanctions()
+}
+
+//Forget whatever is held against target on m's network, returning whether
+//there was anything
+func forgive(m *minecraft, target string) bool {
+	sanctionsLock.Lock()
+	defer sanctionsLock.Unlock()
+
+	loadSanctions()
+	key := sanctionKey(m.name, target)
+	_, ok := sanctions[key]
+	if ok {
+		delete(sanctions, key)
+		saveSanctions()
+	}
+	return ok
+}
+
+//Whether s is still what's held against its target, rather than having been
+//lifted or replaced since it was read.  Must be called with sanctionsLock
+//held.
+func (s sanction) current() bool {
+	held, ok := sanctions[s.key()]
+	return ok && held.Issued.Equal(s.Issued)
+}
+
+//Forget s, if it's still current, returning whether it was
+func forget(s sanction) bool {
+	sanctionsLock.Lock()
+	defer sanctionsLock.Unlock()
+
+	loadSanctions()
+	if !s.current() {
+		return false
+	}
+	delete(sanctions, s.key())
+	saveSanctions()
+	return true
+}
+
+//Every recorded sanction, soonest to expire first and permanent ones last
+func allSanctions() []sanction {
+	sanctionsLock.Lock()
+	defer sanctionsLock.Unlock()
+
+	loadSanctions()
+	var all []sanction
+	for _, s := range sanctions {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].permanent() != all[j].permanent() {
+			return !all[i].permanent()
+		}
+		if !all[i].Expires.Equal(all[j].Expires) {
+			return all[i].Expires.Before(all[j].Expires)
+		}
+		return strings.ToLower(all[i].Target) < strings.ToLower(all[j].Target)
+	})
+	return all
+}
+
+func (s sanction) permanent() bool {
+	return s.Expires.IsZero()
+}
+
+func (s sanction) expired() bool {
+	return !s.permanent() && !time.Now().Before(s.Expires)
+}
+
+func (s sanction) ip() bool {
+	return net.ParseIP(s.Target) != nil
+}
+
+//The server s was issued on, or the default if that's gone
+func (s sanction) server() *minecraft {
+	if m := findServer(s.Server); m != nil {
+		return m
+	}
+	return findServer("")
+}
+
+//Whether a and b are the same server, or on the same proxied network
+func sameNetwork(a, b *minecraft) bool {
+	if a == b {
+		return true
+	}
+	proxy := a.network()
+	return proxy != nil && proxy == b.network()
+}
+
+//Pardon s on its server, through the console or its ban list if it's
+//stopped, and forget it.  Returns whether it could be lifted.  Nothing is
+//done if s was lifted or replaced since it was read, and the lock is held
+//throughout so a new ban can't come in between and be pardoned with it.
+func (s sanction) lift() bool {
+	m := s.server()
+	if m == nil {
+		return false
+	}
+
+	sanctionsLock.Lock()
+	loadSanctions()
+	if !s.current() {
+		sanctionsLock.Unlock()
+		return false
+	}
+
+	pardon := "pardon"
+	if s.ip() {
+		pardon = "pardon-ip"
+	}
+	if err := networkSend(m, pardon, s.Target); err != nil {
+		sanctionsLock.Unlock()
+		logErr.Printf("Couldn't lift %s on %s: %s\n", s.Kind, s.Target, err)
+		return false
+	}
+	delete(sanctions, s.key())
+	saveSanctions()
+	sanctionsLock.Unlock()
+
+	logInfo.Printf("Lifted %s on %s\n", s.Kind, s.Target)
+	m.alert(fmt.Sprintf("The %s on %s has run out and been lifted.", s.Kind, s.Target))
+	return true
+}
+
+//Lift temporary bans as they run out.  Those that can't be lifted yet, such
+//as when a proxy that has to do it is down, are lifted once it's back.
+func sanctionScheduler() {
+	for range time.Tick(SanctionCheckInterval * time.Second) {
+		for _, s := range allSanctions() {
+			if s.expired() {
+				s.lift()
+			}
+		}
+	}
+}
+
+//m has just started: lift whatever ran out while it was down, and forget
+//bans that are no longer on its ban list because they were pardoned some
+//other way
+func (m *minecraft) reconcileSanctions() {
+	//The proxy's own ban command keeps its list somewhere we can't read
+	checkList := m.config().Type == ""
+	if proxy := m.network(); proxy != nil && proxy.config().ProxyCommands["ban"] != "" {
+		checkList = false
+	}
+
+	for _, s := range allSanctions() {
+		if srv := s.server(); srv == nil || !sameNetwork(srv, m) {
+			continue
+		}
+
+		if s.expired() {
+			s.lift()
+			continue
+		}
+
+		if !checkList {
+			continue
+		}
+		banned, err := onBanList(m.config().MCServerDir, s.Target, s.ip())
+		if err != nil {
+			logErr.Printf("Couldn't read %s's ban list: %s\n", m.name, err)
+			continue
+		}
+		if !banned && forget(s) {
+			logInfo.Printf("%s isn't banned on %s any more, forgetting its %s\n", s.Target, m.name, s.Kind)
+		}
+	}
+}
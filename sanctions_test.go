@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStaleSanctionsLeftAlone(t *testing.T) {
+	defer func(s []*minecraft) { servers = s }(servers)
+	servers = []*minecraft{{name: "survival"}}
+	withTestConfig(t, nil)
+
+	impose(sanction{Target: "Griefer", Kind: SANCTION_BAN, Server: "survival", Expires: time.Now().Add(-time.Minute)})
+	old := allSanctions()[0]
+	time.Sleep(time.Millisecond)
+	impose(sanction{Target: "griefer", Kind: SANCTION_BAN, Server: "survival", Reason: "again"})
+
+	//The temporary ban ran out, but a permanent one replaced it meanwhile
+	if old.lift() {
+		t.Error("lifted a replaced ban")
+	}
+	if forget(old) {
+		t.Error("forgot a replaced ban")
+	}
+	all := allSanctions()
+	if len(all) != 1 || all[0].Reason != "again" {
+		t.Fatalf("left with %+v", all)
+	}
+	if !forget(all[0]) || len(allSanctions()) != 0 {
+		t.Error("couldn't forget the current ban")
+	}
+}
+
+func TestSanctionsPerNetwork(t *testing.T) {
+	defer func(s []*minecraft) { servers = s }(servers)
+	survival, creative := &minecraft{name: "survival"}, &minecraft{name: "creative"}
+	proxy := &minecraft{name: "proxy", conf: ServerConfig{Type: PROXY_VELOCITY}}
+	hub := &minecraft{name: "hub", conf: ServerConfig{Proxy: "proxy"}}
+	lobby := &minecraft{name: "lobby", conf: ServerConfig{Proxy: "proxy"}}
+	servers = []*minecraft{survival, creative, proxy, hub, lobby}
+	withTestConfig(t, nil)
+
+	//The same player banned on two servers of their own is two bans
+	impose(sanction{Target: "Griefer", Kind: SANCTION_BAN, Server: "survival"})
+	impose(sanction{Target: "griefer", Kind: SANCTION_BAN, Server: "creative", Reason: "there too"})
+	impose(sanction{Target: "Griefer", Kind: SANCTION_BAN, Server: "hub"})
+	if all := allSanctions(); len(all) != 3 {
+		t.Fatalf("left with %+v", all)
+	}
+
+	//Pardoning on one leaves the other alone
+	if !forgive(survival, "GRIEFER") {
+		t.Error("nothing forgiven on survival")
+	}
+	if forgive(survival, "griefer") {
+		t.Error("forgiven on survival twice")
+	}
+	all := allSanctions()
+	if len(all) != 2 || all[0].Server == "survival" || all[1].Server == "survival" {
+		t.Fatalf("left with %+v", all)
+	}
+	for _, s := range all {
+		if s.Server == "creative" && !forget(s) {
+			t.Error("couldn't forget the ban on creative")
+		}
+	}
+
+	//Behind a proxy, a ban anywhere is the network's
+	if !forgive(lobby, "griefer") || len(allSanctions()) != 0 {
+		t.Errorf("the hub's ban wasn't forgiven from the lobby: %+v", allSanctions())
+	}
+}
+
+func TestSanctionsRekeyed(t *testing.T) {
+	defer func(s []*minecraft) { servers = s }(servers)
+	servers = []*minecraft{{name: "survival"}, {name: "creative"}}
+	withTestConfig(t, nil)
+
+	//As kept before, by target alone
+	old := map[string]sanction{
+		"griefer": {Target: "Griefer", Kind: SANCTION_BAN, Server: "creative", Issued: time.Now()},
+	}
+	if err := saveData(sanctionsFile, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if forgive(servers[0], "griefer") {
+		t.Error("forgiven on survival")
+	}
+	if !forgive(servers[1], "griefer") {
+		t.Error("not forgiven on creative")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type intervalTask struct {
+	period time.Duration
+	stop   chan bool
+}
+
+var (
+	tasks     map[string]*intervalTask = make(map[string]*intervalTask)
+	tasksLock sync.Mutex
+)
+
+//Arrange for the command raw to be queued every period.  Scheduling a name
+//that is already scheduled replaces it, and a period <= 0 cancels it.
+//Commands are queued rather than called directly so they never race
+//interactive commands for server output.
+func schedule(name string, period time.Duration, raw string) {
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+
+	if task, exists := tasks[name]; exists {
+		if task.period == period {
+			return
+		}
+		close(task.stop)
+		delete(tasks, name)
+	}
+
+	if period <= 0 {
+		return
+	}
+
+	task := &intervalTask{period, make(chan bool)}
+	tasks[name] = task
+
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				commands <- &command{raw: raw, sender: "scheduler", source: SOURCE_INTERNAL}
+			case <-task.stop:
+				return
+			}
+		}
+	}()
+}
+
+//(Re)schedule the periodic jobs described by c, for each server.  Intervals
+//are in minutes.
+func scheduleFromConfig(c *Config) {
+	wanted := make(map[string]bool)
+
+	for _, s := range c.servers {
+		mapgenPeriod := time.Duration(s.MapUpdateInterval) * time.Minute
+		if s.MapUpdateCommand.Command == "" {
+			mapgenPeriod = 0
+		}
+		schedule("mapgen@"+s.Name, mapgenPeriod, "@"+s.Name+" mapgen")
+
+		wanted["mapgen@"+s.Name] = true
+	}
+
+	//Drop the jobs of servers which have gone from the config
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+	for name, task := range tasks {
+		if !wanted[name] {
+			close(task.stop)
+			delete(tasks, name)
+		}
+	}
+}
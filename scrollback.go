@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A record of what was relayed from the game lately, so people who weren't
+//watching can catch up with 'last', and IRC users coming back are told what
+//they missed.
+
+//One relayed event
+type scrollbackEntry struct {
+	Time   time.Time
+	Server string
+	Event  string
+	Player string
+	Text   string //As relayed, with § codes
+}
+
+//Events worth catching up on
+var scrollbackEvents = map[string]bool{
+	EVENT_CHAT:        true,
+	EVENT_ACTION:      true,
+	EVENT_JOIN:        true,
+	EVENT_LEAVE:       true,
+	EVENT_DEATH:       true,
+	EVENT_ADVANCEMENT: true,
+}
+
+const (
+	scrollbackFile = "scrollback.json"
+	departuresFile = "departures.json"
+
+	DefaultLastLines = 10 //Lines 'last' replies with when not told
+
+	//How long new events wait to be written out, so a busy chat isn't
+	//rewriting the whole file on every line
+	scrollbackSaveDelay = 30 * time.Second
+)
+
+var (
+	scrollback        []scrollbackEntry //Oldest first, loaded on first use
+	scrollbackPending bool              //A save is scheduled
+	scrollbackLock    sync.Mutex
+
+	departures     map[string]time.Time //When each IRC user, by lowercased nick, last left
+	departuresLock sync.Mutex
+)
+
+//Must be called with scrollbackLock held
+func loadScrollback() {
+	if scrollback != nil {
+		return
+	}
+
+	scrollback = []scrollbackEntry{}
+	if err := loadData(scrollbackFile, &scrollback); err != nil {
+		logErr.Printf("Couldn't read %s: %s\n", scrollbackFile, err)
+	}
+}
+
+//Remember an event that was relayed, dropping the oldest once there are
+//more than ScrollbackSize
+func remember(event, server, player, text string) {
+	if !scrollbackEvents[event] {
+		return
+	}
+
+	scrollbackLock.Lock()
+	defer scrollbackLock.Unlock()
+
+	loadScrollback()
+	scrollback = append(scrollback, scrollbackEntry{time.Now(), server, event, player, text})
+	if size := currentConfig().ScrollbackSize; len(scrollback) > size {
+		scrollback = scrollback[len(scrollback)-size:]
+	}
+
+	if !scrollbackPending {
+		scrollbackPending = true
+		time.AfterFunc(scrollbackSaveDelay, saveScrollback)
+	}
+}
+
+//Write out events remembered since the last save, if there are any
+func saveScrollback() {
+	scrollbackLock.Lock()
+	defer scrollbackLock.Unlock()
+
+	if !scrollbackPending {
+		return
+	}
+	scrollbackPending = false
+	if err := saveData(scrollbackFile, scrollback); err != nil {
+		logErr.Printf("Couldn't save %s: %s\n", scrollbackFile, err)
+	}
+}
+
+//The last n events involving player (or anyone, if it's empty) since the
+//given time, oldest first
+func recall(n int, player string, since time.Time) []scrollbackEntry {
+	scrollbackLock.Lock()
+	defer scrollbackLock.Unlock()
+
+	loadScrollback()
+	var found []scrollbackEntry
+	for i := len(scrollback) - 1; i >= 0 && len(found) < n; i-- {
+		e := scrollback[i]
+		if !e.Time.After(since) {
+			break
+		}
+		if player == "" || strings.EqualFold(e.Player, player) {
+			found = append(found, e)
+		}
+	}
+
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found
+}
+
+func (e scrollbackEntry) String() string {
+	stamp := e.Time.Format("15:04")
+	if time.Since(e.Time) > 24*time.Hour {
+		stamp = e.Time.Format("Jan 2 15:04")
+	}
+	if len(servers) > 1 {
+		stamp += " @" + e.Server
+	}
+	return "[" + stamp + "] " + e.Text
+}
+
+//Must be called with departuresLock held
+func loadDepartures() {
+	if departures != nil {
+		return
+	}
+
+	departures = make(map[string]time.Time)
+	if err := loadData(departuresFile, &departures); err != nil {
+		logErr.Printf("Couldn't read %s: %s\n", departuresFile, err)
+	}
+}
+
+//nick has left one of the bot's IRC channels
+func ircUserLeft(nick string) {
+	departuresLock.Lock()
+	defer departuresLock.Unlock()
+
+	loadDepartures()
+	departures[strings.ToLower(nick)] = time.Now()
+	if err := saveData(departuresFile, departures); err != nil {
+		logErr.Printf("Couldn't save %s: %s\n", departuresFile, err)
+	}
+}
+
+//nick has joined channel.  If they've been away long enough, and channel
+//relays the game, tell them what they missed.
+func ircUserJoined(nick, channel string) {
+	away := currentConfig().AwaySummary
+	if away <= 0 || !ircChat.Accepts(channel, ROLE_RELAY) {
+		return
+	}
+
+	departuresLock.Lock()
+	loadDepartures()
+	left, ok := departures[strings.ToLower(nick)]
+	departuresLock.Unlock()
+
+	if !ok || time.Since(left) < time.Duration(away)*time.Minute {
+		return
+	}
+
+	if summary := awaySummary(left); summary != "" {
+		ircChat.Send(nick, toChat(ircChat, summary))
+	}
+}
+
+//What happened in game since the given time, in a line
+func awaySummary(since time.Time) string {
+	events := recall(currentConfig().ScrollbackSize, "", since)
+	if len(events) == 0 {
+		return ""
+	}
+
+	var chat, deaths int
+	var speakers, joined []string
+	seen := make(map[string]bool)
+	for _, e := range events {
+		switch e.Event {
+		case EVENT_CHAT, EVENT_ACTION:
+			chat++
+			if !seen["chat "+e.Player] {
+				seen["chat "+e.Player] = true
+				speakers = append(speakers, e.Player)
+			}
+		case EVENT_DEATH:
+			deaths++
+		case EVENT_JOIN:
+			if !seen["join "+e.Player] {
+				seen["join "+e.Player] = true
+				joined = append(joined, e.Player)
+			}
+		}
+	}
+
+	var parts []string
+	if chat > 0 {
+		parts = append(parts, fmt.Sprintf("%d lines of chat from %s", chat, strings.Join(speakers, ", ")))
+	}
+	if len(joined) > 0 {
+		parts = append(parts, strings.Join(joined, ", ")+" joined")
+	}
+	if deaths > 0 {
+		parts = append(parts, fmt.Sprintf("%d deaths", deaths))
+	}
+	if len(parts) == 0 {
+		parts = append(parts, fmt.Sprintf("%d events", len(events)))
+	}
+
+	return fmt.Sprintf("While you were away (%v): %s.  Use %slast to catch up.",
+		time.Since(since)/time.Minute*time.Minute, strings.Join(parts, "; "), currentConfig().AttnChar)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestScrollbackSavesLater(t *testing.T) {
+	withTestConfig(t, &Config{ScrollbackSize: 2})
+
+	remember(EVENT_CHAT, "survival", "Steve", "<Steve> one")
+	remember(EVENT_START, "survival", "", "survival is up")
+	remember(EVENT_CHAT, "survival", "Steve", "<Steve> two")
+	remember(EVENT_CHAT, "survival", "Alex", "<Alex> three")
+	if _, err := os.Stat(dataFile(scrollbackFile)); !os.IsNotExist(err) {
+		t.Errorf("saved straight away: %v", err)
+	}
+	if got := recall(10, "steve", time.Time{}); len(got) != 1 || got[0].Text != "<Steve> two" {
+		t.Errorf("recalled %+v", got)
+	}
+
+	saveScrollback()
+	var saved []scrollbackEntry
+	if err := loadData(scrollbackFile, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 2 || saved[1].Text != "<Alex> three" {
+		t.Errorf("saved %+v", saved)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+var envRefRegex *regexp.Regexp = regexp.MustCompile(`\$\{(\w+)\}`)
+
+//A reference in the config and what it resolved to
+type secretRef struct {
+	ref      string
+	resolved string
+}
+
+//Replace ${ENV_VAR} and file:/path references in every string field of conf
+//with what they point at.  Returns the references by the path of the field
+//they were in, so WriteConfig can put them back in the same places.
+func resolveSecrets(conf *Config) (map[string]secretRef, error) {
+	refs := make(map[string]secretRef)
+
+	err := walkStrings(reflect.ValueOf(conf), "", func(path, s string) (string, error) {
+		resolved, err := resolveRef(s)
+		if err != nil {
+			return s, fmt.Errorf("%s: %s", path, err)
+		}
+
+		if resolved != s {
+			refs[path] = secretRef{ref: s, resolved: resolved}
+		}
+		return resolved, nil
+	})
+
+	return refs, err
+}
+
+func resolveRef(s string) (string, error) {
+	if strings.HasPrefix(s, "file:") {
+		file := strings.TrimPrefix(s, "file:")
+		warnIfWorldReadable(file)
+
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(raw), "\r\n"), nil
+	}
+
+	var err error
+	resolved := envRefRegex.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envRefRegex.FindStringSubmatch(ref)[1]
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			err = errors.New("environment variable " + name + " is not set")
+		}
+		return val
+	})
+
+	return resolved, err
+}
+
+//Swap resolved secrets in conf back to the references they were read from.
+//Only fields still holding what was resolved there are touched, so a value
+//that happens to match a secret elsewhere, or a secret that's been changed
+//from chat, is written as it is.  If a secret has gone from where it was
+//read but its value turns up somewhere else, as when an entry before it in a
+//list without names was removed, it's an error rather than risk writing it
+//out.
+func unresolveSecrets(conf *Config, refs map[string]secretRef) error {
+	if len(refs) == 0 {
+		return nil
+	}
+
+	values := make(map[string]string)
+	walkStrings(reflect.ValueOf(conf), "", func(path, s string) (string, error) {
+		values[path] = s
+		return s, nil
+	})
+	for path, ref := range refs {
+		if ref.resolved == "" || values[path] == ref.resolved {
+			continue
+		}
+		for elsewhere, s := range values {
+			if s == ref.resolved {
+				return fmt.Errorf("the secret read into %s is now in %s, not writing it out", path, elsewhere)
+			}
+		}
+	}
+
+	return walkStrings(reflect.ValueOf(conf), "", func(path, s string) (string, error) {
+		if ref, ok := refs[path]; ok && ref.resolved == s {
+			return ref.ref, nil
+		}
+		return s, nil
+	})
+}
+
+//Call f on every string reachable through the exported fields of v, storing
+//whatever it returns in place of the original.  path names the field for
+//error messages, and for telling secrets apart.  Entries of lists of named
+//things, such as IrcChannels, are known by name so the path stays the same
+//when entries before them come and go.
+func walkStrings(v reflect.Value, path string, f func(path, s string) (string, error)) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return walkStrings(v.Elem(), path, f)
+
+	case reflect.String:
+		s, err := f(path, v.String())
+		if err != nil {
+			return err
+		}
+		if v.CanSet() {
+			v.SetString(s)
+		}
+
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath != "" { //Unexported
+				continue
+			}
+			name := t.Field(i).Name
+			if path != "" {
+				name = path + "." + name
+			}
+			if err := walkStrings(v.Field(i), name, f); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			elem := fmt.Sprintf("%s[%d]", path, i)
+			if name := elemName(v.Index(i)); name != "" {
+				elem = fmt.Sprintf("%s[%q]", path, name)
+			}
+			if err := walkStrings(v.Index(i), elem, f); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		//Map values aren't addressable, so edit a copy and store it back
+		for _, key := range v.MapKeys() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			if err := walkStrings(elem, fmt.Sprintf("%s[%v]", path, key), f); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	}
+
+	return nil
+}
+
+//The Name of v, if it's a struct that has one
+func elemName(v reflect.Value) string {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	if name := v.FieldByName("Name"); name.IsValid() && name.Kind() == reflect.String {
+		return strings.ToLower(name.String())
+	}
+	return ""
+}
+
+//Complain if anyone on the box can read file.  Meaningless on windows.
+func warnIfWorldReadable(file string) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return
+	}
+
+	if info.Mode().Perm()&0004 != 0 {
+		logErr.Printf("%s is world readable, consider chmod o-r\n", file)
+	}
+}
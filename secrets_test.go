@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnresolveSecretsByPath(t *testing.T) {
+	os.Setenv("MCBOT_TEST_SECRET", "admin")
+	defer os.Unsetenv("MCBOT_TEST_SECRET")
+
+	conf := &Config{
+		Pass:         "${MCBOT_TEST_SECRET}",
+		AccessLevels: map[string]AccessLevel{"Admin": {Members: []string{"irc:cbeck"}}},
+	}
+	refs, err := resolveSecrets(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Pass != "admin" {
+		t.Fatalf("Pass resolved to %q", conf.Pass)
+	}
+
+	//Plain values that happen to match a secret stay as they are
+	conf.Ignore = []string{"admin"}
+	conf.AccessLevels["Admin"] = AccessLevel{Members: []string{"admin"}}
+	if err := unresolveSecrets(conf, refs); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Pass != "${MCBOT_TEST_SECRET}" {
+		t.Errorf("Pass is %q", conf.Pass)
+	}
+	if conf.Ignore[0] != "admin" || conf.AccessLevels["Admin"].Members[0] != "admin" {
+		t.Errorf("unrelated fields rewritten: %v %v", conf.Ignore, conf.AccessLevels)
+	}
+
+	//A secret changed since it was read is written as it now is, as long as
+	//its old value isn't anywhere it might be taken to have moved to
+	conf.Pass = "hunter2"
+	if err := unresolveSecrets(conf, refs); err == nil {
+		t.Error("old secret left in Ignore")
+	}
+	conf.Ignore = nil
+	conf.AccessLevels["Admin"] = AccessLevel{}
+	if err := unresolveSecrets(conf, refs); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Pass != "hunter2" {
+		t.Errorf("changed Pass is %q", conf.Pass)
+	}
+}
+
+func TestSecretsInShiftingLists(t *testing.T) {
+	os.Setenv("MCBOT_TEST_SECRET", "hunter2")
+	defer os.Unsetenv("MCBOT_TEST_SECRET")
+	withTestConfig(t, nil)
+
+	file := filepath.Join(t.TempDir(), "mcbot.yaml")
+	raw := `Nick: MCBot
+IrcChannels:
+  - {Name: "#public", Roles: [relay]}
+  - {Name: "#staff", Key: "${MCBOT_TEST_SECRET}", Roles: [alerts]}
+MCServerCommand:
+  Command: java
+  Args: [-Xmx2G, "${MCBOT_TEST_SECRET}"]
+`
+	if err := ioutil.WriteFile(file, []byte(raw), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := ReadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(conf)
+
+	//Channels are known by name, so the key follows #staff to the front
+	err = updateConfig(func(c *Config) error {
+		c.IrcChannels = c.IrcChannels[1:]
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, _ := ioutil.ReadFile(file)
+	if strings.Contains(string(written), "hunter2") || strings.Contains(string(written), "#public") {
+		t.Errorf("wrote:\n%s", written)
+	}
+	if !strings.Contains(string(written), "${MCBOT_TEST_SECRET}") {
+		t.Errorf("lost the reference:\n%s", written)
+	}
+
+	//Arguments aren't, so shifting the secret along is refused
+	err = updateConfig(func(c *Config) error {
+		c.MCServerCommand.Args = c.MCServerCommand.Args[1:]
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "not writing it out") {
+		t.Errorf("shifted argument: %v", err)
+	}
+	if again, _ := ioutil.ReadFile(file); string(again) != string(written) {
+		t.Errorf("file changed to:\n%s", again)
+	}
+}
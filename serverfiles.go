@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//Editing the server's whitelist, op list and ban lists directly while it's
+//stopped, so they can still be managed then.  Servers from 1.7.6 on keep
+//JSON lists keyed by UUID; older ones keep text files, a name per line, with
+//ban lists adding | separated fields from 1.3.  Files are locked against
+//other tools with a .lock file beside them while being rewritten, holding
+//the PID of whoever took it so one left behind by a crash can be cleared.
+
+//The lists a server keeps, as their JSON and text file names
+var serverLists = map[string][2]string{
+	"whitelist":      {"whitelist.json", "white-list.txt"},
+	"ops":            {"ops.json", "ops.txt"},
+	"banned-players": {"banned-players.json", "banned-players.txt"},
+	"banned-ips":     {"banned-ips.json", "banned-ips.txt"},
+}
+
+const (
+	LockWait = 5 //Seconds to wait for someone else's lock on a server file
+
+	banTimeFormat = "2006-01-02 15:04:05 -0700"
+)
+
+//Serializes the bot's own edits, and keeps servers from being started in the
+//middle of one.  The .lock files keep out everyone else.
+var serverFilesLock sync.Mutex
+
+//A server list as read from disk.  Entries are kept as generic maps so
+//fields the bot doesn't know about survive being rewritten.
+type serverList struct {
+	file    string
+	json    bool
+	plain   bool //A text list of bare names, from before 1.3
+	ip      bool //Keyed by address rather than name
+	entries []map[string]interface{}
+}
+
+//Which of list's files dir uses.  If there's neither, the JSON one when the
+//server is new enough to keep a user cache.
+func listFile(dir, list string) (string, bool) {
+	names := serverLists[list]
+	jsonFile := filepath.Join(dir, names[0])
+	if _, err := os.Stat(jsonFile); err == nil {
+		return jsonFile, true
+	}
+	txtFile := filepath.Join(dir, names[1])
+	if _, err := os.Stat(txtFile); err == nil {
+		return txtFile, false
+	}
+	if _, err := os.Stat(filepath.Join(dir, "usercache.json")); err == nil {
+		return jsonFile, true
+	}
+	return txtFile, false
+}
+
+func readServerList(dir, list string) (*serverList, error) {
+	l := &serverList{ip: list == "banned-ips"}
+	l.file, l.json = listFile(dir, list)
+
+	raw, err := ioutil.ReadFile(l.file)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if l.json {
+		return l, json.Unmarshal(raw, &l.entries)
+	}
+
+	key := l.key()
+	isBans := strings.HasPrefix(list, "banned-")
+	l.plain = true
+	scanner := bufio.NewScanner(strings.NewReader(string(raw)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "|")
+		entry := map[string]interface{}{key: fields[0]}
+		if isBans && len(fields) >= 5 {
+			l.plain = false
+			entry["created"], entry["source"], entry["expires"], entry["reason"] =
+				fields[1], fields[2], fields[3], fields[4]
+		}
+		l.entries = append(l.entries, entry)
+	}
+	return l, scanner.Err()
+}
+
+//The field entries are known by
+func (l *serverList) key() string {
+	if l.ip {
+		return "ip"
+	}
+	return "name"
+}
+
+func (l *serverList) names() []string {
+	var names []string
+	for _, e := range l.entries {
+		names = append(names, fmt.Sprint(e[l.key()]))
+	}
+	return names
+}
+
+func (l *serverList) find(name string) int {
+	for i, e := range l.entries {
+		if strings.EqualFold(fmt.Sprint(e[l.key()]), name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l *serverList) write() error {
+	var raw []byte
+	if l.json {
+		var err error
+		if raw, err = json.MarshalIndent(l.entries, "", "  "); err != nil {
+			return err
+		}
+	} else {
+		var b strings.Builder
+		if !l.plain && len(l.entries) > 0 {
+			fmt.Fprintf(&b, "# Updated %s by mc-bot\n", time.Now().Format(banTimeFormat))
+			b.WriteString("# victim name | ban date | banned by | banned until | reason\n\n")
+		}
+		for _, e := range l.entries {
+			b.WriteString(fmt.Sprint(e[l.key()]))
+			if _, ok := e["created"]; ok && !l.plain {
+				fmt.Fprintf(&b, "|%v|%v|%v|%v", e["created"], e["source"], e["expires"], e["reason"])
+			}
+			b.WriteString("\n")
+		}
+		raw = []byte(b.String())
+	}
+
+	return writeAtomic(l.file, raw, 0644)
+}
+
+//Take the lock on file for the other tools that honour it, waiting a while
+//if someone else has it.  Returns how to release it.
+func lockFile(file string) (func(), error) {
+	lock := file + ".lock"
+	deadline := time.Now().Add(LockWait * time.Second)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if staleLock(lock) {
+			logInfo.Printf("Clearing %s, left by a process that's gone\n", lock)
+			os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New(lock + " is held by something else")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//Whether lock was left by a process that's no longer running.  Locks
+//without a PID in them are assumed to be live.
+func staleLock(lock string) bool {
+	raw, err := ioutil.ReadFile(lock)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil || pid <= 0 {
+		return false
+	}
+
+	//serverFilesLock is held, so one with our own PID is from before a restart
+	if pid == os.Getpid() {
+		return true
+	}
+	return !processAlive(pid)
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" { //Finding it means it's there
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+//Apply edit to one of m's lists and save it, while m is stopped
+func (m *minecraft) editList(list string, edit func(*serverList) error) error {
+	serverFilesLock.Lock()
+	defer serverFilesLock.Unlock()
+
+	if m.IsRunning() {
+		return errors.New(m.name + " is running, its console has to be used")
+	}
+
+	dir := m.config().MCServerDir
+	file, _ := listFile(dir, list)
+	unlock, err := lockFile(file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	l, err := readServerList(dir, list)
+	if err != nil {
+		return err
+	}
+	if err = edit(l); err != nil {
+		return err
+	}
+	return l.write()
+}
+
+//The names on one of m's lists
+func (m *minecraft) readList(list string) ([]string, error) {
+	serverFilesLock.Lock()
+	defer serverFilesLock.Unlock()
+
+	l, err := readServerList(m.config().MCServerDir, list)
+	if err != nil {
+		return nil, err
+	}
+	return l.names(), nil
+}
+
+//player's UUID, from the server's user cache or, for servers not in online
+//mode, worked out the way the server does
+func (m *minecraft) playerUUID(player string) (string, error) {
+	dir := m.config().MCServerDir
+
+	var cache []struct {
+		Name string `json:"name"`
+		UUID string `json:"uuid"`
+	}
+	if raw, err := ioutil.ReadFile(filepath.Join(dir, "usercache.json")); err == nil {
+		if err := json.Unmarshal(raw, &cache); err != nil {
+			return "", fmt.Errorf("usercache.json: %s", err)
+		}
+	}
+	for _, c := range cache {
+		if strings.EqualFold(c.Name, player) {
+			return c.UUID, nil
+		}
+	}
+
+	if m.serverProperty("online-mode") == "false" {
+		return offlineUUID(player), nil
+	}
+
+	return "", fmt.Errorf("no UUID known for %s, they need to have joined once or the server to be running", player)
+}
+
+//The value of key in m's server.properties, or "" if it isn't set
+func (m *minecraft) serverProperty(key string) string {
+	raw, err := ioutil.ReadFile(filepath.Join(m.config().MCServerDir, "server.properties"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(raw), "\n") {
+		if split := strings.SplitN(strings.TrimSpace(line), "=", 2); len(split) == 2 && split[0] == key {
+			return split[1]
+		}
+	}
+	return ""
+}
+
+//The version 3 UUID offline mode servers give player
+func offlineUUID(player string) string {
+	sum := md5.Sum([]byte("OfflinePlayer:" + player))
+	sum[6] = sum[6]&0x0f | 0x30
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:])
+}
+
+//A new entry for player on a list of l's kind
+func (m *minecraft) listEntry(l *serverList, player string) (map[string]interface{}, error) {
+	entry := map[string]interface{}{l.key(): player}
+	if l.json && !l.ip {
+		uuid, err := m.playerUUID(player)
+		if err != nil {
+			return nil, err
+		}
+		entry["uuid"] = uuid
+	}
+	return entry, nil
+}
+
+//Add or remove player from list (whitelist or ops) while m is stopped,
+//returning whether that changed anything
+func (m *minecraft) offlineListEdit(list, op, player string) (bool, error) {
+	changed := false
+	err := m.editList(list, func(l *serverList) error {
+		i := l.find(player)
+		if op == "remove" {
+			if i >= 0 {
+				l.entries = append(l.entries[:i], l.entries[i+1:]...)
+				changed = true
+			}
+			return nil
+		}
+
+		if i >= 0 {
+			return nil
+		}
+		entry, err := m.listEntry(l, player)
+		if err != nil {
+			return err
+		}
+		if list == "ops" && l.json {
+			entry["level"] = 4
+			if level, err := strconv.Atoi(m.serverProperty("op-permission-level")); err == nil {
+				entry["level"] = level
+			}
+			entry["bypassesPlayerLimit"] = false
+		}
+		l.entries = append(l.entries, entry)
+		changed = true
+		return nil
+	})
+	return changed, err
+}
+
+//Do what a ban, ban-ip, pardon or pardon-ip console command would, while
+//m is stopped.  target may be followed by a reason.
+func (m *minecraft) offlineBan(command, target string) error {
+	split := strings.SplitN(target, " ", 2)
+	target = split[0]
+	reason := "Banned by an operator."
+	if len(split) > 1 {
+		reason = split[1]
+	}
+
+	list := "banned-players"
+	if strings.HasSuffix(command, "-ip") {
+		list = "banned-ips"
+	}
+
+	return m.editList(list, func(l *serverList) error {
+		i := l.find(target)
+		if strings.HasPrefix(command, "pardon") {
+			if i >= 0 {
+				l.entries = append(l.entries[:i], l.entries[i+1:]...)
+			}
+			return nil
+		}
+
+		entry, err := m.listEntry(l, target)
+		if err != nil {
+			return err
+		}
+		if !l.plain {
+			entry["created"] = time.Now().Format(banTimeFormat)
+			entry["source"] = "mc-bot"
+			entry["expires"] = "forever"
+			entry["reason"] = reason
+		}
+		if i >= 0 {
+			l.entries[i] = entry
+		} else {
+			l.entries = append(l.entries, entry)
+		}
+		return nil
+	})
+}
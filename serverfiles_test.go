@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOfflineUUID(t *testing.T) {
+	for player, want := range map[string]string{
+		"Notch": "b50ad385-829d-3141-a216-7e7d7539ba7f",
+		"notch": offlineUUID("notch"), //Case matters to the server
+	} {
+		if got := offlineUUID(player); got != want {
+			t.Errorf("%s: got %s, want %s", player, got, want)
+		}
+	}
+	if offlineUUID("Notch") == offlineUUID("notch") {
+		t.Error("names differing in case share a UUID")
+	}
+}
+
+func TestReadServerList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcbot-serverfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//Nothing there yet, and no user cache, so an old server
+	l, err := readServerList(dir, "whitelist")
+	if err != nil || l.json || len(l.entries) != 0 || filepath.Base(l.file) != "white-list.txt" {
+		t.Errorf("missing list: %+v, %v", l, err)
+	}
+	write("usercache.json", "[]")
+	if l, err = readServerList(dir, "whitelist"); err != nil || !l.json || filepath.Base(l.file) != "whitelist.json" {
+		t.Errorf("missing list with a user cache: %+v, %v", l, err)
+	}
+
+	write("ops.txt", "# ops\nSteve\n\nAlex\n")
+	l, err = readServerList(dir, "ops")
+	if err != nil || !l.plain || !reflect.DeepEqual(l.names(), []string{"Steve", "Alex"}) {
+		t.Fatalf("text ops: %+v, %v", l, err)
+	}
+	if l.find("alex") != 1 || l.find("Notch") != -1 {
+		t.Error("find")
+	}
+
+	write("banned-players.txt", "Griefer|2013-05-01 12:00:00 +0000|Mod1|Forever|lava\n")
+	l, err = readServerList(dir, "banned-players")
+	if err != nil || l.plain || l.entries[0]["reason"] != "lava" {
+		t.Fatalf("text bans: %+v, %v", l, err)
+	}
+	l.entries = append(l.entries, map[string]interface{}{"name": "Steve", "created": "now", "source": "mc-bot",
+		"expires": "forever", "reason": "spam"})
+	if err := l.write(); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := ioutil.ReadFile(l.file)
+	if !strings.HasSuffix(string(raw), "\n\nGriefer|2013-05-01 12:00:00 +0000|Mod1|Forever|lava\nSteve|now|mc-bot|forever|spam\n") {
+		t.Errorf("wrote %q", raw)
+	}
+
+	write("banned-ips.json", `[{"ip":"10.0.0.1","created":"now","source":"Server","expires":"forever","reason":"x","extra":1}]`)
+	l, err = readServerList(dir, "banned-ips")
+	if err != nil || !l.json || !l.ip || !reflect.DeepEqual(l.names(), []string{"10.0.0.1"}) {
+		t.Fatalf("JSON IP bans: %+v, %v", l, err)
+	}
+	if err := l.write(); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = readServerList(dir, "banned-ips"); err != nil || l.entries[0]["extra"] != 1.0 {
+		t.Errorf("unknown field lost: %+v, %v", l, err)
+	}
+}
+
+func TestStaleLocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcbot-serverfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ops.json")
+
+	for content, stale := range map[string]bool{
+		fmt.Sprintf("%d\n", os.Getpid()):  true,
+		fmt.Sprintf("%d\n", os.Getppid()): false,
+		"":                                false,
+		"someone else's":                  false,
+	} {
+		if err := ioutil.WriteFile(file+".lock", []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := staleLock(file + ".lock"); got != stale {
+			t.Errorf("%q: stale %v", content, got)
+		}
+	}
+
+	//A lock left from before a restart doesn't hold things up
+	if err := ioutil.WriteFile(file+".lock", []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if _, err := os.Stat(file + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock left behind: %v", err)
+	}
+}
+
+func TestOpRegex(t *testing.T) {
+	for line, want := range map[string]string{
+		"[12:00:00] [Server thread/INFO]: Made Steve a server operator":                       "Made Steve a server operator",
+		"[12:00:00] [Server thread/INFO]: Nothing changed. The player already is an operator": "Nothing changed. The player already is an operator",
+		"[12:00:00] [Server thread/INFO]: That player does not exist":                         "That player does not exist",
+		"[12:00:00 INFO]: Opped Steve":                                                        "Opped Steve",
+		"[12:00:00 INFO]: Could not de-op Steve":                                              "Could not de-op Steve",
+		"2013-05-01 12:00:00 [INFO] De-opping Steve":                                          "De-opping Steve",
+		"[12:00:00] [Server thread/INFO]: <Steve> Made Alex a server operator":                "",
+	} {
+		got := ""
+		if match := opRegex.FindStringSubmatch(line); match != nil {
+			got = match[1]
+		}
+		if got != want {
+			t.Errorf("%q: got %q, want %q", line, got, want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ckolbeck/mcserver"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+//The name given to the server described by the top level MCServer* and
+//Backup/MapUpdate settings, when Servers isn't used
+const defaultServerName = "default"
+
+//One Minecraft server managed by the bot
+type ServerConfig struct {
+	Name string //Used to target it, e.g. '@creative list'
+
+	MCServerCommand cmd
+	MCServerDir     string
+	MCWorldDir      string
+
+	//Time in minutes between backups/map updates, 0 to disable
+	BackupCommand     cmd
+	BackupInterval    int64
+	MapUpdateCommand  cmd
+	MapTempWorldDir   string
+	MapUpdateInterval int64
+
+	//bungeecord or velocity if this is a proxy rather than a game server
+	Type string
+
+	//For game servers, the proxy players reach them through
+	Proxy string
+
+	//For proxies, what to run instead of sending kick, ban, ban-ip, pardon
+	//or pardon-ip to every backend, e.g. "ban": "gban %s"
+	ProxyCommands map[string]string
+}
+
+//A running server and what the bot keeps track of about it
+type minecraft struct {
+	*mcserver.Server
+	name string
+	conf ServerConfig //As it was when the server was created
+
+	response     chan string //Output waiting to be read by the current command
+	errors       int
+	severeErrors int
+	version      string
+
+	mapgenRunning    bool
+	lastMapgenOutput string
+	lastMapgenRun    time.Time
+
+	playersLock sync.Mutex
+	players     map[string]*presence //Who's online, by lowercased name
+
+	echoLock sync.Mutex
+	echoes   []string //What the bot has said lately, to know it when it's logged
+}
+
+//In config order.  The first is the default target for commands.
+var servers []*minecraft
+
+func newMinecraft(conf *ServerConfig) (*minecraft, error) {
+	s, err := mcserver.NewServer(conf.MCServerCommand.Command, conf.MCServerCommand.Args,
+		conf.MCServerDir, logInfo, logErr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", conf.Name, err)
+	}
+
+	return &minecraft{
+		Server:   s,
+		name:     conf.Name,
+		conf:     *conf,
+		response: make(chan string, 2048),
+		players:  make(map[string]*presence),
+	}, nil
+}
+
+//Create every configured server and start watching its output
+func startServers(conf *Config) {
+	for _, sc := range conf.servers {
+		m, err := newMinecraft(sc)
+		if err != nil {
+			logErr.Println(err)
+			continue
+		}
+
+		servers = append(servers, m)
+		go m.teeOutput()
+	}
+}
+
+//The server called name, or the default server if name is empty.  nil if
+//there's no such server.
+func findServer(name string) *minecraft {
+	if len(servers) == 0 {
+		return nil
+	}
+	if name == "" {
+		return servers[0]
+	}
+
+	for _, m := range servers {
+		if strings.EqualFold(m.name, name) {
+			return m
+		}
+	}
+	return nil
+}
+
+//The current settings for m.  Servers removed from the config keep the
+//settings they were started with.
+func (m *minecraft) config() *ServerConfig {
+	for _, sc := range currentConfig().servers {
+		if sc.Name == m.name {
+			return sc
+		}
+	}
+	return &m.conf
+}
+
+//Throw away output no command has read, so the next one only sees its own
+func (m *minecraft) flushResponse() {
+	for {
+		select {
+		case <-m.response:
+		default:
+			return
+		}
+	}
+}
+
+//The next line of m's output that re matches, as FindStringSubmatch gives
+//it, or nil if the command times out first
+func (m *minecraft) awaitResponse(re *regexp.Regexp, timeout *bool) []string {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for !*timeout {
+		select {
+		case line := <-m.response:
+			if match := re.FindStringSubmatch(line); match != nil {
+				return match
+			}
+		case <-tick.C:
+		}
+	}
+	return nil
+}
+
+//Prefix text with the server's name, if there's more than one server it
+//could be confused with
+func (m *minecraft) tag(text string) string {
+	if len(servers) > 1 {
+		return "[" + m.name + "] " + text
+	}
+	return text
+}
+
+//Let the alerts rooms know about something that happened to m
+func (m *minecraft) alert(text string) {
+	alert(m.tag(text))
+}
+
+//Clear the counters which only make sense for a single run of the server
+func (m *minecraft) resetStats() {
+	m.errors = 0
+	m.severeErrors = 0
+	m.version = ""
+	m.clearPlayers()
+}
+
+//Whether room is one of m's rooms
+func (m *minecraft) owns(t chatTransport, room string) bool {
+	return roomServer(t, room) == m
+}
+
+//The rooms on t with role which belong to m
+func (m *minecraft) rooms(t chatTransport, role string) []string {
+	var rooms []string
+	for _, room := range t.Rooms(role) {
+		if m.owns(t, room) {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+//The server a room relays for, and which commands from it go to unless
+//another is named
+func roomServer(t chatTransport, room string) *minecraft {
+	name := ""
+	if sr, ok := t.(serverRooms); ok {
+		name = sr.RoomServer(room)
+	}
+
+	if m := findServer(name); m != nil {
+		return m
+	}
+	return findServer("")
+}
+
+//Make sure everything which names a server names one that exists
+func checkServers(c *Config) error {
+	names := make(map[string]bool)
+	proxies := make(map[string]bool)
+	for _, s := range c.Servers {
+		if s.Name == "" || strings.ContainsAny(s.Name, " @") {
+			return fmt.Errorf("Server name '%s' must be non-empty and contain no spaces or @", s.Name)
+		}
+		if names[strings.ToLower(s.Name)] {
+			return errors.New("Server " + s.Name + " is defined twice")
+		}
+		names[strings.ToLower(s.Name)] = true
+
+		switch s.Type {
+		case "":
+		case PROXY_BUNGEECORD, PROXY_VELOCITY:
+			proxies[strings.ToLower(s.Name)] = true
+		default:
+			return fmt.Errorf("%s: unknown server type %s", s.Name, s.Type)
+		}
+	}
+	for _, s := range c.Servers {
+		if s.Proxy != "" && (s.Type != "" || !proxies[strings.ToLower(s.Proxy)]) {
+			return fmt.Errorf("%s: %s isn't a proxy it can be behind", s.Name, s.Proxy)
+		}
+	}
+	if len(c.Servers) == 0 {
+		names[defaultServerName] = true
+	}
+
+	check := func(where, name string) error {
+		if name != "" && !names[strings.ToLower(name)] {
+			return fmt.Errorf("%s: unknown server %s", where, name)
+		}
+		return nil
+	}
+
+	for _, channel := range c.IrcChannels {
+		if err := check(channel.Name, channel.Server); err != nil {
+			return err
+		}
+	}
+	if err := check("Matrix", c.Matrix.Server); err != nil {
+		return err
+	}
+	return check("Discord", c.Discord.Server)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//State the bot keeps between runs (last seen times and the like) lives in
+//small JSON files under DataDir.
+
+var storeLock sync.Mutex
+
+func dataFile(name string) string {
+	return filepath.Join(currentConfig().DataDir, name)
+}
+
+//Read the named data file into v.  A file that doesn't exist yet leaves v
+//as it is.
+func loadData(name string, v interface{}) error {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	raw, err := ioutil.ReadFile(dataFile(name))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(raw, v)
+}
+
+//Replace the named data file with v
+func saveData(name string, v interface{}) error {
+	raw, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	if err = os.MkdirAll(currentConfig().DataDir, 0700); err != nil {
+		return err
+	}
+	return writeAtomic(dataFile(name), raw, 0600)
+}
+
+//Write raw to file by way of a temporary file in the same directory, so
+//readers see either the old contents or the new, never a mix
+func writeAtomic(file string, raw []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //No-op once the rename succeeds
+
+	if _, err = tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
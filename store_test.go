@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+//Make conf (or an empty config, if it's nil) current for the rest of the
+//test, with its DataDir somewhere fresh and nothing loaded from a previous
+//one.  Returns the data directory.
+func withTestConfig(t *testing.T, conf *Config) string {
+	if conf == nil {
+		conf = &Config{}
+	}
+	conf.DataDir = t.TempDir()
+	applyDefaults(conf)
+	mungeConfig(conf)
+
+	old := currentConfig()
+	resetData()
+	setConfig(conf)
+	t.Cleanup(func() {
+		resetData()
+		setConfig(old)
+	})
+	return conf.DataDir
+}
+
+//Forget everything loaded from DataDir, so it's read again from the next one
+func resetData() {
+	applicationsLock.Lock()
+	applications = nil
+	applicationsLock.Unlock()
+
+	deathsLock.Lock()
+	deaths = nil
+	deathsLock.Unlock()
+
+	linksLock.Lock()
+	links, pendingLinks = nil, make(map[string]pendingLink)
+	linksLock.Unlock()
+
+	mailLock.Lock()
+	mailboxes, mailNoticed = nil, make(map[string]int)
+	mailLock.Unlock()
+
+	seenLock.Lock()
+	seen = nil
+	seenLock.Unlock()
+
+	sanctionsLock.Lock()
+	sanctions = nil
+	sanctionsLock.Unlock()
+
+	scrollbackLock.Lock()
+	scrollback, scrollbackPending = nil, false
+	scrollbackLock.Unlock()
+
+	departuresLock.Lock()
+	departures = nil
+	departuresLock.Unlock()
+
+	ticketsLock.Lock()
+	tickets = nil
+	ticketsLock.Unlock()
+}
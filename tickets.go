@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Reports and help requests from players, for staff who may only be in
+//chat.  Each becomes a ticket which is announced in the alerts rooms, naming
+//the moderators there so they're pinged, and which staff then claim and
+//close.  The player hears in game, or by mail, when that happens.
+
+//What a ticket can be
+const (
+	TICKET_REPORT = "report"
+	TICKET_HELPOP = "helpop"
+
+	TICKET_OPEN    = "open"
+	TICKET_CLAIMED = "claimed"
+	TICKET_CLOSED  = "closed"
+)
+
+type ticket struct {
+	ID       int
+	Kind     string
+	Player   string //Who raised it
+	Reported string //For reports, who it's about
+	Message  string
+	Server   string
+	Location string //Where the player was, if the server would say
+	Opened   time.Time
+
+	State     string
+	ClaimedBy string
+	ClosedBy  string
+	Closed    time.Time
+	Note      string
+}
+
+//What's kept in ticketsFile
+type ticketQueue struct {
+	NextID  int
+	Tickets []*ticket
+}
+
+const (
+	ticketsFile = "tickets.json"
+
+	LocateWait     = 2  //Seconds to wait for the server to say where a player is
+	TicketCooldown = 60 //Seconds a player must wait between tickets
+)
+
+var (
+	tickets     *ticketQueue //Loaded on first use
+	ticketsLock sync.Mutex
+
+	//From 'data get entity <player> Pos', 1.13 on
+	entityPosRegex *regexp.Regexp = regexp.MustCompile(`has the following entity data: \[(-?[0-9.]+)d, (-?[0-9.]+)d, (-?[0-9.]+)d\]`)
+)
+
+//Must be called with ticketsLock held
+func loadTickets() {
+	if tickets != nil {
+		return
+	}
+
+	tickets = &ticketQueue{NextID: 1}
+	if err := loadData(ticketsFile, tickets); err != nil {
+		logErr.Printf("Couldn't read %s: %s\n", ticketsFile, err)
+	}
+}
+
+//Must be called with ticketsLock held
+func saveTickets() {
+	if err := saveData(ticketsFile, tickets); err != nil {
+		logErr.Printf("Couldn't save %s: %s\n", ticketsFile, err)
+	}
+}
+
+//File t, unless its player raised another too recently
+func openTicket(t ticket) (ticket, error) {
+	ticketsLock.Lock()
+	defer ticketsLock.Unlock()
+
+	loadTickets()
+	for i := len(tickets.Tickets) - 1; i >= 0; i-- {
+		last := tickets.Tickets[i]
+		if !strings.EqualFold(last.Player, t.Player) {
+			continue
+		}
+		if wait := TicketCooldown*time.Second - time.Since(last.Opened); wait > 0 {
+			return t, fmt.Errorf("You raised ticket #%d just now, wait %v before raising another.",
+				last.ID, wait/time.Second*time.Second+time.Second)
+		}
+		break
+	}
+
+	t.ID = tickets.NextID
+	t.State = TICKET_OPEN
+	t.Opened = time.Now()
+	tickets.NextID++
+	tickets.Tickets = append(tickets.Tickets, &t)
+	saveTickets()
+	return t, nil
+}
+
+//Move ticket id to state on by's behalf.  Closed tickets stay closed, and
+//claimed ones stay with whoever claimed them unless force is set.
+func updateTicket(id int, state, by, note string, force bool) (ticket, error) {
+	ticketsLock.Lock()
+	defer ticketsLock.Unlock()
+
+	loadTickets()
+	for _, t := range tickets.Tickets {
+		if t.ID != id {
+			continue
+		}
+		if t.State == TICKET_CLOSED {
+			return *t, fmt.Errorf("Ticket #%d was already closed by %s.", t.ID, t.ClosedBy)
+		}
+		if state == TICKET_CLAIMED && t.State == TICKET_CLAIMED && t.ClaimedBy != by && !force {
+			return *t, fmt.Errorf("Ticket #%d is already claimed by %s, 'tickets claim %d force' takes it over.",
+				t.ID, t.ClaimedBy, t.ID)
+		}
+
+		t.State = state
+		if state == TICKET_CLAIMED {
+			t.ClaimedBy = by
+		} else {
+			t.ClosedBy, t.Closed, t.Note = by, time.Now(), note
+		}
+		saveTickets()
+		return *t, nil
+	}
+	return ticket{}, fmt.Errorf("There's no ticket #%d.", id)
+}
+
+//Tickets which aren't closed, oldest first
+func openTickets() []ticket {
+	ticketsLock.Lock()
+	defer ticketsLock.Unlock()
+
+	loadTickets()
+	var found []ticket
+	for _, t := range tickets.Tickets {
+		if t.State != TICKET_CLOSED {
+			found = append(found, *t)
+		}
+	}
+	return found
+}
+
+func (t ticket) String() string {
+	s := fmt.Sprintf("#%d %s from %s", t.ID, t.Kind, t.Player)
+	if t.Reported != "" {
+		s += " about " + t.Reported
+	}
+	if len(servers) > 1 {
+		s += " on " + t.Server
+	}
+	if t.Location != "" {
+		s += " at " + t.Location
+	}
+	s += fmt.Sprintf(", %v ago: %s", time.Since(t.Opened)/time.Second*time.Second, t.Message)
+	if t.State == TICKET_CLAIMED {
+		s += " (claimed by " + t.ClaimedBy + ")"
+	}
+	return s
+}
+
+//Where player is on m, as "x y z", or "" if the server won't say.  Must be
+//called from a command, which has the server's output to itself.  m needn't
+//be the command's own server, so its output is flushed here.
+func (m *minecraft) locate(player string) string {
+	m.flushResponse()
+	m.In <- "data get entity " + player + " Pos"
+
+	wait := time.After(LocateWait * time.Second)
+	for {
+		select {
+		case line := <-m.response:
+			if match := entityPosRegex.FindStringSubmatch(line); match != nil {
+				return strings.Join(match[1:], " ")
+			}
+		case <-wait:
+			return ""
+		}
+	}
+}
+
+//The nicks of the moderators who are in the bot's IRC channels: whoever's
+//logged in to an account allowed to handle tickets, directly, by default or
+//through a link.  A nick alone could be anyone's, so doesn't count.
+func onlineModerators() []string {
+	var mods []string
+	for _, nick := range ircPresentNicks() {
+		account := ircAccount(nick)
+		if account == "" {
+			continue
+		}
+		if allowed(&command{identities: []string{"irc:" + account}, source: SOURCE_CHAT}, "tickets") {
+			mods = append(mods, nick)
+		}
+	}
+	sort.Strings(mods)
+	return mods
+}
+
+//Let the alerts rooms know about a new ticket, pinging whoever can handle it
+func announceTicket(t ticket) {
+	text := "New ticket " + t.String()
+	if mods := onlineModerators(); len(mods) > 0 {
+		text += " -- " + strings.Join(mods, ", ")
+	}
+	alert(text)
+}
+
+//Let the player who raised t know what's happened to it
+func (t ticket) notify(text string) {
+	if m, name := playerServer(t.Player); m != nil {
+		m.tell(name, text)
+		return
+	}
+	sendMail("mc:"+t.Player, "staff", text)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTickets(t *testing.T) {
+	withTestConfig(t, nil)
+
+	first, err := openTicket(ticket{Kind: TICKET_HELPOP, Player: "Steve", Message: "stuck"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openTicket(ticket{Kind: TICKET_HELPOP, Player: "steve", Message: "still stuck"}); err == nil {
+		t.Error("second ticket straight after the first")
+	}
+	if _, err := openTicket(ticket{Kind: TICKET_REPORT, Player: "Alex", Reported: "Steve", Message: "spam"}); err != nil {
+		t.Errorf("someone else's ticket: %s", err)
+	}
+
+	if _, err := updateTicket(first.ID, TICKET_CLAIMED, "Mod1", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := updateTicket(first.ID, TICKET_CLAIMED, "Mod1", "", false); err != nil {
+		t.Errorf("claiming your own ticket again: %s", err)
+	}
+	if _, err := updateTicket(first.ID, TICKET_CLAIMED, "Mod2", "", false); err == nil || !strings.Contains(err.Error(), "already claimed by Mod1") {
+		t.Errorf("claimed from under Mod1: %v", err)
+	}
+	if claimed, err := updateTicket(first.ID, TICKET_CLAIMED, "Mod2", "", true); err != nil || claimed.ClaimedBy != "Mod2" {
+		t.Errorf("forced claim: %+v, %v", claimed, err)
+	}
+	if _, err := updateTicket(first.ID, TICKET_CLOSED, "Mod2", "sorted", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := updateTicket(first.ID, TICKET_CLAIMED, "Mod1", "", true); err == nil {
+		t.Error("claimed a closed ticket")
+	}
+}
+
+func TestLocateFlushes(t *testing.T) {
+	m := answeringServer("[12:00:00] [Server thread/INFO]: Steve has the following entity data: [1.5d, 64.0d, -3.25d]")
+	m.response <- "[11:59:00] [Server thread/INFO]: Steve has the following entity data: [0.0d, 0.0d, 0.0d]"
+	if got := m.locate("Steve"); got != "1.5 64.0 -3.25" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestOnlineModerators(t *testing.T) {
+	withTestConfig(t, &Config{AccessLevels: map[string]AccessLevel{
+		"Mod": {Members: []string{"irc:ModAcct", "irc:mallory", "mc:Steve"}, Allowed: []string{"tickets"}},
+	}})
+	linksLock.Lock()
+	links = map[string]accountLink{"steve": {Player: "Steve", Identity: "irc:steveacct"}}
+	linksLock.Unlock()
+
+	defer func(g *ircGateway) { gateway = g }(gateway)
+	gateway = &ircGateway{
+		nick: "MCBot",
+		present: map[string]map[string]bool{
+			"mcbot": {"#mc": true}, "mod1": {"#mc": true}, "stevie": {"#staff": true},
+			"mallory": {"#mc": true}, "bob": {"#mc": true},
+		},
+		accounts: map[string]string{"mod1": "ModAcct", "stevie": "steveacct", "bob": "bobacct"},
+	}
+
+	//By account, directly or through a link, and never by nick alone
+	want := []string{"mod1", "stevie"}
+	if got := onlineModerators(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	//Anyone logged in, if everyone may handle tickets
+	withTestConfig(t, &Config{DefaultAccess: []string{"tickets"}})
+	want = []string{"bob", "mod1", "stevie"}
+	if got := onlineModerators(); !reflect.DeepEqual(got, want) {
+		t.Errorf("by default, got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+//What a room is used for
+const (
+	ROLE_RELAY    = "relay"    //Chat relayed to and from the game
+	ROLE_COMMANDS = "commands" //Commands accepted
+	ROLE_CONSOLE  = "console"  //Mirror of the server console, for staff
+	ROLE_ALERTS   = "alerts"   //Crashes, backups, permission denials
+)
+
+//A chat network the server is bridged to
+type chatTransport interface {
+	//Short lowercase name, also the prefix for this transport's identities
+	//in AccessLevels, e.g. "irc" for irc:nick
+	Name() string
+
+	//Connect and start delivering received messages to handleChat
+	Connect(conf *Config) error
+
+	//Send text to a room (or user, for transports where that's the same thing)
+	Send(room, text string)
+
+	//The rooms which have the given role
+	Rooms(role string) []string
+
+	//Whether messages received in room should be treated as having role
+	Accepts(room, role string) bool
+
+	//Whether the transport is currently connected and able to send
+	Online() bool
+}
+
+//Transports which can show relayed game chat under the player's own name
+type playerRelay interface {
+	SendAs(player, msg string, action bool)
+}
+
+//Transports whose rooms are individually configured
+type roomConfigs interface {
+	RoomConfig(room string) *ChannelConfig
+}
+
+//Transports whose rooms can be tied to one of several servers
+type serverRooms interface {
+	//The name of the server room belongs to, "" for the default
+	RoomServer(room string) string
+}
+
+//Per room settings.  Only IRC channels are configured this way for now.
+type ChannelConfig struct {
+	Name  string
+	Key   string
+	Roles []string
+
+	//The server this room relays and runs commands for, if not the first
+	Server string
+
+	//Commands accepted in this room.  If empty, anything AccessLevels allows.
+	Commands []string
+
+	//Regexes selecting the lines sent to this room.  A line is sent if it
+	//matches any Include (or there are none) and no Exclude.
+	Include []string
+	Exclude []string
+
+	//Derived values:
+	roles    map[string]bool
+	commands map[string]bool
+	include  []*regexp.Regexp
+	exclude  []*regexp.Regexp
+}
+
+func (c *ChannelConfig) compile() error {
+	c.roles = make(map[string]bool, len(c.Roles))
+	for _, role := range c.Roles {
+		switch role {
+		case ROLE_RELAY, ROLE_COMMANDS, ROLE_CONSOLE, ROLE_ALERTS:
+			c.roles[role] = true
+		default:
+			return fmt.Errorf("%s: unknown role %s", c.Name, role)
+		}
+	}
+
+	c.commands = make(map[string]bool, len(c.Commands))
+	for _, op := range c.Commands {
+		c.commands[op] = true
+	}
+
+	c.include, c.exclude = nil, nil
+	for _, expr := range c.Include {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("%s: %s", c.Name, err)
+		}
+		c.include = append(c.include, re)
+	}
+	for _, expr := range c.Exclude {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("%s: %s", c.Name, err)
+		}
+		c.exclude = append(c.exclude, re)
+	}
+
+	return nil
+}
+
+//Whether line passes the room's filters
+func (c *ChannelConfig) shows(line string) bool {
+	for _, re := range c.exclude {
+		if re.MatchString(line) {
+			return false
+		}
+	}
+
+	if len(c.include) == 0 {
+		return true
+	}
+	for _, re := range c.include {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+func roomConfig(t chatTransport, room string) *ChannelConfig {
+	if rc, ok := t.(roomConfigs); ok {
+		return rc.RoomConfig(room)
+	}
+	return nil
+}
+
+//Whether op may be run from room, as far as the room itself is concerned
+func roomAllowsCommand(t chatTransport, room, op string) bool {
+	if c := roomConfig(t, room); c != nil && len(c.commands) > 0 {
+		return c.commands[op]
+	}
+	return true
+}
+
+//A line of chat received from a transport
+type chatMessage struct {
+	transport chatTransport
+	room      string   //Where the reply to a command should go
+	sender    string   //Display name
+	account   string   //Account the transport vouches the sender owns, if any
+	groups    []string //Further identities the sender holds, e.g. discord-role:id
+	text      string
+	action    bool //A /me
+	directed  bool //Addressed to the bot with the attention char; text excludes it
+}
+
+//The name the sender's permissions are looked up under.  A verified account
+//is preferred over a display name, which anyone could pick.
+func (m *chatMessage) identity() string {
+	if m.account != "" {
+		return m.transport.Name() + ":" + m.account
+	}
+
+	return m.transport.Name() + ":" + m.sender
+}
+
+//Every identity permissions may be granted through
+func (m *chatMessage) identities() []string {
+	return append([]string{m.identity()}, m.groups...)
+}
+
+var transports []chatTransport
+
+//Start every transport that's configured
+func connectTransports(conf *Config) {
+	if conf.IrcServer != "" {
+		transports = append(transports, ircChat)
+	}
+	if conf.Matrix.Homeserver != "" {
+		transports = append(transports, matrixChat)
+	}
+	if conf.Discord.Token != "" {
+		transports = append(transports, discordChat)
+	}
+
+	for _, t := range transports {
+		if err := t.Connect(conf); err != nil {
+			logErr.Printf("Couldn't connect to %s: %s\n", t.Name(), err)
+		}
+	}
+}
+
+//Whether name is the name of a known transport
+func isTransport(name string) bool {
+	for _, t := range []chatTransport{ircChat, matrixChat, discordChat} {
+		if t.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+//Deal with a line of chat from any transport: commands are queued for
+//commandDispatch and everything else is relayed into the game.
+func handleChat(m *chatMessage) {
+	conf := currentConfig()
+	if conf.ignore[m.sender] || conf.ignore[m.identity()] {
+		return
+	}
+	if m.transport == chatTransport(ircChat) {
+		deliverIRCMail(m)
+	}
+
+	if m.directed {
+		if !m.transport.Accepts(m.room, ROLE_COMMANDS) {
+			return
+		}
+
+		commands <- &command{
+			raw:        m.text,
+			sender:     m.sender,
+			identities: m.identities(),
+			unverified: m.account == "",
+			channel:    m.room,
+			source:     SOURCE_CHAT,
+			transport:  m.transport,
+			server:     roomServer(m.transport, m.room),
+		}
+		return
+	}
+
+	srv := roomServer(m.transport, m.room)
+	if srv == nil || !m.transport.Accepts(m.room, ROLE_RELAY) {
+		return
+	}
+
+	srv.relayToGame(m)
+}
+
+//Lines held for a transport while it's offline
+type backlog struct {
+	lock    sync.Mutex
+	lines   []backlogLine
+	dropped int
+}
+
+type backlogLine struct {
+	room string
+	who  string //The player who said it, if it was chat
+	text string
+}
+
+const (
+	backlogMax    = 500 //Lines held while offline before the oldest are dropped
+	backlogReplay = 5   //Lines per room replayed verbatim once back
+)
+
+var (
+	backlogs     map[string]*backlog = make(map[string]*backlog)
+	backlogsLock sync.Mutex
+)
+
+func backlogFor(t chatTransport) *backlog {
+	backlogsLock.Lock()
+	defer backlogsLock.Unlock()
+
+	b, ok := backlogs[t.Name()]
+	if !ok {
+		b = &backlog{}
+		backlogs[t.Name()] = b
+	}
+	return b
+}
+
+//Send text to every room with the given role.  who is the player
+//responsible for the line, if any.
+func broadcast(role, who, text string) {
+	for _, t := range transports {
+		for _, room := range t.Rooms(role) {
+			sendTo(t, room, who, text)
+		}
+	}
+}
+
+//Let the alerts rooms know about something
+func alert(text string) {
+	broadcast(ROLE_ALERTS, "", text)
+}
+
+//Send text to a room, if it passes the room's filters.  While t is
+//disconnected lines are held instead, and replayed in condensed form once
+//it's back.
+func sendTo(t chatTransport, room, who, text string) {
+	if c := roomConfig(t, room); c != nil && !c.shows(text) {
+		return
+	}
+
+	deliver(t, room, who, text)
+}
+
+//sendTo without the filters, for the bot's own notices
+func deliver(t chatTransport, room, who, text string) {
+	text = toChat(t, text)
+	if t.Online() {
+		t.Send(room, text)
+		return
+	}
+
+	b := backlogFor(t)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.lines = append(b.lines, backlogLine{room, who, text})
+	if len(b.lines) > backlogMax {
+		b.lines = b.lines[1:]
+		b.dropped++
+	}
+}
+
+//Replay whatever sendTo held while t was offline.  If a room missed more
+//than a few lines, summarise who was talking and replay only the latest.
+//The console rooms' own lines follow.
+func flushBacklog(t chatTransport) {
+	defer flushConsole(t)
+
+	b := backlogFor(t)
+	b.lock.Lock()
+	lines, dropped := b.lines, b.dropped
+	b.lines, b.dropped = nil, 0
+	b.lock.Unlock()
+
+	if dropped > 0 {
+		logErr.Printf("Dropped %d lines for %s while it was offline\n", dropped, t.Name())
+	}
+
+	var rooms []string
+	byRoom := make(map[string][]backlogLine)
+	for _, l := range lines {
+		if _, seen := byRoom[l.room]; !seen {
+			rooms = append(rooms, l.room)
+		}
+		byRoom[l.room] = append(byRoom[l.room], l)
+	}
+
+	for _, room := range rooms {
+		lines := byRoom[room]
+
+		if len(lines) > backlogReplay {
+			seen := make(map[string]bool)
+			var speakers []string
+			for _, l := range lines {
+				if l.who != "" && !seen[l.who] {
+					seen[l.who] = true
+					speakers = append(speakers, l.who)
+				}
+			}
+
+			summary := fmt.Sprintf("Missed %d lines while disconnected from %s", len(lines), t.Name())
+			if len(speakers) > 0 {
+				summary += " (from " + strings.Join(speakers, ", ") + ")"
+			}
+			t.Send(room, fmt.Sprintf("%s, the last %d:", summary, backlogReplay))
+			lines = lines[len(lines)-backlogReplay:]
+		}
+
+		for _, l := range lines {
+			t.Send(room, l.text)
+		}
+	}
+}